@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+const (
+	//Evidence of the TEE for the workload, read-only in the container
+	rakshAttestationMountPoint = rakshMountPoint + "/attestation"
+	rakshAttestationVMTEEDir   = rakshVMTEEMountPoint + "/attestation"
+	attestationFileName        = "evidence.json"
+
+	attestationVersion   = 1
+	attestationNonceSize = 32
+)
+
+//Evidence of the TEE bound to the container. The report data of the
+//evidence is SHA-512(nonce || SHA-256(decrypted properties)), which a
+//relying party recomputes from the nonce and the properties it deployed.
+type containerAttestation struct {
+	Version   int    `json:"version"`
+	Container string `json:"container"`
+	//Fresh for each container
+	Nonce string `json:"nonce"`
+	//SHA-256 of the decrypted properties
+	SpecDigest string           `json:"specDigest"`
+	Evidence   *crypto.Evidence `json:"evidence"`
+}
+
+//Report data binding the evidence to the nonce and the properties
+func attestationReportData(nonce []byte, specDigest []byte) []byte {
+	digest := sha512.New()
+	digest.Write(nonce)
+	digest.Write(specDigest)
+	return digest.Sum(nil)
+}
+
+//Write the evidence of the TEE for the container and a copy of its event
+//log into files in memory. Returns the directory of the files, empty when
+//the TEE has no attestation.
+func writeAttestation(tee crypto.TEEProvider, containerID string, specDigest [sha256.Size]byte, events *eventLog) (string, error) {
+
+	if tee == nil {
+		log.Info("No attestation evidence for the workload, not running in a VM TEE")
+		return "", nil
+	}
+
+	nonce := make([]byte, attestationNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	evidence, err := tee.GetEvidence(attestationReportData(nonce, specDigest[:]))
+	if errors.Is(err, crypto.ErrNoAttestation) {
+		log.Info("No attestation evidence for the workload, the TEE has no attestation")
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(&containerAttestation{
+		Version:    attestationVersion,
+		Container:  containerID,
+		Nonce:      hex.EncodeToString(nonce),
+		SpecDigest: hex.EncodeToString(specDigest[:]),
+		Evidence:   evidence,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(rakshAttestationVMTEEDir, filepath.Base(containerID))
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, attestationFileName), data, 0444)
+	if err != nil {
+		return "", err
+	}
+	eventLog, err := ioutil.ReadFile(events.path)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, eventLogFileName), eventLog, 0444)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Wrote %s attestation evidence for container %s", evidence.Kind, containerID)
+	return dir, nil
+}
+
+//Mount the evidence and event log in srcDir read-only at /etc/raksh/attestation of the
+//container
+func mountAttestation(pid int, bundlePath string, srcDir string) error {
+
+	destPath := filepath.Join(bundlePath, "rootfs", rakshAttestationMountPoint)
+	commands := [][]string{
+		{"mkdir", "-p", destPath},
+		{"mount", "-t", "tmpfs", "-o", "size=1m,mode=0755", "tmpfs", destPath},
+		{"cp", filepath.Join(srcDir, attestationFileName), filepath.Join(srcDir, eventLogFileName), destPath},
+		{"mount", "-o", "remount,ro", destPath},
+	}
+	for _, command := range commands {
+		args := append([]string{"-m", "-p", "-t", strconv.Itoa(pid)}, command...)
+		out, err := exec.Command("nsenter", args...).CombinedOutput()
+		if err != nil {
+			log.Infof("Error in executing %s %s", command[0], err)
+			log.Infof("out %s", string(out))
+			return err
+		}
+	}
+	log.Infof("Mounted the attestation evidence at %s", rakshAttestationMountPoint)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	"github.com/raksh-oci-hook/pkg/kbs"
+	log "github.com/sirupsen/logrus"
+)
+
+//Reference key broker for Raksh, for development and testing of the
+//attestation flow. It is not a hardened production broker, and it has no
+//TDX verifier.
+func main() {
+
+	listen := flag.String("listen", ":8080", "Address to listen on")
+	resources := flag.String("resources", "resources", "Directory of the resources, <repository>/<type>/<tag>")
+	simulatedKey := flag.String("simulated-key", "", "PEM public key of the simulated TEE evidence, accepts simulated TEEs")
+	vcek := flag.String("vcek", "", "PEM VCEK certificate or public key, accepts SEV-SNP TEEs of that platform")
+	policy := flag.String("policy", "", "JSON file of the claims required per TEE, e.g. {\"snp\": {\"measurement\": \"...\"}}, TEEs without claims get nothing")
+	tlsCert := flag.String("tls-cert", "", "PEM TLS certificate")
+	tlsKey := flag.String("tls-key", "", "PEM TLS private key")
+	flag.Parse()
+
+	err := run(*listen, *resources, *simulatedKey, *vcek, *policy, *tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(listen, resources, simulatedKey, vcek, policy, tlsCert, tlsKey string) error {
+
+	broker, err := kbs.NewBroker(resources)
+	if err != nil {
+		return err
+	}
+
+	if simulatedKey != "" {
+		log.Warn("Accepting simulated TEEs, which protect nothing")
+		key, err := readPublicKey(simulatedKey)
+		if err != nil {
+			return err
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s is not an Ed25519 public key", simulatedKey)
+		}
+		broker.SetVerifier(crypto.TEESimulated, kbs.SimulatedVerifier(edKey))
+	}
+	if vcek != "" {
+		key, err := readPublicKey(vcek)
+		if err != nil {
+			return err
+		}
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s is not an ECDSA public key", vcek)
+		}
+		broker.SetVerifier(crypto.TEESNP, kbs.SNPVerifier(ecKey))
+	}
+
+	if policy == "" {
+		log.Warn("No policy, no resources are released")
+	} else {
+		data, err := ioutil.ReadFile(policy)
+		if err != nil {
+			return err
+		}
+		var claims map[crypto.TEEKind]map[string]string
+		err = json.Unmarshal(data, &claims)
+		if err != nil {
+			return fmt.Errorf("invalid policy %s: %s", policy, err)
+		}
+		for kind, required := range claims {
+			broker.SetPolicy(kind, required)
+		}
+	}
+
+	log.Infof("Key broker listening on %s, resources in %s", listen, resources)
+	if tlsCert != "" {
+		return http.ListenAndServeTLS(listen, tlsCert, tlsKey, broker)
+	}
+	log.Warn("Serving without TLS, the resources are still encrypted to the TEE key")
+	return http.ListenAndServe(listen, broker)
+}
+
+//Read the public key of a PEM certificate or public key
+func readPublicKey(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
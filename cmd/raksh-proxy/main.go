@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/raksh-oci-hook/pkg/vsock"
+	log "github.com/sirupsen/logrus"
+)
+
+//Host proxy provisioning the Raksh secrets to Kata guests over vsock.
+//The secrets are encrypted to a key generated in the guest for each
+//request.
+func main() {
+
+	listen := flag.String("listen", "vsock:any:1024", "Address to listen on, vsock:<cid>:<port> or unix:<path>")
+	dir := flag.String("secrets", "secrets", "Directory of the secrets, named as in the Raksh Kubernetes secret")
+	flag.Parse()
+
+	listener, err := vsock.Listen(*listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Host proxy listening on %s, secrets in %s", *listen, *dir)
+	log.Fatal(vsock.NewServer(*dir).Serve(listener))
+}
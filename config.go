@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	"github.com/raksh-oci-hook/pkg/kbs"
+	"github.com/raksh-oci-hook/pkg/vsock"
+)
+
+const (
+	//Hook configuration baked into the guest image
+	rakshHookConfigFile = "/usr/share/raksh/hook.json"
+)
+
+//Hook configuration
+type hookConfig struct {
+	//TEE to get the Raksh secrets from. "auto" (default) to detect it,
+	//"none" to use the Raksh Kubernetes secret, or the TEE kind.
+	TEE string `json:"tee,omitempty"`
+	//Store of the simulated TEE, for development only
+	SimulatedStore string `json:"simulatedStore,omitempty"`
+	//TPM unsealing settings
+	TPM *tpmConfig `json:"tpm,omitempty"`
+	//POWER PEF secure VM settings
+	SVM *svmConfig `json:"svm,omitempty"`
+	//Get the Raksh secrets from a key broker after attesting the TEE
+	KBS *kbsConfig `json:"kbs,omitempty"`
+	//Get the Raksh secrets from the host proxy over vsock
+	Vsock *vsockConfig `json:"vsock,omitempty"`
+
+	//Reconstruct configMapKey from shares instead of reading it whole
+	MasterKey *masterKeyConfig `json:"masterKey,omitempty"`
+	//Register extended with the event log, "auto" (default) for the RTMR
+	//of a TDX guest or the PCR of a TPM, "none", "rtmr" or "pcr"
+	MeasurementRegister string `json:"measurementRegister,omitempty"`
+
+	//Workload identity certificates, issued when the TEE releases the
+	//identity CA
+	Identity *identityConfig `json:"identity,omitempty"`
+	//Refuse containers whose namespace has no trusted image signing keys
+	//in the properties
+	RequireImageSignatures bool `json:"requireImageSignatures,omitempty"`
+	//Withhold the secrets from a guest whose kernel has no Yama LSM to
+	//restrict ptrace
+	RequirePtraceRestriction bool `json:"requirePtraceRestriction,omitempty"`
+}
+
+//Threshold reconstruction of configMapKey
+type masterKeyConfig struct {
+	//Number of shares needed
+	Threshold int `json:"threshold"`
+	//Hex SHA-256 of configMapKey, to tell which shares combine to it
+	KeyCheck string `json:"keyCheck"`
+	//Where to get the shares from
+	Shares []shareSource `json:"shares"`
+}
+
+//TPM unsealing settings, defaults when empty
+type tpmConfig struct {
+	//Device or unix:<path> or tcp:<host:port> of a simulator
+	Device string `json:"device,omitempty"`
+	//Directory of the sealed secrets
+	SealedDir string `json:"sealedDir,omitempty"`
+	//PCRs of the policy, e.g. sha256:0,2,4,7
+	PCRs string `json:"pcrs,omitempty"`
+	//Persistent handle of the parent key
+	Parent uint32 `json:"parent,omitempty"`
+}
+
+//POWER PEF secure VM settings
+type svmConfig struct {
+	//esmb-get-file
+	GetFileTool string `json:"getFileTool,omitempty"`
+	//Timeout of the tool in seconds
+	ToolTimeout int `json:"toolTimeout,omitempty"`
+}
+
+//Key broker settings
+type kbsConfig struct {
+	//URL of the key broker
+	URL string `json:"url"`
+	//PEM CA certificates of the broker, the system CAs when empty
+	CACert string `json:"caCert,omitempty"`
+	//Repository of the resources, <repository>/raksh/<secret> and
+	//<repository>/user/<user secret>
+	Repository string `json:"repository,omitempty"`
+	//User secrets to get from the broker
+	UserSecrets []string `json:"userSecrets,omitempty"`
+}
+
+//Workload identity settings, defaults when empty
+type identityConfig struct {
+	//Trust domain of the SPIFFE IDs
+	TrustDomain string `json:"trustDomain,omitempty"`
+	//Validity of the certificates in hours
+	Validity int `json:"validity,omitempty"`
+}
+
+//Host proxy settings
+type vsockConfig struct {
+	//vsock:<cid>:<port> of the proxy, or unix:<path> for tests
+	Address string `json:"address"`
+}
+
+//Default key broker repository
+const kbsDefaultRepository = "default"
+
+//Detect the TEE
+const teeAuto = "auto"
+
+//Measurement registers
+const (
+	registerPCR  = "pcr"
+	registerRTMR = "rtmr"
+)
+
+//Share source types
+const (
+	//Secret file retrieved from the VM TEE
+	shareSourceTEE = "tee"
+	//File in the Raksh Kubernetes secret
+	shareSourceSecret = "secret"
+	//File in the guest, e.g. provisioned by a local agent
+	shareSourceFile = "file"
+	//HTTPS URL of a local key broker, or HTTP over a unix socket
+	shareSourceBroker = "broker"
+)
+
+//Each combination of threshold shares may have to be tried
+const masterKeyMaxShares = 16
+
+//Source of a configMapKey share. Shares are base64 encoded.
+type shareSource struct {
+	Type string `json:"type"`
+	//File name for tee and secret, path for file, URL for broker
+	Path string `json:"path"`
+	//Unix socket of a broker served over plain HTTP
+	Socket string `json:"socket,omitempty"`
+	//PEM CA certificates of an HTTPS broker, the system CAs when empty
+	CACert string `json:"caCert,omitempty"`
+}
+
+//Load the hook configuration. A missing file is the default configuration.
+func loadHookConfig(path string) (*hookConfig, error) {
+
+	config := &hookConfig{TEE: teeAuto, MeasurementRegister: teeAuto}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("No hook configuration at %s, using defaults", path)
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hook configuration %s: %s", path, err)
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid hook configuration %s: %s", path, err)
+	}
+
+	log.Infof("Loaded hook configuration from %s", path)
+	return config, nil
+}
+
+//Check the configuration is consistent
+func (c *hookConfig) validate() error {
+
+	switch c.TEE {
+	case "":
+		c.TEE = teeAuto
+	case teeAuto, string(crypto.TEENone):
+	default:
+		_, err := crypto.LookupTEEProvider(crypto.TEEKind(c.TEE))
+		if err != nil {
+			return err
+		}
+	}
+
+	switch c.MeasurementRegister {
+	case "":
+		c.MeasurementRegister = teeAuto
+	case teeAuto, string(crypto.TEENone), registerPCR, registerRTMR:
+	default:
+		return fmt.Errorf("unknown measurementRegister %q", c.MeasurementRegister)
+	}
+
+	if c.TPM != nil {
+		if c.TPM.Device == "" {
+			c.TPM.Device = crypto.TPMDevice
+		}
+		if c.TPM.SealedDir == "" {
+			c.TPM.SealedDir = crypto.TPMSealedDir
+		}
+		if c.TPM.PCRs == "" {
+			c.TPM.PCRs = crypto.TPMDefaultPCRs
+		}
+		if c.TPM.Parent == 0 {
+			c.TPM.Parent = crypto.TPMParentHandle
+		}
+		_, err := crypto.ParsePCRSelection(c.TPM.PCRs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.SVM != nil {
+		if c.SVM.GetFileTool == "" {
+			c.SVM.GetFileTool = crypto.ESMBTool
+		}
+		if c.SVM.ToolTimeout < 0 {
+			return fmt.Errorf("negative svm toolTimeout")
+		}
+	}
+
+	if c.KBS != nil {
+		if c.KBS.URL == "" {
+			return fmt.Errorf("kbs has no url")
+		}
+		if c.KBS.Repository == "" {
+			c.KBS.Repository = kbsDefaultRepository
+		}
+		for _, name := range c.KBS.UserSecrets {
+			err := kbs.ValidResourcePath(c.KBS.Repository + "/user/" + name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.Vsock != nil {
+		if c.Vsock.Address == "" {
+			return fmt.Errorf("vsock has no address")
+		}
+		if c.KBS != nil {
+			return fmt.Errorf("only one of kbs and vsock can provide the secrets")
+		}
+	}
+
+	if c.MasterKey != nil {
+		//A single source must never be enough
+		if c.MasterKey.Threshold < 2 {
+			return fmt.Errorf("masterKey threshold must be at least 2")
+		}
+		if len(c.MasterKey.Shares) < c.MasterKey.Threshold {
+			return fmt.Errorf("masterKey has %d shares for threshold %d", len(c.MasterKey.Shares), c.MasterKey.Threshold)
+		}
+		if len(c.MasterKey.Shares) > masterKeyMaxShares {
+			return fmt.Errorf("masterKey has more than %d shares", masterKeyMaxShares)
+		}
+		if keyCheck, err := hex.DecodeString(c.MasterKey.KeyCheck); err != nil || len(keyCheck) != sha256.Size {
+			return fmt.Errorf("masterKey keyCheck must be the hex SHA-256 of configMapKey")
+		}
+		for _, share := range c.MasterKey.Shares {
+			switch share.Type {
+			case shareSourceTEE, shareSourceSecret, shareSourceFile, shareSourceBroker:
+			default:
+				return fmt.Errorf("unknown masterKey share type %q", share.Type)
+			}
+			if share.Path == "" {
+				return fmt.Errorf("masterKey %s share has no path", share.Type)
+			}
+			//Shares must not cross the host in the clear
+			if share.Type == shareSourceBroker && !strings.HasPrefix(share.Path, "https://") &&
+				!(share.Socket != "" && strings.HasPrefix(share.Path, "http://")) {
+				return fmt.Errorf("masterKey broker share %s must use https or a unix socket", share.Path)
+			}
+		}
+	}
+
+	if c.Identity != nil && c.Identity.Validity < 0 {
+		return fmt.Errorf("identity validity must be positive")
+	}
+
+	return nil
+}
+
+//Replace the built-in TEE providers with the configured ones
+func (c *hookConfig) registerTEEProviders() {
+
+	if c.TPM != nil {
+		pcrs, _ := crypto.ParsePCRSelection(c.TPM.PCRs)
+		crypto.RegisterTEEProvider(crypto.NewTPMProvider(c.TPM.Device, c.TPM.SealedDir, pcrs, c.TPM.Parent))
+	}
+	if c.SVM != nil {
+		timeout := time.Duration(c.SVM.ToolTimeout) * time.Second
+		crypto.RegisterTEEProvider(crypto.NewSVMProvider(c.SVM.GetFileTool, timeout))
+	}
+	if c.SimulatedStore != "" {
+		crypto.RegisterTEEProvider(crypto.NewSimulatedProvider(c.SimulatedStore))
+	}
+}
+
+//Select the TEE provider from the configuration or by detection.
+//Returns nil when not running in a TEE.
+func (c *hookConfig) teeProvider() (crypto.TEEProvider, error) {
+
+	c.registerTEEProviders()
+
+	switch c.TEE {
+	case teeAuto:
+		return crypto.DetectTEEProvider(), nil
+	case string(crypto.TEENone):
+		log.Info("Configured not to use a VM TEE")
+		return nil, nil
+	}
+
+	if c.TEE == string(crypto.TEESimulated) {
+		log.Warn("The simulated VM TEE is configured, it must never be used in production")
+	}
+
+	provider, err := crypto.LookupTEEProvider(crypto.TEEKind(c.TEE))
+	if err != nil {
+		return nil, err
+	}
+	//Never fall back to the host visible secrets when the TEE is missing
+	if detection := provider.Detect(); !detection.Detected {
+		return nil, fmt.Errorf("configured TEE %s not detected: %s", c.TEE, detection.Reason)
+	}
+	log.Infof("Using configured VM TEE %s", c.TEE)
+	return provider, nil
+}
+
+//Measurer of the event log, nil when there is no measurement register
+func (c *hookConfig) measurer(tee crypto.TEEProvider) (crypto.Measurer, error) {
+
+	tpmDevice := crypto.TPMDevice
+	if c.TPM != nil {
+		tpmDevice = c.TPM.Device
+	}
+
+	switch c.MeasurementRegister {
+	case string(crypto.TEENone):
+		return nil, nil
+	case registerRTMR:
+		measurer := crypto.NewRTMRMeasurer(crypto.MeasurementRTMR)
+		if measurer == nil {
+			return nil, fmt.Errorf("no TDX RTMR %d", crypto.MeasurementRTMR)
+		}
+		return measurer, nil
+	case registerPCR:
+		return crypto.NewTPMMeasurer(tpmDevice, crypto.MeasurementPCR), nil
+	}
+
+	if tee != nil && tee.Kind() == crypto.TEETDX {
+		if measurer := crypto.NewRTMRMeasurer(crypto.MeasurementRTMR); measurer != nil {
+			return measurer, nil
+		}
+	}
+	if c.TPM != nil {
+		return crypto.NewTPMMeasurer(tpmDevice, crypto.MeasurementPCR), nil
+	}
+	if _, err := os.Stat(tpmDevice); err == nil {
+		return crypto.NewTPMMeasurer(tpmDevice, crypto.MeasurementPCR), nil
+	}
+	log.Info("No measurement register, the event log is not measured")
+	return nil, nil
+}
+
+//Client of the key broker attesting with tee, nil when no broker is
+//configured
+func (c *hookConfig) kbsClient(tee crypto.TEEProvider) (*kbs.Client, error) {
+
+	if c.KBS == nil {
+		return nil, nil
+	}
+	if tee == nil {
+		return nil, fmt.Errorf("the key broker %s needs a VM TEE", c.KBS.URL)
+	}
+	return kbs.NewClient(c.KBS.URL, tee, c.KBS.CACert)
+}
+
+//TDX and SNP guests hold no Raksh secrets, they are only released to
+//their evidence by the key broker. Fail before the container starts instead
+//of finding no secrets in the TEE.
+func (c *hookConfig) checkSecretSource(tee crypto.TEEProvider) error {
+
+	if tee == nil || c.KBS != nil || c.Vsock != nil {
+		return nil
+	}
+	capabilities := tee.Capabilities()
+	if capabilities.LaunchSecrets || capabilities.Sealing {
+		return nil
+	}
+	return fmt.Errorf("the %s TEE holds no Raksh secrets, configure kbs to release them to its evidence", tee.Kind())
+}
+
+//Source of the Raksh secrets, nil to use the Raksh Kubernetes secret
+func (c *hookConfig) secretSource(tee crypto.TEEProvider, broker *kbs.Client) secretSource {
+
+	switch {
+	case broker != nil:
+		return &kbsSecrets{client: broker, prefix: c.KBS.Repository + "/raksh"}
+	case c.Vsock != nil:
+		return vsock.NewClient(c.Vsock.Address)
+	case tee != nil:
+		return tee
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+func TestCheckSecretSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		tee    crypto.TEEKind
+		config hookConfig
+		err    string
+	}{
+		{"no TEE", crypto.TEENone, hookConfig{}, ""},
+		{"tdx", crypto.TEETDX, hookConfig{}, "the tdx TEE holds no Raksh secrets, configure kbs"},
+		{"snp", crypto.TEESNP, hookConfig{}, "the snp TEE holds no Raksh secrets, configure kbs"},
+		{"snp with kbs", crypto.TEESNP, hookConfig{KBS: &kbsConfig{URL: "https://kbs.example.com"}}, ""},
+		{"snp with vsock", crypto.TEESNP, hookConfig{Vsock: &vsockConfig{}}, ""},
+		{"sev", crypto.TEESEV, hookConfig{}, ""},
+		{"tpm", crypto.TEETPM, hookConfig{}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tee crypto.TEEProvider
+			if test.tee != crypto.TEENone {
+				var err error
+				tee, err = crypto.LookupTEEProvider(test.tee)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := test.config.checkSecretSource(tee)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
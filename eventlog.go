@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Append-only, hash-chained log of what the hook consumed and produced for
+//a container. Each event has the SHA-256 digest of its seq, type and data,
+//and the chain SHA-256(previous chain || digest), starting from zeros.
+//With a measurement register, the register is extended with each digest,
+//so that the evidence of the TEE covers the log.
+
+const (
+	rakshEventLogDir = rakshVMTEEMountPoint + "/events"
+	//Name of the copy next to the attestation evidence
+	eventLogFileName = "eventlog.jsonl"
+)
+
+//Event types
+const (
+	eventTEE              = "tee"
+	eventConfigJSON       = "config.json"
+	eventEncryptedSpec    = "encrypted-spec"
+	eventSpecSignature    = "spec-signature"
+	eventDecryptedSpec    = "decrypted-spec"
+	eventImageSignature   = "image-signature"
+	eventRootfs           = "rootfs"
+	eventUserSecret       = "user-secret"
+	eventWorkloadIdentity = "workload-identity"
+)
+
+//An entry of the event log, one JSON object per line
+type event struct {
+	Seq  int               `json:"seq"`
+	Type string            `json:"type"`
+	Data map[string]string `json:"data"`
+	//Hex SHA-256 of the JSON of seq, type and data
+	Digest string `json:"digest"`
+	//Hex running hash of the log
+	Chain string `json:"chain"`
+}
+
+type eventLog struct {
+	path     string
+	file     *os.File
+	seq      int
+	chain    [sha256.Size]byte
+	measurer crypto.Measurer
+}
+
+//Start the event log of the container, extending measurer when not nil.
+//The log of an earlier run of the hook for the container, e.g. when the
+//runtime retries the hook, is continued: its events are already measured.
+func openEventLog(containerID string, measurer crypto.Measurer) (*eventLog, error) {
+
+	err := os.MkdirAll(rakshEventLogDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(rakshEventLogDir, filepath.Base(containerID)+".jsonl")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0400)
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLog{path: path, file: file, measurer: measurer}
+	err = l.resume()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if measurer != nil {
+		log.Infof("Measuring the event log into %s", measurer.Register())
+	}
+	log.Infof("Event log: %s", path)
+	return l, nil
+}
+
+//Restore seq and chain from the events in the log, checking them
+func (l *eventLog) resume() error {
+
+	data, err := ioutil.ReadAll(l.file)
+	if err != nil {
+		return err
+	}
+	//An event cut short by a failed write, its measurement can't be
+	//matched anymore
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		log.Warnf("Dropping the incomplete last event of %s", l.path)
+		err = l.file.Truncate(int64(complete))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, line := range bytes.Split(data[:complete], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e event
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return fmt.Errorf("invalid event %d in %s: %s", l.seq, l.path, err)
+		}
+		digest, err := eventDigest(&e)
+		if err != nil {
+			return err
+		}
+		l.chain = sha256.Sum256(append(l.chain[:], digest[:]...))
+		if e.Seq != l.seq || e.Digest != hex.EncodeToString(digest[:]) || e.Chain != hex.EncodeToString(l.chain[:]) {
+			return fmt.Errorf("event %d in %s doesn't match the log", l.seq, l.path)
+		}
+		l.seq++
+	}
+	if l.seq > 0 {
+		log.Infof("Continuing the event log %s after %d events", l.path, l.seq)
+	}
+	return nil
+}
+
+//Digest of the seq, type and data of e
+func eventDigest(e *event) ([sha256.Size]byte, error) {
+	//Map keys are marshaled sorted, the digest input is canonical
+	measured, err := json.Marshal(&struct {
+		Seq  int               `json:"seq"`
+		Type string            `json:"type"`
+		Data map[string]string `json:"data"`
+	}{e.Seq, e.Type, e.Data})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(measured), nil
+}
+
+//Extend the measurement register with an event and append it. An event
+//which isn't measured is never in the log: a failed write leaves the
+//register ahead of the log instead, which a verifier notices.
+func (l *eventLog) record(eventType string, data map[string]string) error {
+
+	e := &event{Seq: l.seq, Type: eventType, Data: data}
+	digest, err := eventDigest(e)
+	if err != nil {
+		return err
+	}
+	chain := sha256.Sum256(append(l.chain[:], digest[:]...))
+	e.Digest = hex.EncodeToString(digest[:])
+	e.Chain = hex.EncodeToString(chain[:])
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if l.measurer != nil {
+		err = l.measurer.Extend(digest[:])
+		if err != nil {
+			log.Errorf("Unable to extend %s: %s", l.measurer.Register(), err)
+			return err
+		}
+	}
+
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	l.chain = chain
+	l.seq++
+	return nil
+}
+
+func (l *eventLog) close() {
+	l.file.Close()
+}
+
+//Result of a verification for the log
+func verificationResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "valid"
+}
+
+//Record a user secret, its ciphertext digest and whether it was accepted
+func recordUserSecret(events *eventLog, name string, digest string, err error) error {
+	data := map[string]string{"name": name, "result": verificationResult(err)}
+	if digest != "" {
+		data["digest"] = digest
+	}
+	return events.record(eventUserSecret, data)
+}
+
+//Hex SHA-256 of data
+func digestHex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Measurer recording the measurements, or failing
+type fakeMeasurer struct {
+	fail     bool
+	extended [][]byte
+}
+
+func (m *fakeMeasurer) Register() string {
+	return "fake"
+}
+
+func (m *fakeMeasurer) Extend(measurement []byte) error {
+	if m.fail {
+		return errors.New("register unavailable")
+	}
+	m.extended = append(m.extended, append([]byte(nil), measurement...))
+	return nil
+}
+
+//Event log in a temporary file, continuing the events already in it
+func openTestEventLog(t *testing.T, path string, measurer *fakeMeasurer) *eventLog {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &eventLog{path: path, file: file, measurer: measurer}
+	err = l.resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.close)
+	return l
+}
+
+func TestEventLogExtendFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container.jsonl")
+	measurer := &fakeMeasurer{}
+	l := openTestEventLog(t, path, measurer)
+
+	err := l.record(eventTEE, map[string]string{"kind": "snp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The event is not logged without its measurement
+	measurer.fail = true
+	err = l.record(eventConfigJSON, map[string]string{"digest": "00"})
+	if err == nil {
+		t.Fatal("event recorded without extending the register")
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("unmeasured event logged: %s", after[len(before):])
+	}
+	if l.seq != 1 {
+		t.Errorf("seq %d after the failed event", l.seq)
+	}
+
+	//The chain continues from the last measured event
+	measurer.fail = false
+	err = l.record(eventConfigJSON, map[string]string{"digest": "01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(measurer.extended) != 2 {
+		t.Fatalf("%d measurements for 2 events", len(measurer.extended))
+	}
+	resumed := openTestEventLog(t, path, nil)
+	if resumed.seq != 2 || resumed.chain != l.chain {
+		t.Errorf("resumed at seq %d", resumed.seq)
+	}
+}
+
+func TestEventLogResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container.jsonl")
+	l := openTestEventLog(t, path, &fakeMeasurer{})
+	for _, eventType := range []string{eventTEE, eventConfigJSON, eventRootfs} {
+		err := l.record(eventType, map[string]string{"type": eventType})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.close()
+
+	//An event cut short is dropped
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(`{"seq":3,"type":"user`)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := openTestEventLog(t, path, nil)
+	if resumed.seq != 3 || resumed.chain != l.chain {
+		t.Errorf("resumed at seq %d", resumed.seq)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(data, []byte("\n")) != 3 || data[len(data)-1] != '\n' {
+		t.Errorf("log after resuming:\n%s", data)
+	}
+
+	//A changed event is refused
+	err = ioutil.WriteFile(path, bytes.Replace(data, []byte(`"type":"rootfs"`), []byte(`"type":"other"`), 1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = (&eventLog{path: path, file: file}).resume()
+	if err == nil {
+		t.Error("changed event log resumed")
+	}
+}
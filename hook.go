@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/raksh-oci-hook/pkg/crypto"
 	"github.com/sirupsen/logrus"
 
 	runSpec "github.com/opencontainers/runtime-spec/specs-go"
@@ -29,10 +31,21 @@ const (
 	//Raksh secrets
 	configMapKeyFileName = "configMapKey"
 	imageKeyFileName     = "imageKey"
-	nonceFileName        = "nonce"
+	envelopeKeyFileName  = "envelopeKey"
+	//CA issuing the workload identities, only released to a VM TEE
+	identityCAFileName = "identityCA"
 
-	//Raksh properties
-	rakshProperties = "properties"
+	//Raksh properties and the deployer signature over it
+	rakshProperties          = "properties"
+	rakshPropertiesSignature = "signature"
+
+	//Trusted deployer keys
+	//Baked into the guest image or delivered by the VM TEE
+	rakshTrustedKeysDir = "/usr/share/raksh/trusted-keys"
+	trustedKeysFileName = "trustedKeys"
+
+	//Suffix of the user secret holding the deployer signature of a user secret
+	userSecretSignatureSuffix = ".sig"
 
 	//VM TEE mount points (in-memory)
 	rakshVMTEEMountPoint           = "/run/raksh"
@@ -48,7 +61,7 @@ var (
 
 func init() {
 
-	log.Out = os.Stdout
+	log.Out = os.Stderr
 
 	dname, err := ioutil.TempDir("", "hooklog")
 	fname := filepath.Join(dname, "hook.log")
@@ -64,10 +77,11 @@ func init() {
 
 func main() {
 
-	log.Info("Started Raksh OCI hook version %s", version)
+	log.Infof("Started Raksh OCI hook version %s", version)
 
 	start := flag.Bool("s", true, "Start the hook")
 	printVersion := flag.Bool("version", false, "Print the hook's version")
+	configFile := flag.String("config", rakshHookConfigFile, "Hook configuration file")
 	flag.Parse()
 
 	if *printVersion {
@@ -75,9 +89,41 @@ func main() {
 		os.Exit(0)
 	}
 
+	//Commands besides the pre-start hook
+	var command func() error
+	switch flag.Arg(0) {
+	case "detect":
+		//Print the TEE detection report
+		command = func() error { return printDetectionReport(*configFile) }
+	case "decrypt-layer":
+		//Decrypt an encrypted image layer with imageKey
+		command = func() error { return decryptLayerCommand(*configFile, flag.Args()[1:]) }
+	case "rootfs-digest":
+		//Print the rootfs digest for the properties
+		command = func() error { return rootfsDigestCommand(flag.Args()[1:]) }
+	case "seal":
+		//Encrypt the properties or a user secret to envelopeKey
+		command = func() error { return sealCommand(flag.Args()[1:]) }
+	case "keyprovider":
+		//Unwrap layer keys for the image puller with imageKey
+		command = func() error { return keyProviderCommand(*configFile, flag.Args()[1:]) }
+	}
+	if command != nil {
+		if err := command(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *start {
 		log.Info("Starting Raksh OCI pre-start hook")
-		if err := startRakshHook(); err != nil {
+		config, err := loadHookConfig(*configFile)
+		if err != nil {
+			log.Info(err)
+			return
+		}
+		if err := startRakshHook(config); err != nil {
 			//log.Fatal(err)
 			log.Info(err)
 			return
@@ -85,8 +131,34 @@ func main() {
 	}
 }
 
+//Print the detection report of the TEE providers as JSON
+func printDetectionReport(configFile string) error {
+	config, err := loadHookConfig(configFile)
+	if err != nil {
+		return err
+	}
+	config.registerTEEProviders()
+
+	report := crypto.ProbeTEE()
+	debug, err := checkGuestDebuggable(guestRoot, config.RequirePtraceRestriction)
+	if err != nil {
+		debug = &debugReport{Error: err.Error()}
+	}
+	data, err := json.MarshalIndent(&struct {
+		//The tee setting of the configuration
+		Configured string `json:"configured"`
+		*crypto.DetectionReport
+		Debug *debugReport `json:"debug"`
+	}{config.TEE, report, debug}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
 // Modify the Raksh secrets mount-point
-func startRakshHook() error {
+func startRakshHook(config *hookConfig) error {
 	//Hook receives container State in Stdin
 	//https://github.com/opencontainers/runtime-spec/blob/master/config.md#posix-platform-hooks
 	//https://github.com/opencontainers/runtime-spec/blob/master/runtime.md#state
@@ -125,32 +197,136 @@ func startRakshHook() error {
 	log.Infof("Source mount path for Raksh encrypted config Map is %s", rakshEncConfigMapMountPath)
 
 	//Read the Raksh secrets
-	// /etc/raksh/secrets/{configMapKey, nonce, imageKey}
-	configMapKey, nonce, imageKey, err := readRakshSecrets(rakshSecretSrcMountPath)
+	// /etc/raksh/secrets/{configMapKey, imageKey, envelopeKey}
+	tee, err := config.teeProvider()
+	if err != nil {
+		log.Errorf("unable to select the VM TEE %s", err)
+		return err
+	}
+	err = checkGuestIntegrity(tee, config)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	err = config.checkSecretSource(tee)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	//Record what the container is started with
+	measurer, err := config.measurer(tee)
+	if err != nil {
+		log.Errorf("unable to select the measurement register %s", err)
+		return err
+	}
+	events, err := openEventLog(s.ID, measurer)
+	if err != nil {
+		log.Errorf("unable to open the event log %s", err)
+		return err
+	}
+	defer events.close()
+	teeData := map[string]string{"kind": string(crypto.TEENone)}
+	if tee != nil {
+		teeData["kind"] = string(tee.Kind())
+	}
+	if measurer != nil {
+		teeData["register"] = measurer.Register()
+	}
+	err = events.record(eventTEE, teeData)
+	if err != nil {
+		return err
+	}
+	configJSON, err := ioutil.ReadFile(filepath.Join(configJsonPath, "config.json"))
+	if err != nil {
+		return err
+	}
+	err = events.record(eventConfigJSON, map[string]string{"digest": digestHex(configJSON)})
+	if err != nil {
+		return err
+	}
+
+	broker, err := config.kbsClient(tee)
+	if err != nil {
+		log.Errorf("unable to set up the key broker client %s", err)
+		return err
+	}
+	secrets, err := readRakshSecrets(rakshSecretSrcMountPath, config, tee, config.secretSource(tee, broker))
 	if err != nil {
 		log.Errorf("unable to read Raksh secret data %s", err)
 		return err
 	}
-	log.Debugf("Raksh encrypted secrets %v, %v, %v", configMapKey, nonce, imageKey)
+	defer secrets.destroy()
+	log.Debugf("Raksh secrets of %d, %d bytes", secrets.configMapKey.Len(), secrets.imageKey.Len())
+
+	envelopeKeys, err := secrets.envelopeKeys()
+	if err != nil {
+		return err
+	}
 
 	//Read the encrypted configMap - properties
 	// /etc/raksh/secrets/spec/properties
 	encConfigMapFile := filepath.Join(rakshEncConfigMapMountPath, rakshProperties)
-	encConfigMap, err := readSecretFile(encConfigMapFile)
+	encConfigMap, err := readEncryptedFile(encConfigMapFile)
 	if err != nil {
 		log.Errorf("Unable to read encConfigMap: %s", err)
 		return err
 	}
 
 	log.Debugf("encrypted configMap %v", encConfigMap)
+	err = events.record(eventEncryptedSpec, map[string]string{"digest": digestHex(encConfigMap)})
+	if err != nil {
+		return err
+	}
 
-	scConfig, err := readEncryptedConfigmap(encConfigMap, configMapKey, nonce)
+	//Only use a configMap signed by a trusted deployer
+	// /etc/raksh/spec/signature
+	trustedKeys, err := loadTrustedKeys(secrets.attested)
+	if err != nil {
+		log.Errorf("Unable to load trusted deployer keys: %s", err)
+		return err
+	}
+	encConfigMapSigFile := filepath.Join(rakshEncConfigMapMountPath, rakshPropertiesSignature)
+	err = verifyDeployerSignature(trustedKeys, encConfigMap, encConfigMapSigFile)
+	if recordErr := events.record(eventSpecSignature, map[string]string{"result": verificationResult(err)}); recordErr != nil {
+		return recordErr
+	}
+	if err != nil {
+		log.Errorf("Refusing to use encConfigMap: %s", err)
+		return err
+	}
+
+	//Envelope versions already seen, to reject rolled back properties and user secrets
+	versions, err := openVersionStore()
+	if err != nil {
+		return err
+	}
+
+	scConfig, workload, err := readEncryptedConfigmap(encConfigMap, envelopeKeys, versions)
 	if err != nil {
 		log.Errorf("readEncryptedConfigmap errored out: %s", err)
 		return err
 	}
 
 	log.Debugf("decrypted configMap %v", scConfig)
+	err = events.record(eventDecryptedSpec, map[string]string{"digest": hex.EncodeToString(scConfig.digest[:]), "workload": workload})
+	if err != nil {
+		return err
+	}
+
+	//Only images signed by a trusted key get the secrets
+	err = verifyImageSignature(config, scConfig, s.Annotations, events)
+	if err != nil {
+		log.Errorf("Refusing to deliver secrets: %s", err)
+		return err
+	}
+
+	//The host provided rootfs must be the one of the properties
+	err = verifyRootfs(scConfig, s.Annotations, filepath.Join(bundlePath, "rootfs"), events)
+	if err != nil {
+		log.Errorf("Refusing to deliver secrets: %s", err)
+		return err
+	}
 
 	//Read user secrets
 	// /etc/raksh/secrets/user/{key=value}
@@ -163,20 +339,56 @@ func startRakshHook() error {
 	}
 	log.Infof("Source mount path for Raksh encrypted user secrets is %s", rakshEncUserSecretMountPath)
 
-        userSecretData := filepath.Join(rakshEncUserSecretMountPath, "..data")
-	userSecrets, err := readRakshUserSecrets(userSecretData, configMapKey, nonce)
+	userSecretData := filepath.Join(rakshEncUserSecretMountPath, "..data")
+	userSecrets, err := readRakshUserSecrets(userSecretData, envelopeKeys, workload, scConfig.Metadata.Namespace, versions, trustedKeys, events)
 	if err != nil {
 		log.Errorf("readRakshUserSecrets errored out: %s", err)
 		return err
 	}
 
-	log.Debugf("decrypted user secrets %v", userSecrets)
+	err = readKBSUserSecrets(broker, config, userSecrets, events)
+	if err != nil {
+		log.Errorf("readKBSUserSecrets errored out: %s", err)
+		return err
+	}
+
+	for name, value := range userSecrets {
+		log.Debugf("decrypted user secret %s", name)
+		defer value.Destroy()
+	}
 
 	err = modifyRakshBindMount(containerPid, bundlePath)
 	if err != nil {
-		log.Infof("Error modifying the Raksh mount point", err)
+		log.Infof("Error modifying the Raksh mount point %s", err)
+		return err
+	}
+
+	//Key pair and certificate for mTLS between the workloads
+	identityDir, err := issueWorkloadIdentity(config, secrets, scConfig, s.ID, s.Annotations, events)
+	if err != nil {
+		log.Errorf("Unable to issue the workload identity: %s", err)
 		return err
 	}
+	if identityDir != "" {
+		defer os.RemoveAll(identityDir)
+		err = copyWorkloadIdentity(containerPid, bundlePath, identityDir)
+		if err != nil {
+			log.Errorf("Unable to copy the workload identity: %s", err)
+			return err
+		}
+	}
+
+	//Evidence for the workload to prove it runs in the TEE
+	attestationDir, err := writeAttestation(tee, s.ID, scConfig.digest, events)
+	if err != nil {
+		log.Errorf("Unable to get the attestation evidence for the workload: %s", err)
+	} else if attestationDir != "" {
+		defer os.RemoveAll(attestationDir)
+		err = mountAttestation(containerPid, bundlePath, attestationDir)
+		if err != nil {
+			log.Errorf("Unable to mount the attestation evidence: %s", err)
+		}
+	}
 
 	return nil
 }
@@ -229,12 +441,12 @@ func modifyRakshBindMount(pid int, bundlePath string) error {
 	cmd := exec.Command("nsenter", args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Infof("Error in executing mount ", err)
-		log.Infof("out ", string(out))
+		log.Infof("Error in executing mount %s", err)
+		log.Infof("out %s", string(out))
 		return err
 	}
 
-	log.Debugf("Existing mount list inside the container : ", string(out))
+	log.Debugf("Existing mount list inside the container : %s", string(out))
 
 	//Unmount raksh properties
 	mntDest := filepath.Join(bundlePath, "rootfs", rakshEncConfigMapPath)
@@ -242,8 +454,8 @@ func modifyRakshBindMount(pid int, bundlePath string) error {
 	cmd = exec.Command("nsenter", args...)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		log.Infof("Error in executing umount for %s", mntDest, err)
-		log.Infof("out ", string(out))
+		log.Infof("Error in executing umount for %s %s", mntDest, err)
+		log.Infof("out %s", string(out))
 		return err
 	}
 
@@ -256,8 +468,8 @@ func modifyRakshBindMount(pid int, bundlePath string) error {
 	cmd = exec.Command("nsenter", args...)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		log.Infof("Error in executing umount for %s ", mntDest, err)
-		log.Infof("out ", string(out))
+		log.Infof("Error in executing umount for %s %s", mntDest, err)
+		log.Infof("out %s", string(out))
 		return err
 	}
 
@@ -267,8 +479,8 @@ func modifyRakshBindMount(pid int, bundlePath string) error {
 	cmd = exec.Command("nsenter", args...)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		log.Infof("Error in executing umount for %s ", mntDest, err)
-		log.Infof("out ", string(out))
+		log.Infof("Error in executing umount for %s %s", mntDest, err)
+		log.Infof("out %s", string(out))
 		return err
 	}
 
@@ -279,8 +491,8 @@ func modifyRakshBindMount(pid int, bundlePath string) error {
         cmd = exec.Command("nsenter", args...)
         out, err = cmd.CombinedOutput()
         if err != nil {
-                log.Infof("Error in executing tmpfs mount ", err)
-                log.Infof("out ", string(out))
+                log.Infof("Error in executing tmpfs mount %s", err)
+                log.Infof("out %s", string(out))
                 return err
         }
 
@@ -288,11 +500,11 @@ func modifyRakshBindMount(pid int, bundlePath string) error {
         cmd = exec.Command("nsenter", args...)
         out, err = cmd.CombinedOutput()
         if err != nil {
-                log.Infof("Error in executing copy command ", err)
-                log.Infof("out ", string(out))
+                log.Infof("Error in executing copy command %s", err)
+                log.Infof("out %s", string(out))
                 return err
         }
-        log.Infof("ls out ", string(out))
+        log.Infof("ls out %s", string(out))
 
 	log.Infof("Modifying bind mount complete")
 	return nil
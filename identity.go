@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+const (
+	//Workload identity of the container, under /etc/raksh/secrets
+	rakshIdentityDir      = "identity"
+	rakshIdentityVMTEEDir = rakshVMTEEMountPoint + "/identity"
+
+	identityCertFileName     = "tls.crt"
+	identityKeyFileName      = "tls.key"
+	identityCABundleFileName = "ca.crt"
+
+	identityDefaultTrustDomain = "raksh"
+	identityDefaultValidity    = 24 * time.Hour
+
+	//Container name annotations of containerd and CRI-O
+	containerdContainerNameAnnotation = "io.kubernetes.cri.container-name"
+	crioContainerNameAnnotation       = "io.kubernetes.container.name"
+)
+
+//Identity of the container from the decrypted properties
+func workloadIdentity(config *hookConfig, scConfig *scConfig, annotations map[string]string) (*crypto.WorkloadIdentity, error) {
+
+	if scConfig.Metadata.Name == "" || scConfig.Metadata.Namespace == "" {
+		return nil, fmt.Errorf("the properties have no pod name and namespace")
+	}
+
+	container, err := scConfig.container(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	trustDomain := identityDefaultTrustDomain
+	if config.Identity != nil && config.Identity.TrustDomain != "" {
+		trustDomain = config.Identity.TrustDomain
+	}
+	return &crypto.WorkloadIdentity{
+		TrustDomain: trustDomain,
+		Namespace:   scConfig.Metadata.Namespace,
+		Pod:         scConfig.Metadata.Name,
+		Container:   container.Name,
+	}, nil
+}
+
+//Issue the identity certificate of the container with the identity CA
+//of the TEE. Returns the directory of the certificate, key and CA bundle,
+//empty when the TEE released no identity CA. The certificate is recorded in
+//events.
+func issueWorkloadIdentity(config *hookConfig, secrets *rakshSecrets, scConfig *scConfig, containerID string, annotations map[string]string, events *eventLog) (string, error) {
+
+	if secrets.identityCA.Len() == 0 {
+		log.Info("No identity CA, the container gets no workload identity")
+		return "", nil
+	}
+	ca, err := crypto.ParseIdentityCA(secrets.identityCA.Bytes())
+	if err != nil {
+		return "", err
+	}
+	id, err := workloadIdentity(config, scConfig, annotations)
+	if err != nil {
+		return "", err
+	}
+
+	validity := identityDefaultValidity
+	if config.Identity != nil && config.Identity.Validity > 0 {
+		validity = time.Duration(config.Identity.Validity) * time.Hour
+	}
+	cert, key, err := ca.Issue(id, validity)
+	if err != nil {
+		return "", err
+	}
+	defer key.Destroy()
+	uri, _ := id.URI()
+	err = events.record(eventWorkloadIdentity, map[string]string{"id": uri.String(), "digest": digestHex(cert)})
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(rakshIdentityVMTEEDir, filepath.Base(containerID))
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	//Only the certificates are readable by others
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{identityCertFileName, cert, 0644},
+		{identityKeyFileName, key.Bytes(), 0600},
+		{identityCABundleFileName, ca.Bundle(), 0644},
+	}
+	for _, file := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, file.name), file.data, file.perm)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	log.Infof("Issued the workload identity %s", uri)
+	return dir, nil
+}
+
+//Copy the workload identity in srcDir into the secrets tmpfs of the
+//container
+func copyWorkloadIdentity(pid int, bundlePath string, srcDir string) error {
+
+	destPath := filepath.Join(bundlePath, "rootfs", rakshSecretMountPoint, rakshIdentityDir)
+	commands := [][]string{
+		{"mkdir", "-p", destPath},
+		{"cp", filepath.Join(srcDir, identityCertFileName), filepath.Join(srcDir, identityKeyFileName),
+			filepath.Join(srcDir, identityCABundleFileName), destPath},
+	}
+	for _, command := range commands {
+		args := append([]string{"-m", "-p", "-t", strconv.Itoa(pid)}, command...)
+		out, err := exec.Command("nsenter", args...).CombinedOutput()
+		if err != nil {
+			log.Infof("Error in executing %s %s", command[0], err)
+			log.Infof("out %s", string(out))
+			return err
+		}
+	}
+	log.Infof("Copied the workload identity to %s", filepath.Join(rakshSecretMountPoint, rakshIdentityDir))
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	"github.com/raksh-oci-hook/pkg/ocicrypt"
+)
+
+//OCI descriptor of an image layer
+type layerDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+//Keys unwrapping the layer keys of encrypted images. imageKey is only
+//taken from a VM TEE, so that confidential images can only be decrypted
+//in an attested guest. The caller destroys the returned buffer.
+func loadImageKeys(config *hookConfig) (*crypto.EnvelopeKeys, *crypto.SecureBuffer, error) {
+
+	tee, err := config.teeProvider()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tee == nil {
+		return nil, nil, fmt.Errorf("image decryption needs a VM TEE")
+	}
+	err = checkGuestIntegrity(tee, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = config.checkSecretSource(tee)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//The secrets of an earlier container or call are already in memory
+	imageKeyFile := filepath.Join(rakshSecretVMTEEMountPoint, imageKeyFileName)
+	if fileExists(imageKeyFile) != nil {
+		broker, err := config.kbsClient(tee)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = config.secretSource(tee, broker).FetchSecrets(rakshSecretVMTEEMountPoint, imageKeyFileName)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	imageKey, err := readSecretFile(imageKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	private, err := crypto.ParsePrivateKey(imageKey.Bytes())
+	if err != nil && imageKey.Len() == 32 {
+		//A raw key is an X25519 private key
+		private, err = ecdh.X25519().NewPrivateKey(imageKey.Bytes())
+	}
+	if err != nil {
+		imageKey.Destroy()
+		return nil, nil, fmt.Errorf("imageKey is not a private key: %s", err)
+	}
+	return &crypto.EnvelopeKeys{Private: private}, imageKey, nil
+}
+
+//decrypt-layer -descriptor <file> [-in <file>] -out <file>
+//Decrypt an ocicrypt encrypted layer, described by its OCI descriptor,
+//with imageKey. The output is only written when the layer is authentic.
+func decryptLayerCommand(configFile string, args []string) error {
+
+	flags := flag.NewFlagSet("decrypt-layer", flag.ContinueOnError)
+	descriptorFile := flags.String("descriptor", "", "OCI descriptor of the layer (JSON)")
+	in := flags.String("in", "-", "Encrypted layer, - for stdin")
+	out := flags.String("out", "", "Decrypted layer")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *descriptorFile == "" || *out == "" {
+		return fmt.Errorf("usage: decrypt-layer -descriptor <file> [-in <file>] -out <file>")
+	}
+
+	data, err := ioutil.ReadFile(*descriptorFile)
+	if err != nil {
+		return err
+	}
+	var descriptor layerDescriptor
+	err = json.Unmarshal(data, &descriptor)
+	if err != nil {
+		return fmt.Errorf("invalid layer descriptor %s: %s", *descriptorFile, err)
+	}
+	if !strings.HasSuffix(descriptor.MediaType, ocicrypt.MediaTypeSuffix) {
+		return fmt.Errorf("layer %s is not encrypted", descriptor.Digest)
+	}
+
+	config, err := loadHookConfig(configFile)
+	if err != nil {
+		return err
+	}
+	keys, imageKey, err := loadImageKeys(config)
+	if err != nil {
+		return err
+	}
+	defer imageKey.Destroy()
+
+	input := os.Stdin
+	if *in != "-" {
+		input, err = os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+	//The descriptor digest is over the encrypted layer
+	encryptedDigest := sha256.New()
+	reader := io.TeeReader(input, encryptedDigest)
+
+	output, err := ioutil.TempFile(filepath.Dir(*out), ".decrypt-layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	err = ocicrypt.DecryptLayer(output, reader, descriptor.Annotations, keys)
+	if err != nil {
+		return fmt.Errorf("layer %s: %s", descriptor.Digest, err)
+	}
+	if descriptor.Digest != "" && descriptor.Digest != "sha256:"+hex.EncodeToString(encryptedDigest.Sum(nil)) {
+		return fmt.Errorf("the digest of layer %s doesn't match", descriptor.Digest)
+	}
+	err = output.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(output.Name(), *out)
+	if err != nil {
+		return err
+	}
+	log.Infof("Decrypted layer %s", descriptor.Digest)
+	return nil
+}
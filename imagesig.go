@@ -0,0 +1,190 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Signatures of the container image, cosign or simple signing payloads
+//signed with Ed25519 or ECDSA keys. The payload binds the repository to
+//the manifest digest.
+//https://github.com/containers/image/blob/main/docs/containers-signature.5.md
+
+const (
+	//Image reference annotations of containerd and CRI-O, as in the pod
+	containerdImageNameAnnotation = "io.kubernetes.cri.image-name"
+	crioImageNameAnnotation       = "io.kubernetes.cri-o.ImageName"
+
+	simpleSigningType = "atomic container signature"
+	cosignType        = "cosign container image signature"
+)
+
+//Image signature policy of the properties
+type imagePolicy struct {
+	//PEM public keys of the image signers, by namespace
+	TrustedKeys map[string]string `yaml:"trustedKeys"`
+	//Signatures delivered with the properties
+	Signatures []imageSignature `yaml:"signatures"`
+}
+
+//Signature of an image, as output by cosign download signature
+type imageSignature struct {
+	Payload         []byte `json:"Payload"`
+	Base64Signature string `json:"Base64Signature"`
+}
+
+//Signed payload
+type signaturePayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+//Verify that the image the container runs from is the one of the
+//properties, signed by a trusted key of the namespace of the properties,
+//and that its rootfs is pinned. Images of namespaces without trusted keys
+//are accepted unless the configuration requires signatures. The result is
+//recorded in events.
+func verifyImageSignature(config *hookConfig, scConfig *scConfig, annotations map[string]string, events *eventLog) error {
+
+	namespace := scConfig.Metadata.Namespace
+	trustedKeysPEM := scConfig.ImagePolicy.TrustedKeys[namespace]
+	if trustedKeysPEM == "" {
+		if config.RequireImageSignatures {
+			return fmt.Errorf("no trusted image signing keys for namespace %q", namespace)
+		}
+		log.Infof("No trusted image signing keys for namespace %q, the image is not verified", namespace)
+		return nil
+	}
+
+	container, err := scConfig.container(annotations)
+	if err != nil {
+		return err
+	}
+	runtimeImage := annotations[containerdImageNameAnnotation]
+	if runtimeImage == "" {
+		runtimeImage = annotations[crioImageNameAnnotation]
+	}
+	//The signature covers the image reference the runtime annotates, not
+	//the rootfs the host provides, which verifyRootfs checks
+	if container.Rootfs == nil {
+		err = errors.New("the rootfs of a signed image must be pinned by digest or verityRootHash")
+	} else {
+		err = verifyImage(trustedKeysPEM, container.Image, runtimeImage, scConfig.ImagePolicy.Signatures)
+	}
+	data := map[string]string{"image": container.Image, "runtimeImage": runtimeImage, "result": verificationResult(err)}
+	if recordErr := events.record(eventImageSignature, data); recordErr != nil {
+		return recordErr
+	}
+	if err != nil {
+		return fmt.Errorf("image %s of container %s: %s", container.Image, container.Name, err)
+	}
+	log.Infof("Verified the signature of image %s", container.Image)
+	return nil
+}
+
+//Verify the image, which must be pinned by digest, with the signatures of
+//the properties. runtimeImage, the image the runtime started the container
+//from, must be pinned to the same digest.
+func verifyImage(trustedKeysPEM string, image string, runtimeImage string, signatures []imageSignature) error {
+
+	keys, err := crypto.ParsePublicKeys([]byte(trustedKeysPEM))
+	if err != nil {
+		return fmt.Errorf("trusted image signing keys: %s", err)
+	}
+	repository, digest, ok := strings.Cut(image, "@")
+	if !ok || !strings.HasPrefix(digest, "sha256:") {
+		return errors.New("the image is not pinned by digest")
+	}
+	repository = normalizeRepository(repository)
+
+	//Otherwise the signature holds for an image which isn't running
+	if runtimeImage == "" {
+		return errors.New("the runtime doesn't annotate the image of the container")
+	}
+	runtimeRepository, runtimeDigest, ok := strings.Cut(runtimeImage, "@")
+	if !ok {
+		return fmt.Errorf("the container runs %s, which is not pinned by digest", runtimeImage)
+	}
+	if runtimeDigest != digest || normalizeRepository(runtimeRepository) != repository {
+		return fmt.Errorf("the container runs %s", runtimeImage)
+	}
+
+	if len(signatures) == 0 {
+		return errors.New("the image is not signed")
+	}
+
+	for _, signature := range signatures {
+		err = verifySignaturePayload(crypto.TrustedKeys(keys), &signature, repository, digest)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Image signature rejected: %s", err)
+	}
+	return err
+}
+
+//Check the signature of the payload, then that the payload is for the
+//repository and the digest
+func verifySignaturePayload(keys crypto.TrustedKeys, signature *imageSignature, repository string, digest string) error {
+
+	sig, err := b64.StdEncoding.DecodeString(signature.Base64Signature)
+	if err != nil {
+		return fmt.Errorf("invalid image signature: %s", err)
+	}
+	err = keys.Verify(signature.Payload, sig)
+	if err != nil {
+		return errors.New("the image signature is not from a trusted key")
+	}
+
+	var payload signaturePayload
+	err = json.Unmarshal(signature.Payload, &payload)
+	if err != nil {
+		return fmt.Errorf("invalid image signature payload: %s", err)
+	}
+	switch payload.Critical.Type {
+	case simpleSigningType, cosignType:
+	default:
+		return fmt.Errorf("unsupported image signature type %q", payload.Critical.Type)
+	}
+	if payload.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("the image signature is for digest %s", payload.Critical.Image.DockerManifestDigest)
+	}
+	signed, _, _ := strings.Cut(payload.Critical.Identity.DockerReference, "@")
+	if normalizeRepository(signed) != repository {
+		return fmt.Errorf("the image signature is for %s", payload.Critical.Identity.DockerReference)
+	}
+	return nil
+}
+
+//Repository of an image reference without tag, with the registry and
+//the library namespace of Docker Hub, e.g. docker.io/library/busybox
+func normalizeRepository(reference string) string {
+
+	slash := strings.LastIndex(reference, "/")
+	if colon := strings.LastIndex(reference, ":"); colon > slash {
+		reference = reference[:colon]
+	}
+	registry, path, ok := strings.Cut(reference, "/")
+	if !ok || !strings.ContainsAny(registry, ".:") && registry != "localhost" {
+		registry, path = "docker.io", reference
+	}
+	if registry == "index.docker.io" {
+		registry = "docker.io"
+	}
+	if registry == "docker.io" && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return registry + "/" + path
+}
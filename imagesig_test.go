@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testImage = "quay.io/org/app@sha256:2fa529f6da728633c66a98cf8a71e9025d5d1200389180e2f5cb0528da63bf54"
+
+//Properties of a payments/app container of testImage, signed by a trusted
+//key of the namespace
+func signedTestProperties(t *testing.T) *scConfig {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository, digest, _ := strings.Cut(testImage, "@")
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":%q}}`,
+		repository, digest, cosignType))
+
+	scConfig := &scConfig{}
+	scConfig.Metadata.Namespace = "payments"
+	scConfig.Spec.Containers = []containers{{Name: "app", Image: testImage}}
+	scConfig.ImagePolicy.TrustedKeys = map[string]string{
+		"payments": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+	scConfig.ImagePolicy.Signatures = []imageSignature{{
+		Payload:         payload,
+		Base64Signature: b64.StdEncoding.EncodeToString(ed25519.Sign(private, payload)),
+	}}
+	return scConfig
+}
+
+func TestVerifyImageSignature(t *testing.T) {
+	annotations := map[string]string{containerdImageNameAnnotation: testImage}
+	tests := []struct {
+		name   string
+		rootfs *rootfsIntegrity
+		image  string
+		err    string
+	}{
+		{"pinned rootfs", &rootfsIntegrity{Paths: []string{"/app"}, Digest: "sha256:00"}, testImage, ""},
+		{"pinned verity", &rootfsIntegrity{VerityRootHash: "00"}, testImage, ""},
+		{"rootfs not pinned", nil, testImage, "the rootfs of a signed image must be pinned"},
+		{"other image", &rootfsIntegrity{VerityRootHash: "00"}, "quay.io/org/other@sha256:00", "the container runs quay.io/org/app"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "container.jsonl")
+			events := openTestEventLog(t, path, &fakeMeasurer{})
+			scConfig := signedTestProperties(t)
+			scConfig.Spec.Containers[0].Rootfs = test.rootfs
+			scConfig.Spec.Containers[0].Image = test.image
+
+			err := verifyImageSignature(&hookConfig{}, scConfig, annotations, events)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+			//Rejected images are recorded as well
+			log, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(log), `"type":"`+eventImageSignature+`"`) {
+				t.Errorf("no %s event in %s", eventImageSignature, log)
+			}
+		})
+	}
+}
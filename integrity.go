@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//A debuggable guest gives the host, or anyone on the guest, a way to read
+//the decrypted secrets. The secrets are withheld from a debuggable guest,
+//unless the TEE is the simulated one, which protects nothing anyway.
+
+const (
+	//Root of the guest file system, a fake one for testing
+	guestRoot = "/"
+
+	procCmdline     = "proc/cmdline"
+	procModules     = "proc/modules"
+	yamaPtraceScope = "proc/sys/kernel/yama/ptrace_scope"
+
+	//Kata agent configuration when agent.config_file isn't set
+	kataAgentConfigFile = "etc/kata-containers/agent.toml"
+)
+
+//Kernel parameters opening a console or a debugger into the guest
+var debugKernelParams = []string{
+	//Kata agent debug console on vsock
+	"agent.debug_console",
+	"agent.debug_console_vport",
+	"agent.devmode",
+	//Kernel debugger
+	"kgdboc",
+	"kgdbwait",
+	"kgdbcon",
+	"ekgdboc",
+	//systemd root shell on tty9
+	"systemd.debug_shell",
+	"systemd.debug-shell",
+}
+
+//Kata agent configuration keys enabling the debug console
+var debugKataAgentSettings = []string{"debug_console", "debug_console_vport", "dev_mode"}
+
+//Kernel modules for debugging or dumping guest memory
+var debugKernelModules = []string{"kgdboc", "kgdbts", "lime", "fmem", "crash", "kprobe_example", "kretprobe_example"}
+
+//Active kprobes, in debugfs and tracefs
+var kprobeFiles = []string{
+	"sys/kernel/debug/kprobes/list",
+	"sys/kernel/tracing/kprobe_events",
+	"sys/kernel/debug/tracing/kprobe_events",
+}
+
+//Debuggability of the guest
+type debugReport struct {
+	Debuggable bool `json:"debuggable"`
+	//What makes the guest debuggable
+	Reasons []string `json:"reasons,omitempty"`
+	//Why the guest couldn't be checked
+	Error string `json:"error,omitempty"`
+}
+
+func (r *debugReport) add(format string, args ...interface{}) {
+	r.Debuggable = true
+	r.Reasons = append(r.Reasons, fmt.Sprintf(format, args...))
+}
+
+//Inspect the kernel command line, the Kata agent configuration, the
+//loaded kernel modules, ptrace and kprobes of the guest at root. A kernel
+//without Yama only counts when requirePtraceRestriction is set. Fails
+//when the guest can't be checked.
+func checkGuestDebuggable(root string, requirePtraceRestriction bool) (*debugReport, error) {
+	report := &debugReport{}
+
+	//Debug parameters can't be ruled out without the command line
+	cmdline, err := ioutil.ReadFile(filepath.Join(root, procCmdline))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the kernel command line for debug parameters: %s", err)
+	}
+	params := strings.Fields(string(cmdline))
+	agentConfigFile := filepath.Join(root, kataAgentConfigFile)
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		for _, debugParam := range debugKernelParams {
+			if name == debugParam && value != "0" && value != "false" {
+				report.add("kernel parameter %s", param)
+			}
+		}
+		if name == "agent.config_file" {
+			agentConfigFile = filepath.Join(root, value)
+		}
+	}
+
+	checkKataAgentConfig(agentConfigFile, report)
+
+	modules, err := os.Open(filepath.Join(root, procModules))
+	if err == nil {
+		scanner := bufio.NewScanner(modules)
+		for scanner.Scan() {
+			module := strings.Fields(scanner.Text())
+			for _, debugModule := range debugKernelModules {
+				if len(module) > 0 && module[0] == debugModule {
+					report.add("kernel module %s", debugModule)
+				}
+			}
+		}
+		modules.Close()
+	}
+
+	//0, like a kernel without Yama, allows any process to ptrace the
+	//processes of its user
+	scope, err := ioutil.ReadFile(filepath.Join(root, yamaPtraceScope))
+	switch {
+	case os.IsNotExist(err):
+		if requirePtraceRestriction {
+			report.add("unrestricted ptrace, the kernel has no Yama LSM and requirePtraceRestriction is set")
+		}
+	case err != nil:
+		return nil, fmt.Errorf("unable to read kernel.yama.ptrace_scope: %s", err)
+	case strings.TrimSpace(string(scope)) == "0":
+		report.add("unrestricted ptrace, kernel.yama.ptrace_scope is 0")
+	}
+
+	for _, file := range kprobeFiles {
+		probes, err := ioutil.ReadFile(filepath.Join(root, file))
+		if err == nil && len(strings.TrimSpace(string(probes))) > 0 {
+			report.add("active kprobes in /%s", file)
+		}
+	}
+
+	return report, nil
+}
+
+//Check the debug console settings of the Kata agent configuration
+func checkKataAgentConfig(configFile string, report *debugReport) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		for _, setting := range debugKataAgentSettings {
+			if key == setting && value != "false" && value != "0" {
+				report.add("Kata agent setting %s = %s", key, value)
+			}
+		}
+	}
+}
+
+//Refuse to release the secrets to a debuggable guest, or to a guest which
+//can't be checked, unless the TEE is the simulated one
+func checkGuestIntegrity(tee crypto.TEEProvider, config *hookConfig) error {
+	simulated := tee != nil && tee.Kind() == crypto.TEESimulated
+	report, err := checkGuestDebuggable(guestRoot, config.RequirePtraceRestriction)
+	if err != nil {
+		if simulated {
+			log.Warnf("Releasing the secrets of the simulated VM TEE to an unchecked guest: %s", err)
+			return nil
+		}
+		return fmt.Errorf("withholding the secrets, the guest can't be checked for debugging: %s", err)
+	}
+	if !report.Debuggable {
+		return nil
+	}
+	for _, reason := range report.Reasons {
+		log.Warn("The guest is debuggable: ", reason)
+	}
+	if simulated {
+		log.Warn("Releasing the secrets of the simulated VM TEE to a debuggable guest")
+		return nil
+	}
+	return fmt.Errorf("withholding the secrets from a debuggable guest: %s", strings.Join(report.Reasons, ", "))
+}
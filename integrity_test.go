@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//Guest root with the files, relative to the root
+func fakeGuestRoot(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestCheckGuestDebuggable(t *testing.T) {
+	hardened := map[string]string{
+		procCmdline:     "console=hvc0 agent.debug_console=0 quiet",
+		procModules:     "virtio_net 61440 0 - Live 0x0000000000000000\n",
+		yamaPtraceScope: "1\n",
+	}
+	with := func(name string, content string) map[string]string {
+		files := make(map[string]string)
+		for file, data := range hardened {
+			files[file] = data
+		}
+		if content == "" {
+			delete(files, name)
+		} else {
+			files[name] = content
+		}
+		return files
+	}
+
+	tests := []struct {
+		name        string
+		files       map[string]string
+		requireYama bool
+		reasons     []string
+	}{
+		{"hardened", hardened, false, nil},
+		{"debug console", with(procCmdline, "console=hvc0 agent.debug_console"), false, []string{"kernel parameter agent.debug_console"}},
+		{"kgdb", with(procCmdline, "kgdboc=ttyS0,115200"), false, []string{"kernel parameter kgdboc=ttyS0,115200"}},
+		{"agent config", with(kataAgentConfigFile, "debug_console = true # on\n"), false, []string{"Kata agent setting debug_console = true"}},
+		{"module", with(procModules, "lime 16384 0 - Live 0x0\n"), false, []string{"kernel module lime"}},
+		{"ptrace scope 0", with(yamaPtraceScope, "0\n"), false, []string{"unrestricted ptrace, kernel.yama.ptrace_scope is 0"}},
+		{"no Yama", with(yamaPtraceScope, ""), false, nil},
+		{"no Yama required", with(yamaPtraceScope, ""), true, []string{"unrestricted ptrace, the kernel has no Yama LSM and requirePtraceRestriction is set"}},
+		{"kprobes", with(kprobeFiles[1], "p:myprobe do_sys_open\n"), false, []string{"active kprobes in /" + kprobeFiles[1]}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := checkGuestDebuggable(fakeGuestRoot(t, test.files), test.requireYama)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Debuggable != (len(test.reasons) != 0) || !reflect.DeepEqual(report.Reasons, test.reasons) {
+				t.Errorf("report %+v, want reasons %q", report, test.reasons)
+			}
+		})
+	}
+}
+
+func TestCheckGuestDebuggableUnreadable(t *testing.T) {
+	root := fakeGuestRoot(t, map[string]string{yamaPtraceScope: "1"})
+	_, err := checkGuestDebuggable(root, false)
+	if err == nil || !strings.Contains(err.Error(), "unable to read the kernel command line") || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("error without a command line = %v", err)
+	}
+
+	//A directory can't be read as ptrace_scope
+	root = fakeGuestRoot(t, map[string]string{procCmdline: "quiet", yamaPtraceScope + "/x": ""})
+	_, err = checkGuestDebuggable(root, false)
+	if err == nil || !strings.Contains(err.Error(), "unable to read kernel.yama.ptrace_scope") {
+		t.Errorf("error with an unreadable ptrace_scope = %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/ocicrypt"
+	"golang.org/x/sys/unix"
+)
+
+//Unix socket addresses of the key provider, as in ocicrypt.conf
+const keyProviderSchemeUnix = "unix:"
+
+//keyprovider [-grpc <address>]
+//ocicrypt key provider unwrapping layer keys with imageKey. Without
+//-grpc, a single request is read from stdin and answered on stdout, as
+//configured in ocicrypt.conf with
+//{"key-providers": {"raksh": {"cmd": {"path": "<hook>", "args": ["keyprovider"]}}}}
+//With -grpc, the layer keys go to any client which connects: the address
+//is a unix socket only root can connect to, or a loopback address.
+func keyProviderCommand(configFile string, args []string) error {
+
+	flags := flag.NewFlagSet("keyprovider", flag.ContinueOnError)
+	address := flags.String("grpc", "", "Serve gRPC on this address, e.g. unix:///run/raksh/keyprovider.sock or 127.0.0.1:50000")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadHookConfig(configFile)
+	if err != nil {
+		return err
+	}
+	keys, imageKey, err := loadImageKeys(config)
+	if err != nil {
+		return err
+	}
+	defer imageKey.Destroy()
+	provider := ocicrypt.NewKeyProvider(keys)
+
+	if *address == "" {
+		return provider.ServeCommand(os.Stdout, os.Stdin)
+	}
+
+	listener, err := listenKeyProvider(*address)
+	if err != nil {
+		return err
+	}
+	//gRPC clients use HTTP/2 without TLS
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: provider, Protocols: &protocols}
+	log.Infof("Key provider listening on %s", listener.Addr())
+	return server.Serve(listener)
+}
+
+//Listen on a unix socket of mode 0600 or on a loopback TCP address
+func listenKeyProvider(address string) (net.Listener, error) {
+
+	if strings.HasPrefix(address, keyProviderSchemeUnix) {
+		//unix:///path and unix:/path as in gRPC targets
+		path := strings.TrimPrefix(strings.TrimPrefix(address, keyProviderSchemeUnix), "//")
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("the key provider socket %s is not an absolute path", path)
+		}
+		//A socket left by a previous key provider
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			err = os.Remove(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		//No other user can connect between the bind and the chmod
+		mask := unix.Umask(0177)
+		listener, err := net.Listen("unix", path)
+		unix.Umask(mask)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("the key provider only listens on a unix socket or a loopback address, any client may unwrap the layer keys")
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyprovider.sock")
+	for _, address := range []string{"unix://" + path, "unix:" + path} {
+		//The socket of the first listener is replaced
+		listener, err := listenKeyProvider(address)
+		if err != nil {
+			t.Fatalf("%s: %s", address, err)
+		}
+		defer listener.Close()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: socket mode %s", address, info.Mode())
+		}
+	}
+
+	listener, err := listenKeyProvider("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	//A file which isn't a socket is kept
+	file := filepath.Join(t.TempDir(), "file")
+	err = ioutil.WriteFile(file, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		err     string
+	}{
+		{"0.0.0.0:50000", "loopback"},
+		{":50000", "loopback"},
+		{"10.0.0.1:50000", "loopback"},
+		{"127.0.0.1", "missing port"},
+		{"unix:keyprovider.sock", "not an absolute path"},
+		{"unix:" + file, "address already in use"},
+	}
+	for _, test := range tests {
+		listener, err := listenKeyProvider(test.address)
+		if err == nil {
+			listener.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.address, err, test.err)
+		}
+	}
+	if _, err := net.Dial("unix", file); err == nil {
+		t.Errorf("%s replaced by a socket", file)
+	}
+}
@@ -3,47 +3,13 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-
-	log "github.com/sirupsen/logrus"
-)
-
-const (
-	rakshVMTEEMountPoint       = "/run/raksh"
-	rakshSecretVMTEEMountPoint = rakshVMTEEMountPoint + "/secrets"
-	configMapKeyFileName       = "configMapKey"
-	imageKeyFileName           = "imageKey"
-	nonceFileName              = "nonce"
+	"errors"
 )
 
-//Returns true if VM TEE (SEV/PEF/MKTME)
-func IsVMTEE() bool {
-	log.Info("Check if running in VM TEE")
-	if isSVM() == true {
-		log.Info("Running in VM TEE")
-		return true
-	}
-	//ToDo support for SEV and MKTME
-	return false
-}
-
-//Get Secrets from VM TEE
-func PopulateSecretsForVMTEE() error {
-	log.Info("Check if SVM")
-
-	if isSVM() == true {
-		err := populateRakshSecretsForSVM()
-		return err
-	}
-
-	//Add user secrets
-	return nil
-}
-
-// DecryptConfigMap decrypts the config map
-func DecryptConfigMap(data []byte, symmKey []byte, nonce []byte) ([]byte, error) {
-	log.Info("Decrypt configMap")
+//Decrypt and authenticate with AES-GCM into a secure buffer
+func gcmOpen(key []byte, nonce []byte, sealed []byte, additionalData []byte) (*SecureBuffer, error) {
 
-	block, err := aes.NewCipher(symmKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -52,12 +18,19 @@ func DecryptConfigMap(data []byte, symmKey []byte, nonce []byte) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	if len(nonce) != aesgcm.NonceSize() || len(sealed) < aesgcm.Overhead() {
+		return nil, errors.New("invalid nonce or ciphertext length")
+	}
 
-	plaintextBytes, err := aesgcm.Open(nil, nonce, data, nil)
+	plaintext, err := NewSecureBuffer(len(sealed) - aesgcm.Overhead())
 	if err != nil {
 		return nil, err
 	}
+	_, err = aesgcm.Open(plaintext.Bytes()[:0], nonce, sealed, additionalData)
+	if err != nil {
+		plaintext.Destroy()
+		return nil, err
+	}
 
-	return plaintextBytes, nil
-
+	return plaintext, nil
 }
@@ -0,0 +1,337 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//The envelope is a JWE in compact or JSON serialization
+//https://tools.ietf.org/html/rfc7516#section-7
+//The protected header, which is part of the GCM additional data, carries
+//the workload, version and validity window of the encrypted item.
+
+const (
+	//Content encryption
+	EncA256GCM = "A256GCM"
+
+	//Key management with the symmetric key
+	AlgDirect = "dir"
+
+	//Allowed clock difference between the deployer and the guest
+	ClockSkew = 5 * time.Minute
+)
+
+var (
+	ErrNotEnvelope = errors.New("not an encrypted envelope")
+	ErrNotYetValid = errors.New("envelope is not yet valid")
+	ErrExpired     = errors.New("envelope has expired")
+)
+
+//EnvelopeHeader is the JWE header
+type EnvelopeHeader struct {
+	Algorithm  string `json:"alg,omitempty"`
+	Encryption string `json:"enc,omitempty"`
+	KeyID      string `json:"kid,omitempty"`
+
+	//Key agreement parameters
+	EphemeralKey *JWK   `json:"epk,omitempty"`
+	PartyUInfo   string `json:"apu,omitempty"`
+	PartyVInfo   string `json:"apv,omitempty"`
+
+	//Workload the item belongs to and its monotonically increasing version
+	Workload string `json:"workload,omitempty"`
+	Version  uint64 `json:"version,omitempty"`
+	//Type of the item, empty for plain user secrets
+	ContentType string `json:"cty,omitempty"`
+
+	//Validity window in seconds since the epoch
+	IssuedAt  int64 `json:"iat,omitempty"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	NotAfter  int64 `json:"exp,omitempty"`
+}
+
+//EnvelopeKeys are the keys available to open envelopes
+type EnvelopeKeys struct {
+	//Symmetric key for direct encryption (configMapKey)
+	//Held by the caller, usually in a SecureBuffer
+	Symmetric []byte
+	//TEE held private key for key agreement or key transport
+	Private gocrypto.PrivateKey
+}
+
+//Envelope is a parsed JWE
+type Envelope struct {
+	//Integrity protected header, the only source of the metadata
+	Header EnvelopeHeader
+
+	aad        []byte
+	recipients []recipient
+	IV         []byte
+	Ciphertext []byte
+	Tag        []byte
+}
+
+//Recipient of the content encryption key
+type recipient struct {
+	//Protected, shared unprotected and per-recipient header combined
+	header       EnvelopeHeader
+	encryptedKey []byte
+}
+
+//JWE JSON serialization, flattened or general
+type jsonEnvelope struct {
+	Protected    string          `json:"protected"`
+	Unprotected  json.RawMessage `json:"unprotected"`
+	Header       json.RawMessage `json:"header"`
+	EncryptedKey string          `json:"encrypted_key"`
+	Recipients   []struct {
+		Header       json.RawMessage `json:"header"`
+		EncryptedKey string          `json:"encrypted_key"`
+	} `json:"recipients"`
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	Tag        string `json:"tag"`
+	AAD        string `json:"aad"`
+}
+
+//Returns true if data looks like an envelope
+func IsEnvelope(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var envelope jsonEnvelope
+		return json.Unmarshal(data, &envelope) == nil && envelope.Ciphertext != ""
+	}
+	return len(data) > 0 && bytes.Count(data, []byte(".")) == 4 &&
+		bytes.IndexFunc(data, func(r rune) bool { return !isBase64URL(r) && r != '.' }) < 0
+}
+
+func isBase64URL(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_'
+}
+
+//Parse the JWE compact or JSON serialization
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	data = bytes.TrimSpace(data)
+	if !IsEnvelope(data) {
+		return nil, ErrNotEnvelope
+	}
+	if data[0] == '{' {
+		return parseJSONEnvelope(data)
+	}
+
+	parts := bytes.Split(data, []byte("."))
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		value, err := b64.RawURLEncoding.DecodeString(string(part))
+		if err != nil {
+			return nil, fmt.Errorf("envelope part %d: %s", i, err)
+		}
+		decoded[i] = value
+	}
+
+	envelope := &Envelope{
+		aad:        parts[0],
+		IV:         decoded[2],
+		Ciphertext: decoded[3],
+		Tag:        decoded[4],
+	}
+	err := json.Unmarshal(decoded[0], &envelope.Header)
+	if err != nil {
+		return nil, fmt.Errorf("envelope header: %s", err)
+	}
+	envelope.recipients = []recipient{{header: envelope.Header, encryptedKey: decoded[1]}}
+	return envelope, nil
+}
+
+//Parse the JWE JSON serialization
+func parseJSONEnvelope(data []byte) (*Envelope, error) {
+	var raw jsonEnvelope
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &Envelope{}
+	fields := []struct {
+		name  string
+		value string
+		dest  *[]byte
+	}{
+		{"iv", raw.IV, &envelope.IV},
+		{"ciphertext", raw.Ciphertext, &envelope.Ciphertext},
+		{"tag", raw.Tag, &envelope.Tag},
+	}
+	for _, field := range fields {
+		*field.dest, err = b64.RawURLEncoding.DecodeString(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("envelope %s: %s", field.name, err)
+		}
+	}
+
+	protected, err := b64.RawURLEncoding.DecodeString(raw.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("envelope protected header: %s", err)
+	}
+	if len(protected) == 0 {
+		return nil, errors.New("envelope has no protected header")
+	}
+	err = json.Unmarshal(protected, &envelope.Header)
+	if err != nil {
+		return nil, fmt.Errorf("envelope protected header: %s", err)
+	}
+	envelope.aad = []byte(raw.Protected)
+	if raw.AAD != "" {
+		envelope.aad = append(envelope.aad, '.')
+		envelope.aad = append(envelope.aad, raw.AAD...)
+	}
+
+	//Flattened serialization has a single implicit recipient
+	if len(raw.Recipients) == 0 {
+		raw.Recipients = append(raw.Recipients, struct {
+			Header       json.RawMessage `json:"header"`
+			EncryptedKey string          `json:"encrypted_key"`
+		}{raw.Header, raw.EncryptedKey})
+	}
+
+	for i, r := range raw.Recipients {
+		header := envelope.Header
+		for _, unprotected := range []json.RawMessage{raw.Unprotected, r.Header} {
+			err = mergeHeader(&header, protected, unprotected)
+			if err != nil {
+				return nil, fmt.Errorf("envelope recipient %d: %s", i, err)
+			}
+		}
+		encryptedKey, err := b64.RawURLEncoding.DecodeString(r.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("envelope recipient %d encrypted key: %s", i, err)
+		}
+		envelope.recipients = append(envelope.recipients, recipient{header: header, encryptedKey: encryptedKey})
+	}
+	return envelope, nil
+}
+
+//Merge an unprotected header into header. Unprotected parameters must
+//not repeat the protected ones, so they can't override the metadata.
+func mergeHeader(header *EnvelopeHeader, protected []byte, unprotected json.RawMessage) error {
+	if len(unprotected) == 0 {
+		return nil
+	}
+
+	var protectedParams, unprotectedParams map[string]json.RawMessage
+	err := json.Unmarshal(protected, &protectedParams)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(unprotected, &unprotectedParams)
+	if err != nil {
+		return err
+	}
+	for name := range unprotectedParams {
+		if _, ok := protectedParams[name]; ok {
+			return fmt.Errorf("header parameter %q is both protected and unprotected", name)
+		}
+	}
+
+	var unprotectedHeader EnvelopeHeader
+	err = json.Unmarshal(unprotected, &unprotectedHeader)
+	if err != nil {
+		return err
+	}
+	if unprotectedHeader.Workload != "" || unprotectedHeader.Version != 0 || unprotectedHeader.IssuedAt != 0 ||
+		unprotectedHeader.NotBefore != 0 || unprotectedHeader.NotAfter != 0 || unprotectedHeader.ContentType != "" {
+		return errors.New("envelope metadata must be in the protected header")
+	}
+	return json.Unmarshal(unprotected, header)
+}
+
+//Decrypt the envelope with the first recipient the keys can unwrap the
+//content key for. This also authenticates the protected header.
+func (e *Envelope) Decrypt(keys *EnvelopeKeys) (*SecureBuffer, error) {
+	log.Info("Decrypt envelope")
+
+	err := errors.New("envelope has no recipients")
+	for _, r := range e.recipients {
+		var cek []byte
+		switch r.header.Algorithm {
+		case AlgDirect:
+			if len(r.encryptedKey) != 0 {
+				return nil, errors.New("unexpected encrypted key for direct encryption")
+			}
+			if len(keys.Symmetric) == 0 {
+				err = errors.New("no symmetric key for direct encryption")
+				continue
+			}
+			cek = keys.Symmetric
+		default:
+			if keys.Private == nil {
+				err = fmt.Errorf("no private key for %s", r.header.Algorithm)
+				continue
+			}
+			cek, err = unwrapContentKey(&r.header, r.encryptedKey, keys.Private)
+			if err != nil {
+				log.Debugf("Unable to unwrap the content key: %s", err)
+				continue
+			}
+			defer Wipe(cek)
+		}
+		if r.header.Encryption != e.Header.Encryption {
+			return nil, errors.New("content encryption must be in the protected header")
+		}
+		return e.decryptContent(cek)
+	}
+	return nil, err
+}
+
+//Decrypt the content with the content encryption key
+func (e *Envelope) decryptContent(cek []byte) (*SecureBuffer, error) {
+	if e.Header.Encryption != EncA256GCM {
+		return nil, fmt.Errorf("unsupported envelope content encryption %q", e.Header.Encryption)
+	}
+	if len(cek) != 32 {
+		return nil, fmt.Errorf("invalid %s key length %d", EncA256GCM, len(cek))
+	}
+	if len(e.Tag) != 16 {
+		return nil, errors.New("invalid envelope tag length")
+	}
+
+	sealed := make([]byte, 0, len(e.Ciphertext)+len(e.Tag))
+	sealed = append(sealed, e.Ciphertext...)
+	sealed = append(sealed, e.Tag...)
+	return gcmOpen(cek, e.IV, sealed, e.aad)
+}
+
+//Check the mandatory metadata and that now is within the validity window
+func (h *EnvelopeHeader) CheckValidity(now time.Time) error {
+	if h.Workload == "" {
+		return errors.New("envelope has no workload")
+	}
+	if h.Version == 0 {
+		return errors.New("envelope has no version")
+	}
+	if h.IssuedAt == 0 || h.NotAfter == 0 {
+		return errors.New("envelope has no validity window")
+	}
+
+	issuedAt := time.Unix(h.IssuedAt, 0)
+	if issuedAt.After(now.Add(ClockSkew)) {
+		return fmt.Errorf("%w: issued in the future at %s", ErrNotYetValid, issuedAt.UTC())
+	}
+	if h.NotBefore != 0 {
+		notBefore := time.Unix(h.NotBefore, 0)
+		if notBefore.After(now.Add(ClockSkew)) {
+			return fmt.Errorf("%w: valid from %s", ErrNotYetValid, notBefore.UTC())
+		}
+	}
+	notAfter := time.Unix(h.NotAfter, 0)
+	if now.Add(-ClockSkew).After(notAfter) {
+		return fmt.Errorf("%w: expired at %s", ErrExpired, notAfter.UTC())
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//Retrieves a file of the ESM blob from the ultravisor
+	ESMBTool = "esmb-get-file"
+	//Default timeout of esmb-get-file
+	ESMBToolTimeout = 30 * time.Second
+)
+
+//Retrieve a secret with esmb-get-file, which asks the ultravisor for a
+//file of the ESM blob
+func runESMBTool(tool string, name string, timeout time.Duration) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, tool, "-f", name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	//Don't wait for children of the tool holding stdout open
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		Wipe(stdout.Bytes())
+		return nil, fmt.Errorf("%s timed out after %s", tool, timeout)
+	}
+	if err != nil {
+		Wipe(stdout.Bytes())
+		log.Errorf("Error executing %s for %s: %s %s", tool, name, err, stderr.String())
+		return nil, err
+	}
+
+	//The tool terminates the file with a newline
+	return bytes.TrimRight(stdout.Bytes(), "\r\n"), nil
+}
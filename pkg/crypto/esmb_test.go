@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Fake esmb-get-file in dir running script
+func fakeESMBTool(t *testing.T, dir string, script string) string {
+	tool := filepath.Join(dir, "esmb-get-file")
+	err := ioutil.WriteFile(tool, []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tool
+}
+
+func TestSVMFetchSecrets(t *testing.T) {
+	dir := t.TempDir()
+	//esmb-get-file ends the file with a newline
+	tool := fakeESMBTool(t, dir, "case \"$2\" in\nconfigMapKey) echo Y29uZmlnTWFwS2V5 ;;\nimageKey) printf 'aW1hZ2VLZXk=\\r\\n' ;;\n*) exit 1 ;;\nesac\n")
+
+	secretsDir := filepath.Join(dir, "secrets")
+	err := NewSVMProvider(tool, time.Second).FetchSecrets(secretsDir, "configMapKey", "imageKey", "envelopeKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"configMapKey": "Y29uZmlnTWFwS2V5",
+		"imageKey":     "aW1hZ2VLZXk=",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(secretsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(secretsDir, "envelopeKey")); !os.IsNotExist(err) {
+		t.Error("envelopeKey written without a secret in the ESM blob")
+	}
+}
+
+func TestESMBToolTimeout(t *testing.T) {
+	tool := fakeESMBTool(t, t.TempDir(), "echo partial\nsleep 5\n")
+
+	start := time.Now()
+	_, err := runESMBTool(tool, "configMapKey", 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	//Tolerated clock skew between the guest and the peers
+	identityClockSkew = 5 * time.Minute
+)
+
+//Kubernetes object names, DNS subdomains
+var identityNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?$`)
+
+//WorkloadIdentity names a container of a pod
+type WorkloadIdentity struct {
+	TrustDomain string
+	Namespace   string
+	Pod         string
+	Container   string
+}
+
+//SPIFFE ID of the identity,
+//spiffe://<trust domain>/ns/<namespace>/pod/<pod>/container/<container>
+func (id *WorkloadIdentity) URI() (*url.URL, error) {
+	for _, name := range []string{id.TrustDomain, id.Namespace, id.Pod, id.Container} {
+		if !identityNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid workload identity name %q", name)
+		}
+	}
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   id.TrustDomain,
+		Path:   "/ns/" + id.Namespace + "/pod/" + id.Pod + "/container/" + id.Container,
+	}, nil
+}
+
+//IdentityCA issues workload certificates
+type IdentityCA struct {
+	//Issuer first, then the rest of the chain
+	certs []*x509.Certificate
+	key   gocrypto.Signer
+}
+
+//Parse the PEM certificates and the private key of the CA. The first
+//certificate is the issuer, its public key must match the private key.
+func ParseIdentityCA(data []byte) (*IdentityCA, error) {
+	ca := &IdentityCA{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ca.certs = append(ca.certs, cert)
+		case "PRIVATE KEY", "EC PRIVATE KEY", "RSA PRIVATE KEY":
+			key, err := parseSigner(block.Bytes)
+			Wipe(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ca.key = key
+		}
+	}
+
+	if len(ca.certs) == 0 || ca.key == nil {
+		return nil, errors.New("the identity CA needs a certificate and a private key")
+	}
+	if !ca.certs[0].IsCA {
+		return nil, errors.New("the identity CA certificate is not a CA")
+	}
+	public, ok := ca.key.Public().(interface{ Equal(gocrypto.PublicKey) bool })
+	if !ok || !public.Equal(ca.certs[0].PublicKey) {
+		return nil, errors.New("the identity CA private key doesn't match its certificate")
+	}
+	return ca, nil
+}
+
+//Private key able to sign certificates
+func parseSigner(der []byte) (gocrypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey, ed25519.PrivateKey, *rsa.PrivateKey:
+			return key.(gocrypto.Signer), nil
+		}
+		return nil, fmt.Errorf("unsupported identity CA key type %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unable to parse the identity CA private key")
+}
+
+//PEM certificates of the CA, for peers to verify the issued certificates
+func (ca *IdentityCA) Bundle() []byte {
+	var bundle []byte
+	for _, cert := range ca.certs {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return bundle
+}
+
+//Generate a P-256 key pair and issue a certificate for it, valid for
+//client and server authentication. Returns the PEM certificate and the
+//PEM PKCS#8 private key.
+func (ca *IdentityCA) Issue(id *WorkloadIdentity, validity time.Duration) ([]byte, *SecureBuffer, error) {
+	uri, err := id.URI()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.certs[0].NotAfter) {
+		notAfter = ca.certs[0].NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         id.Namespace + "/" + id.Pod + "/" + id.Container,
+			OrganizationalUnit: []string{id.Namespace},
+		},
+		URIs:        []*url.URL{uri},
+		NotBefore:   now.Add(-identityClockSkew),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certs[0], key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	Wipe(keyDER)
+	defer Wipe(keyPEM)
+	secureKey, err := NewSecureBuffer(len(keyPEM))
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(secureKey.Bytes(), keyPEM)
+	return certPEM, secureKey, nil
+}
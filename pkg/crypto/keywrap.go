@@ -0,0 +1,258 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+//Key management algorithms for the TEE held private key
+//https://tools.ietf.org/html/rfc7518#section-4.1
+const (
+	AlgECDHES       = "ECDH-ES"
+	AlgECDHESA256KW = "ECDH-ES+A256KW"
+	AlgRSAOAEP      = "RSA-OAEP"
+	AlgRSAOAEP256   = "RSA-OAEP-256"
+)
+
+//JWK is the subset of a JSON Web Key needed for ephemeral public keys
+type JWK struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y,omitempty"`
+	//Key management algorithm the key is used with, if announced
+	Algorithm string `json:"alg,omitempty"`
+}
+
+//Parse a PEM or DER encoded (PKCS#8, SEC 1 or PKCS#1) X25519, ECDSA
+//or RSA private key
+func ParsePrivateKey(data []byte) (gocrypto.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		switch key.(type) {
+		case *ecdh.PrivateKey, *ecdsa.PrivateKey, *rsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(data); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unable to parse private key")
+}
+
+//Unwrap the content encryption key of a recipient with the private key
+func unwrapContentKey(header *EnvelopeHeader, encryptedKey []byte, private gocrypto.PrivateKey) ([]byte, error) {
+	switch header.Algorithm {
+	case AlgECDHES:
+		if len(encryptedKey) != 0 {
+			return nil, errors.New("unexpected encrypted key for direct key agreement")
+		}
+		return deriveECDHESKey(header, private, header.Encryption, 32)
+	case AlgECDHESA256KW:
+		kek, err := deriveECDHESKey(header, private, header.Algorithm, 32)
+		if err != nil {
+			return nil, err
+		}
+		defer Wipe(kek)
+		return aesKeyUnwrap(kek, encryptedKey)
+	case AlgRSAOAEP, AlgRSAOAEP256:
+		rsaKey, ok := private.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s needs an RSA private key", header.Algorithm)
+		}
+		if header.Algorithm == AlgRSAOAEP {
+			return rsa.DecryptOAEP(sha1.New(), nil, rsaKey, encryptedKey, nil)
+		}
+		return rsa.DecryptOAEP(sha256.New(), nil, rsaKey, encryptedKey, nil)
+	}
+	return nil, fmt.Errorf("unsupported envelope key management %q", header.Algorithm)
+}
+
+//Agree on a secret with the ephemeral key of the sender and derive the
+//key with the Concat KDF
+//https://tools.ietf.org/html/rfc7518#section-4.6
+func deriveECDHESKey(header *EnvelopeHeader, private gocrypto.PrivateKey, algorithmID string, keyLen int) ([]byte, error) {
+	if header.EphemeralKey == nil {
+		return nil, errors.New("envelope has no ephemeral public key")
+	}
+
+	var ecdhKey *ecdh.PrivateKey
+	switch key := private.(type) {
+	case *ecdh.PrivateKey:
+		ecdhKey = key
+	case *ecdsa.PrivateKey:
+		var err error
+		ecdhKey, err = key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s needs an X25519 or EC private key", header.Algorithm)
+	}
+
+	epk, err := header.EphemeralKey.ecdhPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if epk.Curve() != ecdhKey.Curve() {
+		return nil, errors.New("ephemeral public key is on a different curve")
+	}
+	z, err := ecdhKey.ECDH(epk)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(z)
+
+	apu, err := b64.RawURLEncoding.DecodeString(header.PartyUInfo)
+	if err != nil {
+		return nil, fmt.Errorf("apu: %s", err)
+	}
+	apv, err := b64.RawURLEncoding.DecodeString(header.PartyVInfo)
+	if err != nil {
+		return nil, fmt.Errorf("apv: %s", err)
+	}
+	return concatKDF(z, []byte(algorithmID), apu, apv, keyLen), nil
+}
+
+//Convert the JWK to a public key for ECDH
+func (k *JWK) ecdhPublicKey() (*ecdh.PublicKey, error) {
+	x, err := b64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("epk x: %s", err)
+	}
+
+	switch {
+	case k.KeyType == "OKP" && k.Curve == "X25519":
+		return ecdh.X25519().NewPublicKey(x)
+	case k.KeyType == "EC":
+		y, err := b64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("epk y: %s", err)
+		}
+		var curve ecdh.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = ecdh.P256()
+		case "P-384":
+			curve = ecdh.P384()
+		case "P-521":
+			curve = ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported epk curve %q", k.Curve)
+		}
+		//Uncompressed point encoding
+		point := append([]byte{4}, x...)
+		return curve.NewPublicKey(append(point, y...))
+	}
+	return nil, fmt.Errorf("unsupported epk type %q curve %q", k.KeyType, k.Curve)
+}
+
+//Single step KDF with SHA-256 from NIST SP 800-56A
+func concatKDF(z []byte, algorithmID []byte, apu []byte, apv []byte, keyLen int) []byte {
+	var otherInfo []byte
+	for _, field := range [][]byte{algorithmID, apu, apv} {
+		otherInfo = binary.BigEndian.AppendUint32(otherInfo, uint32(len(field)))
+		otherInfo = append(otherInfo, field...)
+	}
+	otherInfo = binary.BigEndian.AppendUint32(otherInfo, uint32(keyLen*8))
+
+	var key []byte
+	for counter := uint32(1); len(key) < keyLen; counter++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(otherInfo)
+		key = h.Sum(key)
+	}
+	return key[:keyLen]
+}
+
+//AES Key Wrap
+//https://tools.ietf.org/html/rfc3394#section-2.2.1
+func aesKeyWrap(kek []byte, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errors.New("invalid key length to wrap")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	//Default initial value
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := make([]byte, n*8)
+	copy(r, key)
+
+	buf := make([]byte, 16)
+	defer Wipe(buf)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(a, r...), nil
+}
+
+//AES Key Wrap unwrapping
+//https://tools.ietf.org/html/rfc3394#section-2.2.2
+func aesKeyUnwrap(kek []byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("invalid wrapped key length")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	buf := make([]byte, 16)
+	defer Wipe(buf)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+
+	//Default initial value
+	iv := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	if subtle.ConstantTimeCompare(a, iv) != 1 {
+		Wipe(r)
+		return nil, errors.New("wrapped key integrity check failed")
+	}
+	return r, nil
+}
@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+//RFC 3394 section 4.6, 256 bits of key data with a 256 bit KEK
+func TestAESKeyWrap(t *testing.T) {
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+	want, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+
+	wrapped, err := aesKeyWrap(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wrapped, want) {
+		t.Errorf("wrapped %X", wrapped)
+	}
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Errorf("unwrapped %X", unwrapped)
+	}
+}
+
+func TestSealEnvelopeKeyWrap(t *testing.T) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := NewJWK(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.Algorithm = AlgECDHESA256KW
+
+	sealed, err := SealEnvelope([]byte("resource"), EnvelopeHeader{}, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := ParseEnvelope(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Header.Algorithm != AlgECDHESA256KW {
+		t.Errorf("alg %s", envelope.Header.Algorithm)
+	}
+	plaintext, err := envelope.Decrypt(&EnvelopeKeys{Private: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plaintext.Destroy()
+	if string(plaintext.Bytes()) != "resource" {
+		t.Errorf("plaintext %q", plaintext.Bytes())
+	}
+
+	recipient.Algorithm = AlgRSAOAEP
+	_, err = SealEnvelope([]byte("resource"), EnvelopeHeader{}, recipient)
+	if err == nil {
+		t.Error("sealed with RSA-OAEP to an EC key")
+	}
+}
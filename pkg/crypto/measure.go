@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	//Runtime measurement registers of the TDX guest driver
+	//Documentation/ABI/testing/sysfs-driver-tdx-guest
+	tdxMeasurementsDir = "/sys/class/misc/tdx_guest/measurements"
+
+	//Registers for measurements of the hook. PCR 23 is the application
+	//support PCR, RTMR 3 is left to the workload by the firmware and the
+	//kernel.
+	MeasurementPCR  = 23
+	MeasurementRTMR = 3
+)
+
+//Measurer extends measurements into a register of the TEE, which the
+//evidence of the TEE reports
+type Measurer interface {
+	//Name of the register, e.g. pcr23
+	Register() string
+	//Extend the register with a measurement
+	Extend(measurement []byte) error
+}
+
+//PCR of a TPM
+type tpmMeasurer struct {
+	device string
+	pcr    int
+}
+
+//New measurer extending the PCR of all banks of the TPM at device, see
+//openTPM, with TPM2_PCR_Event
+func NewTPMMeasurer(device string, pcr int) Measurer {
+	return &tpmMeasurer{device: device, pcr: pcr}
+}
+
+func (m *tpmMeasurer) Register() string {
+	return "pcr" + strconv.Itoa(m.pcr)
+}
+
+func (m *tpmMeasurer) Extend(measurement []byte) error {
+	t, err := openTPM(m.device)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	return t.pcrEvent(m.pcr, measurement)
+}
+
+//RTMR of a TDX guest
+type rtmrMeasurer struct {
+	file  string
+	index int
+}
+
+//New measurer extending the RTMR with the SHA-384 of the measurements,
+//nil when the kernel doesn't expose the RTMR
+func NewRTMRMeasurer(index int) Measurer {
+	file := filepath.Join(tdxMeasurementsDir, fmt.Sprintf("rtmr%d:sha384", index))
+	if _, err := os.Stat(file); err != nil {
+		return nil
+	}
+	return &rtmrMeasurer{file: file, index: index}
+}
+
+func (m *rtmrMeasurer) Register() string {
+	return "rtmr" + strconv.Itoa(m.index)
+}
+
+func (m *rtmrMeasurer) Extend(measurement []byte) error {
+	digest := sha512.Sum384(measurement)
+	return ioutil.WriteFile(m.file, digest[:], 0)
+}
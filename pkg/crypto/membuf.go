@@ -0,0 +1,121 @@
+package crypto
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+//SecureBuffer holds key material and plaintext outside of the Go heap,
+//in memory which is locked against swapping, excluded from core dumps
+//and wiped when the buffer is destroyed
+type SecureBuffer struct {
+	mem  []byte
+	data []byte
+}
+
+//Allocate a locked buffer of size bytes
+func NewSecureBuffer(size int) (*SecureBuffer, error) {
+	if size < 0 {
+		return nil, errors.New("negative secure buffer size")
+	}
+
+	pageSize := os.Getpagesize()
+	memSize := (size/pageSize + 1) * pageSize
+	mem, err := unix.Mmap(-1, 0, memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Mlock(mem)
+	if err != nil {
+		//Still better than the Go heap, the buffer is wiped on Destroy
+		log.Warn("Unable to lock secure buffer in memory: ", err)
+	}
+	err = unix.Madvise(mem, unix.MADV_DONTDUMP)
+	if err != nil {
+		log.Debug("Unable to exclude secure buffer from core dumps: ", err)
+	}
+
+	return &SecureBuffer{mem: mem, data: mem[:size]}, nil
+}
+
+//Read all of r into a new secure buffer. size is a hint of the
+//expected length.
+func ReadSecureBuffer(r io.Reader, size int) (*SecureBuffer, error) {
+	buf, err := NewSecureBuffer(size)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	for {
+		if n == len(buf.data) {
+			//Grow into a larger locked buffer, never into the Go heap
+			larger, err := NewSecureBuffer(2*len(buf.data) + 512)
+			if err != nil {
+				buf.Destroy()
+				return nil, err
+			}
+			copy(larger.data, buf.data)
+			buf.Destroy()
+			buf = larger
+		}
+		m, err := r.Read(buf.data[n:])
+		n += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			buf.Destroy()
+			return nil, err
+		}
+	}
+	buf.Truncate(n)
+	return buf, nil
+}
+
+//Returns the contents of the buffer. The slice must not be retained
+//after the buffer is destroyed.
+func (b *SecureBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+//Returns the length of the contents
+func (b *SecureBuffer) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.data)
+}
+
+//Shorten the contents to n bytes, wiping the rest
+func (b *SecureBuffer) Truncate(n int) {
+	Wipe(b.data[n:])
+	b.data = b.data[:n]
+}
+
+//Wipe, unlock and release the buffer
+func (b *SecureBuffer) Destroy() {
+	if b == nil || b.mem == nil {
+		return
+	}
+	Wipe(b.mem)
+	unix.Munlock(b.mem)
+	unix.Munmap(b.mem)
+	b.mem = nil
+	b.data = nil
+}
+
+//Overwrite buf with zeros
+func Wipe(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
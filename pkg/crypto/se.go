@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sysfsRoot = "/sys"
+	//Set to 1 by the kernel in a Secure Execution guest
+	seProtVirtGuest = "firmware/uv/prot_virt_guest"
+	//Secret store in the guest image. The image is encrypted to the
+	//host keys in the SE header, so only the Secure Execution guest can
+	//read the store.
+	seSecretsDir = "/etc/raksh/secure-execution"
+)
+
+//IBM Secure Execution (s390x) guest
+type seProvider struct {
+	//Root of sysfs, a fake one for testing
+	sysfsRoot string
+	//Directory of the secret files, named as the Raksh secrets
+	secretsDir string
+}
+
+//New Secure Execution provider detected through sysfsRoot and reading the
+//secrets from secretsDir
+func newSEProvider(sysfsRoot string, secretsDir string) *seProvider {
+	return &seProvider{sysfsRoot: sysfsRoot, secretsDir: secretsDir}
+}
+
+func (p *seProvider) Kind() TEEKind {
+	return TEESE
+}
+
+func (p *seProvider) Detect() *Detection {
+	data, err := ioutil.ReadFile(filepath.Join(p.sysfsRoot, seProtVirtGuest))
+	if err != nil {
+		return notDetected(TEESE, "no Secure Execution support: %s", err)
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		return notDetected(TEESE, "not a Secure Execution guest")
+	}
+	log.Info("It is a VM with Secure Execution support")
+	return detected(TEESE, nil)
+}
+
+func (p *seProvider) Capabilities() Capabilities {
+	return Capabilities{LaunchSecrets: true}
+}
+
+//Move the named secrets from the protected store into dir, so that they
+//are only available to the first container. A secret which can't be
+//removed from a read-only image is copied.
+func (p *seProvider) FetchSecrets(dir string, names ...string) error {
+
+	log.Debug("Populating secrets for Secure Execution")
+	err := os.MkdirAll(dir, os.ModeDir)
+	if err != nil {
+		log.Error("Unable to create directory for storing Secure Execution secrets ", err)
+		return err
+	}
+
+	for _, name := range names {
+		keyFile := filepath.Join(dir, name)
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("Secrets File exists for: ", keyFile)
+			continue
+		}
+
+		secretFile := filepath.Join(p.secretsDir, filepath.Base(name))
+		secret, err := ioutil.ReadFile(secretFile)
+		if os.IsNotExist(err) {
+			log.Infof("No %s in the Secure Execution secret store", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(keyFile, secret, 0600)
+		Wipe(secret)
+		if err != nil {
+			log.Errorf("Unable to write %s: %s", keyFile, err)
+			return err
+		}
+
+		//The image root is often read-only, the secret then stays in the
+		//encrypted image and only the secrets tmpfs copy is scrubbed
+		err = os.Remove(secretFile)
+		if readOnlyStore(err) {
+			log.Warnf("Unable to delete secret %s from the image, leaving it: %s", secretFile, err)
+		} else if err != nil {
+			log.Errorf("Unable to delete secret %s: %s", secretFile, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Whether err is from a secret store which can't be changed
+func readOnlyStore(err error) bool {
+	return errors.Is(err, syscall.EROFS) || os.IsPermission(err)
+}
+
+//Secure Execution attestation needs a request from the verifier, which
+//the ultravisor encrypts the measurement to
+func (p *seProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	return nil, ErrNoAttestation
+}
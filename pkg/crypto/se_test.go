@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+//Fake sysfs with prot_virt_guest set to value, or without it when empty
+func fakeSESysfs(t *testing.T, value string) string {
+	root := t.TempDir()
+	if value == "" {
+		return root
+	}
+	file := filepath.Join(root, seProtVirtGuest)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(file, []byte(value+"\n"), 0444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestSEDetect(t *testing.T) {
+	tests := []struct {
+		name          string
+		protVirtGuest string
+		detected      bool
+	}{
+		{"secure execution guest", "1", true},
+		{"normal guest", "0", false},
+		{"no ultravisor", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detection := newSEProvider(fakeSESysfs(t, test.protVirtGuest), t.TempDir()).Detect()
+			if detection.Detected != test.detected || detection.Kind != TEESE {
+				t.Errorf("detection = %+v, want detected %t", detection, test.detected)
+			}
+			if !detection.Detected && detection.Reason == "" {
+				t.Error("no reason for the failed detection")
+			}
+		})
+	}
+}
+
+func TestSEFetchSecrets(t *testing.T) {
+	secretsDir := t.TempDir()
+	for name, secret := range map[string]string{"configMapKey": "Y29uZmlnTWFwS2V5", "imageKey": "aW1hZ2VLZXk="} {
+		err := ioutil.WriteFile(filepath.Join(secretsDir, name), []byte(secret), 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(t.TempDir(), "secrets")
+	provider := newSEProvider(fakeSESysfs(t, "1"), secretsDir)
+
+	err := provider.FetchSecrets(dir, "configMapKey", "trustedKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "configMapKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Y29uZmlnTWFwS2V5" {
+		t.Errorf("configMapKey = %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "trustedKeys")); !os.IsNotExist(err) {
+		t.Error("trustedKeys fetched without a secret")
+	}
+
+	//Moved, so that only the first container gets the secrets
+	if _, err := os.Stat(filepath.Join(secretsDir, "configMapKey")); !os.IsNotExist(err) {
+		t.Error("configMapKey left in the secret store")
+	}
+	err = os.Remove(filepath.Join(dir, "configMapKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.FetchSecrets(dir, "configMapKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "configMapKey")); !os.IsNotExist(err) {
+		t.Error("configMapKey fetched twice")
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	tests := []struct {
+		err      error
+		readOnly bool
+	}{
+		{nil, false},
+		{&os.PathError{Op: "remove", Path: "configMapKey", Err: syscall.EROFS}, true},
+		{&os.PathError{Op: "remove", Path: "configMapKey", Err: syscall.EACCES}, true},
+		{&os.PathError{Op: "remove", Path: "configMapKey", Err: syscall.EPERM}, true},
+		{&os.PathError{Op: "remove", Path: "configMapKey", Err: syscall.EIO}, false},
+	}
+	for _, test := range tests {
+		if readOnly := readOnlyStore(test.err); readOnly != test.readOnly {
+			t.Errorf("readOnlyStore(%v) = %t", test.err, readOnly)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+//JWK of an X25519 or NIST curve public key
+func NewJWK(public *ecdh.PublicKey) (*JWK, error) {
+	point := public.Bytes()
+	switch public.Curve() {
+	case ecdh.X25519():
+		return &JWK{KeyType: "OKP", Curve: "X25519", X: b64.RawURLEncoding.EncodeToString(point)}, nil
+	case ecdh.P256(), ecdh.P384(), ecdh.P521():
+		//Uncompressed point encoding
+		size := (len(point) - 1) / 2
+		return &JWK{
+			KeyType: "EC",
+			Curve:   fmt.Sprintf("P-%d", map[int]int{32: 256, 48: 384, 66: 521}[size]),
+			X:       b64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+			Y:       b64.RawURLEncoding.EncodeToString(point[1+size:]),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve %s", public.Curve())
+}
+
+//Encrypt plaintext to the recipient public key with A256GCM into a
+//flattened JSON envelope. The key is agreed with ECDH-ES, and wrapped with
+//A256KW when the recipient announces ECDH-ES+A256KW. header carries the
+//metadata, if any.
+func SealEnvelope(plaintext []byte, header EnvelopeHeader, recipient *JWK) ([]byte, error) {
+	public, err := recipient.ecdhPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := public.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	switch recipient.Algorithm {
+	case "", AlgECDHES:
+		header.Algorithm = AlgECDHES
+	case AlgECDHESA256KW:
+		header.Algorithm = AlgECDHESA256KW
+	default:
+		return nil, fmt.Errorf("unsupported recipient key management %q", recipient.Algorithm)
+	}
+	header.Encryption = EncA256GCM
+	header.EphemeralKey, err = NewJWK(ephemeral.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := ephemeral.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(z)
+	apu, err := b64.RawURLEncoding.DecodeString(header.PartyUInfo)
+	if err != nil {
+		return nil, fmt.Errorf("apu: %s", err)
+	}
+	apv, err := b64.RawURLEncoding.DecodeString(header.PartyVInfo)
+	if err != nil {
+		return nil, fmt.Errorf("apv: %s", err)
+	}
+
+	var cek, encryptedKey []byte
+	if header.Algorithm == AlgECDHES {
+		cek = concatKDF(z, []byte(EncA256GCM), apu, apv, 32)
+	} else {
+		kek := concatKDF(z, []byte(AlgECDHESA256KW), apu, apv, 32)
+		defer Wipe(kek)
+		cek = make([]byte, 32)
+		_, err = rand.Read(cek)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey, err = aesKeyWrap(kek, cek)
+		if err != nil {
+			Wipe(cek)
+			return nil, err
+		}
+	}
+	defer Wipe(cek)
+
+	protectedJSON, err := json.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+	protected := b64.RawURLEncoding.EncodeToString(protectedJSON)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aesgcm.NonceSize())
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aesgcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+
+	return json.Marshal(&struct {
+		Protected    string `json:"protected"`
+		EncryptedKey string `json:"encrypted_key,omitempty"`
+		IV           string `json:"iv"`
+		Ciphertext   string `json:"ciphertext"`
+		Tag          string `json:"tag"`
+	}{
+		Protected:    protected,
+		EncryptedKey: b64.RawURLEncoding.EncodeToString(encryptedKey),
+		IV:           b64.RawURLEncoding.EncodeToString(iv),
+		Ciphertext:   b64.RawURLEncoding.EncodeToString(ciphertext),
+		Tag:          b64.RawURLEncoding.EncodeToString(tag),
+	})
+}
@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//Launch secrets exposed by the efi_secret module
+	//https://www.kernel.org/doc/html/latest/security/secrets/coco.html
+	sevSecretsDir = "/sys/kernel/security/secrets/coco"
+)
+
+//GUIDs of the Raksh secrets in the SEV launch secret table
+var sevSecretGUIDs = map[string]string{
+	"configMapKey": "7a76e25e-7212-4539-a038-89e6e69a2ca2",
+	"imageKey":     "86061fc1-de48-42bc-b8bc-4f143449cb67",
+	"trustedKeys":  "46ad603e-9181-4d10-b450-cbe1cf388ee5",
+	"envelopeKey":  "451fc2da-f4d9-453c-8cca-219b2b48751b",
+	"identityCA":   "88c26c20-ffa4-4c56-ba93-102ed9535ad7",
+}
+
+var guidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+//AMD SEV/SEV-ES guest. The secrets are injected by the guest owner at
+//launch and exposed in securityfs by the efi_secret module.
+type sevProvider struct {
+	//Directory of the secret entries, named by GUID
+	secretsDir string
+}
+
+//New SEV provider reading the launch secrets from secretsDir
+func newSEVProvider(secretsDir string) *sevProvider {
+	return &sevProvider{secretsDir: secretsDir}
+}
+
+func (p *sevProvider) Kind() TEEKind {
+	return TEESEV
+}
+
+func (p *sevProvider) Detect() *Detection {
+	entries, err := ioutil.ReadDir(p.secretsDir)
+	if err != nil {
+		return notDetected(TEESEV, "no efi_secret launch secrets: %s", err)
+	}
+	log.Info("It is a VM with SEV launch secrets")
+	return detected(TEESEV, map[string]string{"launchSecrets": strconv.Itoa(len(entries))})
+}
+
+func (p *sevProvider) Capabilities() Capabilities {
+	return Capabilities{LaunchSecrets: true}
+}
+
+//Copy the named launch secrets into dir and delete them from securityfs,
+//which makes the kernel wipe them. Names are either Raksh secret names
+//or GUIDs of the secret table.
+func (p *sevProvider) FetchSecrets(dir string, names ...string) error {
+
+	log.Debug("Populating secrets for SEV")
+	err := os.MkdirAll(dir, os.ModeDir)
+	if err != nil {
+		log.Error("Unable to create directory for storing SEV secrets ", err)
+		return err
+	}
+
+	for _, name := range names {
+		keyFile := filepath.Join(dir, name)
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("Secrets File exists for: ", keyFile)
+			continue
+		}
+
+		guid, ok := sevSecretGUIDs[name]
+		if !ok {
+			guid = strings.ToLower(name)
+			if !guidPattern.MatchString(guid) {
+				log.Infof("No launch secret GUID for %s", name)
+				continue
+			}
+		}
+
+		secretFile := filepath.Join(p.secretsDir, guid)
+		secret, err := ioutil.ReadFile(secretFile)
+		if os.IsNotExist(err) {
+			log.Infof("No %s in the launch secrets", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(keyFile, secret, 0600)
+		Wipe(secret)
+		if err != nil {
+			log.Errorf("Unable to write %s: %s", keyFile, err)
+			return err
+		}
+
+		//Consumed, the kernel wipes the secret on unlink
+		err = os.Remove(secretFile)
+		if err != nil {
+			log.Errorf("Unable to delete launch secret %s: %s", secretFile, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//The SEV launch measurement is only available to the guest owner
+func (p *sevProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	return nil, ErrNoAttestation
+}
@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Fake securityfs with the launch secret table of efi_secret
+func fakeSEVSecrets(t *testing.T, secrets map[string]string) string {
+	dir := filepath.Join(t.TempDir(), "coco")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for guid, secret := range secrets {
+		err = ioutil.WriteFile(filepath.Join(dir, guid), []byte(secret), 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSEVDetect(t *testing.T) {
+	secretsDir := fakeSEVSecrets(t, map[string]string{sevSecretGUIDs["configMapKey"]: "a2V5"})
+
+	detection := newSEVProvider(secretsDir).Detect()
+	if !detection.Detected || detection.Kind != TEESEV {
+		t.Fatalf("SEV not detected: %+v", detection)
+	}
+	if detection.Info["launchSecrets"] != "1" {
+		t.Errorf("launchSecrets = %q, want 1", detection.Info["launchSecrets"])
+	}
+
+	detection = newSEVProvider(filepath.Join(secretsDir, "missing")).Detect()
+	if detection.Detected || detection.Reason == "" {
+		t.Errorf("SEV detected without launch secrets: %+v", detection)
+	}
+}
+
+func TestSEVFetchSecrets(t *testing.T) {
+	const otherGUID = "0b7f9a04-3c1e-4b8e-9d6a-1f2e3d4c5b6a"
+	secretsDir := fakeSEVSecrets(t, map[string]string{
+		sevSecretGUIDs["configMapKey"]: "Y29uZmlnTWFwS2V5",
+		sevSecretGUIDs["imageKey"]:     "aW1hZ2VLZXk=",
+		otherGUID:                      "b3RoZXI=",
+	})
+	dir := filepath.Join(t.TempDir(), "secrets")
+
+	err := newSEVProvider(secretsDir).FetchSecrets(dir, "configMapKey", "imageKey", "trustedKeys", "unknown",
+		"0B7F9A04-3C1E-4B8E-9D6A-1F2E3D4C5B6A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"configMapKey":                         "Y29uZmlnTWFwS2V5",
+		"imageKey":                             "aW1hZ2VLZXk=",
+		"0B7F9A04-3C1E-4B8E-9D6A-1F2E3D4C5B6A": "b3RoZXI=",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	for _, name := range []string{"trustedKeys", "unknown"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s fetched without a launch secret", name)
+		}
+	}
+
+	//The consumed launch secrets are deleted so that the kernel wipes them
+	entries, err := ioutil.ReadDir(secretsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d launch secrets left in securityfs", len(entries))
+	}
+}
+
+func TestSEVFetchSecretsExisting(t *testing.T) {
+	guid := sevSecretGUIDs["configMapKey"]
+	secretsDir := fakeSEVSecrets(t, map[string]string{guid: "bmV3"})
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "configMapKey"), []byte("b2xk"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newSEVProvider(secretsDir).FetchSecrets(dir, "configMapKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "configMapKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "b2xk" {
+		t.Errorf("fetched secret overwritten with %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(secretsDir, guid)); err != nil {
+		t.Errorf("launch secret consumed although already fetched: %s", err)
+	}
+}
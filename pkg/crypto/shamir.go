@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+//Shamir secret sharing over GF(2^8)
+//Each share is the evaluation of the byte-wise polynomials at x, with x
+//appended as the last byte of the share.
+
+//Split secret into n shares of which any k reconstruct it
+func SplitSecret(secret []byte, n int, k int) ([][]byte, error) {
+	if k < 2 || n < k || n > 255 {
+		return nil, fmt.Errorf("invalid %d-of-%d sharing", k, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, k)
+	defer Wipe(coefficients)
+	for pos, b := range secret {
+		coefficients[0] = b
+		_, err := rand.Read(coefficients[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[pos] = evalPolynomial(coefficients, share[len(secret)])
+		}
+	}
+	return shares, nil
+}
+
+//Combine at least the threshold number of shares into the secret
+func CombineShares(shares [][]byte) (*SecureBuffer, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are needed")
+	}
+	size := len(shares[0]) - 1
+	if size < 1 {
+		return nil, errors.New("share too short")
+	}
+
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+	for i, share := range shares {
+		if len(share) != size+1 {
+			return nil, errors.New("shares differ in length")
+		}
+		x := share[size]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("invalid or duplicate share %d", x)
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret, err := NewSecureBuffer(size)
+	if err != nil {
+		return nil, err
+	}
+	out := secret.Bytes()
+
+	//Lagrange interpolation at x = 0
+	for i, share := range shares {
+		basis := byte(1)
+		for j := range shares {
+			if i == j {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(xs[j], xs[i]^xs[j]))
+		}
+		for pos := 0; pos < size; pos++ {
+			out[pos] ^= gfMul(share[pos], basis)
+		}
+	}
+	return secret, nil
+}
+
+//Horner's method
+func evalPolynomial(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+//Multiplication in GF(2^8) with the AES polynomial, in constant time
+func gfMul(a byte, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = (a << 1) ^ (carry & 0x1b)
+		b >>= 1
+	}
+	return product
+}
+
+//Division in GF(2^8), b must not be zero
+func gfDiv(a byte, b byte) byte {
+	//b^254 is the inverse of b
+	inverse := b
+	for i := 0; i < 6; i++ {
+		inverse = gfMul(gfMul(inverse, inverse), b)
+	}
+	return gfMul(a, gfMul(inverse, inverse))
+}
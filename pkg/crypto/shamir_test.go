@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func randomSecret(t *testing.T, size int) []byte {
+	secret := make([]byte, size)
+	_, err := rand.Read(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestSplitCombine(t *testing.T) {
+	tests := []struct {
+		k, n int
+	}{
+		{2, 2},
+		{2, 3},
+		{3, 5},
+		{5, 5},
+		{4, 10},
+		{16, 16},
+		{3, 255},
+	}
+	for _, test := range tests {
+		secret := randomSecret(t, 32)
+		shares, err := SplitSecret(secret, test.n, test.k)
+		if err != nil {
+			t.Fatalf("%d-of-%d: %s", test.k, test.n, err)
+		}
+		if len(shares) != test.n {
+			t.Fatalf("%d-of-%d: %d shares", test.k, test.n, len(shares))
+		}
+
+		//The first, the last and all shares
+		for _, subset := range [][][]byte{shares[:test.k], shares[test.n-test.k:], shares} {
+			combined, err := CombineShares(subset)
+			if err != nil {
+				t.Fatalf("%d-of-%d with %d shares: %s", test.k, test.n, len(subset), err)
+			}
+			if !bytes.Equal(combined.Bytes(), secret) {
+				t.Errorf("%d-of-%d with %d shares: wrong secret", test.k, test.n, len(subset))
+			}
+			combined.Destroy()
+		}
+	}
+}
+
+func TestSplitSecretInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret []byte
+		k, n   int
+	}{
+		{"threshold of one", []byte("key"), 1, 3},
+		{"threshold above shares", []byte("key"), 4, 3},
+		{"too many shares", []byte("key"), 2, 256},
+		{"empty secret", nil, 2, 3},
+	}
+	for _, test := range tests {
+		_, err := SplitSecret(test.secret, test.n, test.k)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestCombineSharesInvalid(t *testing.T) {
+	secret := randomSecret(t, 32)
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Fewer than the threshold give some other value
+	combined, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined.Bytes(), secret) {
+		t.Error("two of three shares give the secret")
+	}
+
+	//A corrupted share gives some other value, only a key check tells
+	corrupted := append([]byte(nil), shares[1]...)
+	corrupted[0] ^= 1
+	combined, err = CombineShares([][]byte{shares[0], corrupted, shares[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined.Bytes(), secret) {
+		t.Error("a corrupted share gives the secret")
+	}
+
+	tests := []struct {
+		name   string
+		shares [][]byte
+		err    string
+	}{
+		{"single share", shares[:1], "at least two shares"},
+		{"duplicate x", [][]byte{shares[0], shares[1], shares[1]}, "duplicate share 2"},
+		{"zero x", [][]byte{shares[0], append(append([]byte(nil), shares[1][:32]...), 0)}, "invalid or duplicate share 0"},
+		{"different lengths", [][]byte{shares[0], shares[1][1:]}, "differ in length"},
+		{"too short", [][]byte{{1}, {2}}, "too short"},
+	}
+	for _, test := range tests {
+		_, err := CombineShares(test.shares)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestGFInverse(t *testing.T) {
+	for b := 1; b < 256; b++ {
+		if product := gfMul(byte(b), gfDiv(1, byte(b))); product != 1 {
+			t.Fatalf("%#x * 1/%#x = %#x", b, b, product)
+		}
+	}
+}
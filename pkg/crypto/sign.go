@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//TrustedKeys is the set of deployer public keys whose signatures
+//are accepted on the encrypted properties and user secrets
+type TrustedKeys []gocrypto.PublicKey
+
+var (
+	ErrNoTrustedKeys    = errors.New("no trusted deployer keys available")
+	ErrInvalidSignature = errors.New("signature is not from a trusted deployer")
+)
+
+//Load the trusted deployer keys from the given PEM files or directories
+//of PEM files. Paths which don't exist are skipped.
+func LoadTrustedKeys(paths ...string) (TrustedKeys, error) {
+	var keys TrustedKeys
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			log.Debug("No trusted keys at: ", path)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		files := []string{path}
+		if info.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			fileKeys, err := ParsePublicKeys(data)
+			if err != nil {
+				return nil, fmt.Errorf("trusted keys in %s: %s", file, err)
+			}
+			log.Infof("Loaded %d trusted key(s) from %s", len(fileKeys), file)
+			keys = append(keys, fileKeys...)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoTrustedKeys
+	}
+	return keys, nil
+}
+
+//Parse all the PEM encoded (PKIX) Ed25519 and ECDSA public keys in data
+func ParsePublicKeys(data []byte) ([]gocrypto.PublicKey, error) {
+	var keys []gocrypto.PublicKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+	return keys, nil
+}
+
+//Verify checks that sig is a valid signature over data by any of the
+//trusted keys. ECDSA signatures are ASN.1 encoded over the SHA-2 digest
+//matching the curve size.
+func (keys TrustedKeys) Verify(data []byte, sig []byte) error {
+	if len(keys) == 0 {
+		return ErrNoTrustedKeys
+	}
+
+	for _, key := range keys {
+		switch pub := key.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(pub, data, sig) {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(pub, ecdsaDigest(pub.Curve, data), sig) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidSignature
+}
+
+//Digest data with the hash conventionally paired with the curve
+func ecdsaDigest(curve elliptic.Curve, data []byte) []byte {
+	switch curve.Params().BitSize {
+	case 384:
+		digest := sha512.Sum384(data)
+		return digest[:]
+	case 521:
+		digest := sha512.Sum512(data)
+		return digest[:]
+	default:
+		digest := sha256.Sum256(data)
+		return digest[:]
+	}
+}
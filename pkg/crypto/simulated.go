@@ -0,0 +1,220 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//Default store of the simulated TEE
+	SimulatedStoreDir = "/etc/raksh/simulated"
+	//Dev key signing the simulated evidence, generated when missing
+	simulatedEvidenceKeyFile = "evidence.key"
+	simulatedEvidenceType    = "raksh-simulated-evidence"
+
+	simulatedWarning = "SIMULATED TEE, NOT FOR PRODUCTION: secrets and evidence are not protected by any hardware"
+)
+
+//Payload of the simulated evidence
+type simulatedReport struct {
+	ReportData []byte            `json:"reportData,omitempty"`
+	IssuedAt   int64             `json:"iat"`
+	Claims     map[string]string `json:"claims"`
+}
+
+//Software emulation of a TEE, for development and tests on machines
+//without TEE hardware. The secrets are plain files in the store and the
+//evidence is signed by a dev key next to them, so it protects nothing.
+//It is never detected automatically, it has to be configured.
+type simulatedProvider struct {
+	storeDir string
+}
+
+//New simulated TEE provider with its secrets and dev key in storeDir
+func NewSimulatedProvider(storeDir string) TEEProvider {
+	return &simulatedProvider{storeDir: storeDir}
+}
+
+func (p *simulatedProvider) Kind() TEEKind {
+	return TEESimulated
+}
+
+func (p *simulatedProvider) Detect() *Detection {
+	info, err := os.Stat(p.storeDir)
+	if err != nil {
+		return notDetected(TEESimulated, "no simulated TEE store: %s", err)
+	}
+	if !info.IsDir() {
+		return notDetected(TEESimulated, "simulated TEE store %s is not a directory", p.storeDir)
+	}
+	log.Warn(simulatedWarning)
+	return detected(TEESimulated, map[string]string{"store": p.storeDir, "debug": "true"})
+}
+
+func (p *simulatedProvider) Capabilities() Capabilities {
+	return Capabilities{Attestation: true, LaunchSecrets: true}
+}
+
+//Copy the named secrets from the store into dir. They are kept in the
+//store so that the flow can be repeated.
+func (p *simulatedProvider) FetchSecrets(dir string, names ...string) error {
+
+	log.Warn(simulatedWarning)
+	err := os.MkdirAll(dir, os.ModeDir)
+	if err != nil {
+		log.Error("Unable to create directory for storing simulated TEE secrets ", err)
+		return err
+	}
+
+	for _, name := range names {
+		keyFile := filepath.Join(dir, name)
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("Secrets File exists for: ", keyFile)
+			continue
+		}
+
+		secret, err := ioutil.ReadFile(filepath.Join(p.storeDir, filepath.Base(name)))
+		if os.IsNotExist(err) {
+			log.Infof("No %s in the simulated TEE store", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(keyFile, secret, 0600)
+		Wipe(secret)
+		if err != nil {
+			log.Errorf("Unable to write %s: %s", keyFile, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Evidence with the report as a compact JWS signed by the dev key, and the
+//dev public key as the endorsement
+func (p *simulatedProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+
+	log.Warn(simulatedWarning)
+	key, err := p.evidenceKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]string{
+		"simulated": "true",
+		"debug":     "true",
+	}
+	payload, err := json.Marshal(&simulatedReport{
+		ReportData: reportData,
+		IssuedAt:   time.Now().Unix(),
+		Claims:     claims,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"` + simulatedEvidenceType + `"}`))
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key, []byte(signingInput))
+	report := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	return &Evidence{
+		Kind:         TEESimulated,
+		ReportData:   reportData,
+		Report:       []byte(report),
+		Endorsements: [][]byte{publicKey},
+		Claims:       claims,
+	}, nil
+}
+
+//Load the dev key from the store, generating it on first use
+func (p *simulatedProvider) evidenceKey() (ed25519.PrivateKey, error) {
+
+	keyFile := filepath.Join(p.storeDir, simulatedEvidenceKeyFile)
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM private key", keyFile)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an Ed25519 key", keyFile)
+		}
+		return edKey, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Infof("Generating the simulated TEE evidence key %s", keyFile)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//Verify simulated evidence against the dev public key, returning the
+//signed claims. Only for development verifiers.
+func VerifySimulatedEvidence(evidence *Evidence, key ed25519.PublicKey) (map[string]string, error) {
+	if evidence.Kind != TEESimulated {
+		return nil, fmt.Errorf("not simulated evidence: %s", evidence.Kind)
+	}
+
+	parts := strings.Split(string(evidence.Report), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed simulated evidence")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.New("simulated evidence signature verification failed")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	report := &simulatedReport{}
+	err = json.Unmarshal(payload, report)
+	if err != nil {
+		return nil, err
+	}
+	if string(report.ReportData) != string(evidence.ReportData) {
+		return nil, errors.New("simulated evidence is not bound to the report data")
+	}
+	return report.Claims, nil
+}
@@ -0,0 +1,192 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	//SEV guest driver
+	sevGuestDevice = "/dev/sev-guest"
+
+	//SNP_GET_REPORT = _IOWR('S', 0x0, struct snp_guest_request_ioctl)
+	//include/uapi/linux/sev-guest.h
+	snpGetReport = 0xc0205300
+
+	//struct snp_report_req and struct snp_report_resp
+	snpReportRequestSize  = 96
+	snpReportResponseSize = 4000
+	//The report follows the status, size and reserved fields of
+	//MSG_REPORT_RSP
+	snpReportResponseHeader = 32
+
+	snpReportDataSize = 64
+	snpRequestRetries = 5
+)
+
+//Delay before the first retry of a throttled request, a variable for testing
+var snpRetryDelay = 100 * time.Millisecond
+
+//Requests attestation reports from the SEV-SNP firmware
+type snpDevice interface {
+	GetReport(reportData [snpReportDataSize]byte, vmpl uint32) ([]byte, error)
+}
+
+//struct snp_guest_request_ioctl
+type snpGuestRequest struct {
+	msgVersion uint8
+	_          [7]byte
+	reqData    uint64
+	respData   uint64
+	exitInfo2  uint64
+}
+
+//The SEV guest driver character device
+type sevGuestDev struct {
+	path string
+}
+
+//Request a report from the firmware with the SNP_GET_REPORT ioctl
+func (d *sevGuestDev) GetReport(reportData [snpReportDataSize]byte, vmpl uint32) ([]byte, error) {
+	file, err := os.OpenFile(d.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	request := make([]byte, snpReportRequestSize)
+	copy(request, reportData[:])
+	binary.LittleEndian.PutUint32(request[snpReportDataSize:], vmpl)
+	response := make([]byte, snpReportResponseSize)
+
+	guestRequest := &snpGuestRequest{
+		msgVersion: 1,
+		reqData:    uint64(uintptr(unsafe.Pointer(&request[0]))),
+		respData:   uint64(uintptr(unsafe.Pointer(&response[0]))),
+	}
+
+	errno := retryThrottled(func() unix.Errno {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), snpGetReport, uintptr(unsafe.Pointer(guestRequest)))
+		return errno
+	})
+	runtime.KeepAlive(request)
+	runtime.KeepAlive(response)
+	if errno != 0 {
+		return nil, fmt.Errorf("SNP_GET_REPORT: %s (firmware error %#x, vmm error %#x)",
+			errno, uint32(guestRequest.exitInfo2), uint32(guestRequest.exitInfo2>>32))
+	}
+	return parseReportResponse(response)
+}
+
+//Issue a firmware request, retrying while the firmware throttles requests
+func retryThrottled(request func() unix.Errno) unix.Errno {
+	for retry := 0; ; retry++ {
+		errno := request()
+		if (errno == unix.EAGAIN || errno == unix.EBUSY) && retry < snpRequestRetries {
+			time.Sleep(time.Duration(retry+1) * snpRetryDelay)
+			continue
+		}
+		return errno
+	}
+}
+
+//Report of the MSG_REPORT_RSP response
+func parseReportResponse(response []byte) ([]byte, error) {
+	if len(response) < snpReportResponseHeader {
+		return nil, fmt.Errorf("SNP report response too short: %d bytes", len(response))
+	}
+	status := binary.LittleEndian.Uint32(response[0:])
+	size := binary.LittleEndian.Uint32(response[4:])
+	if status != 0 {
+		return nil, fmt.Errorf("SNP report request failed with status %#x", status)
+	}
+	if size < snpReportSize || int(size) > len(response)-snpReportResponseHeader {
+		return nil, fmt.Errorf("invalid SNP report size %d", size)
+	}
+	return response[snpReportResponseHeader : snpReportResponseHeader+size], nil
+}
+
+//AMD SEV-SNP guest. Attestation reports from the firmware bind report
+//data chosen by the hook, e.g. for key release by a key broker.
+type snpProvider struct {
+	devicePath string
+	device     snpDevice
+}
+
+//New SNP provider using the SEV guest device at devicePath
+func newSNPProvider(devicePath string) *snpProvider {
+	return &snpProvider{devicePath: devicePath, device: &sevGuestDev{path: devicePath}}
+}
+
+func (p *snpProvider) Kind() TEEKind {
+	return TEESNP
+}
+
+func (p *snpProvider) Detect() *Detection {
+	_, err := os.Stat(p.devicePath)
+	if err != nil {
+		return notDetected(TEESNP, "no SEV guest device: %s", err)
+	}
+	log.Info("It is a VM with SEV-SNP support")
+	return detected(TEESNP, map[string]string{"device": p.devicePath})
+}
+
+//The firmware version and TCB are only reported in attestation reports
+func (p *snpProvider) Probe() map[string]string {
+	evidence, err := p.GetEvidence(nil)
+	if err != nil {
+		return map[string]string{"reportError": err.Error()}
+	}
+	info := map[string]string{}
+	for _, claim := range []string{"firmware_version", "current_tcb", "committed_tcb", "policy", "vmpl"} {
+		info[claim] = evidence.Claims[claim]
+	}
+	return info
+}
+
+func (p *snpProvider) Capabilities() Capabilities {
+	return Capabilities{Attestation: true}
+}
+
+//SNP has no launch secrets for Raksh, they are released to the evidence
+//by a key broker
+func (p *snpProvider) FetchSecrets(dir string, names ...string) error {
+	log.Info("SEV-SNP holds no Raksh secrets, they are released by a key broker")
+	return nil
+}
+
+//Attestation report at VMPL 0 bound to reportData
+func (p *snpProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	if len(reportData) > snpReportDataSize {
+		return nil, fmt.Errorf("SNP report data is at most %d bytes", snpReportDataSize)
+	}
+	var data [snpReportDataSize]byte
+	copy(data[:], reportData)
+
+	raw, err := p.device.GetReport(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	report, err := ParseSNPReport(raw)
+	if err != nil {
+		return nil, err
+	}
+	if report.ReportData != data {
+		return nil, errors.New("SNP report is not bound to the report data")
+	}
+
+	return &Evidence{
+		Kind:       TEESNP,
+		ReportData: reportData,
+		Report:     raw,
+		Claims:     report.Claims(),
+	}, nil
+}
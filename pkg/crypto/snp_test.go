@@ -0,0 +1,294 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//testdata/snp_report.bin is an ATTESTATION_REPORT with a distinct value in
+//every field, signed by the key of testdata/snp_vcek.pem
+func readSNPFixture(t *testing.T) ([]byte, *ecdsa.PublicKey) {
+	raw, err := ioutil.ReadFile("testdata/snp_report.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := ioutil.ReadFile("testdata/snp_vcek.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		t.Fatal("no PEM in testdata/snp_vcek.pem")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw, key.(*ecdsa.PublicKey)
+}
+
+//Bytes start, start+1, ... as filled in by the fixture
+func sequence(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func TestParseSNPReport(t *testing.T) {
+	raw, _ := readSNPFixture(t)
+	report, err := ParseSNPReport(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reportData [64]byte
+	copy(reportData[:], "raksh snp report data")
+	if report.Version != 2 || report.GuestSVN != 7 || report.Policy != 0x30000 || report.VMPL != 0 ||
+		report.SignatureAlgo != snpSignatureAlgoECDSAP384 || report.PlatformInfo != 1 {
+		t.Errorf("header = %d %d %#x %d %d %d", report.Version, report.GuestSVN, report.Policy, report.VMPL,
+			report.SignatureAlgo, report.PlatformInfo)
+	}
+	if !report.AuthorKeyEn || report.MaskChipKey || report.SigningKey != 0 {
+		t.Errorf("key info = %t %t %d", report.AuthorKeyEn, report.MaskChipKey, report.SigningKey)
+	}
+	if report.ReportData != reportData {
+		t.Errorf("report data = %q", report.ReportData[:])
+	}
+	for _, field := range []struct {
+		name  string
+		value []byte
+		start byte
+	}{
+		{"family ID", report.FamilyID[:], 0x10},
+		{"image ID", report.ImageID[:], 0x20},
+		{"measurement", report.Measurement[:], 0x90},
+		{"host data", report.HostData[:], 0xc0},
+		{"ID key digest", report.IDKeyDigest[:], 0xe0},
+		{"author key digest", report.AuthorKeyDigest[:], 0x11},
+		{"report ID", report.ReportID[:], 0x40},
+		{"report ID MA", report.ReportIDMA[:], 0x60},
+		{"chip ID", report.ChipID[:], 0xa0},
+	} {
+		if !bytes.Equal(field.value, sequence(field.start, len(field.value))) {
+			t.Errorf("%s = %x", field.name, field.value)
+		}
+	}
+
+	for _, tcb := range []struct {
+		name  string
+		value TCBVersion
+		want  string
+	}{
+		{"current", report.CurrentTCB, "bl=3 tee=0 snp=8 ucode=115"},
+		{"reported", report.ReportedTCB, "bl=3 tee=0 snp=8 ucode=115"},
+		{"committed", report.CommittedTCB, "bl=2 tee=0 snp=7 ucode=93"},
+		{"launch", report.LaunchTCB, "bl=1 tee=0 snp=6 ucode=72"},
+	} {
+		if tcb.value.String() != tcb.want {
+			t.Errorf("%s TCB = %s, want %s", tcb.name, tcb.value, tcb.want)
+		}
+	}
+
+	claims := report.Claims()
+	for claim, want := range map[string]string{
+		"firmware_version": "1.55.21",
+		"policy":           "0x30000",
+		"vmpl":             "0",
+		"measurement":      hex.EncodeToString(sequence(0x90, 48)),
+		"chip_id":          hex.EncodeToString(sequence(0xa0, 64)),
+		"committed_tcb":    "bl=2 tee=0 snp=7 ucode=93",
+	} {
+		if claims[claim] != want {
+			t.Errorf("claim %s = %q, want %q", claim, claims[claim], want)
+		}
+	}
+}
+
+func TestParseSNPReportInvalid(t *testing.T) {
+	raw, _ := readSNPFixture(t)
+	_, err := ParseSNPReport(raw[:snpReportSize-1])
+	if err == nil {
+		t.Error("short report parsed")
+	}
+	old := append([]byte(nil), raw...)
+	binary.LittleEndian.PutUint32(old, 1)
+	_, err = ParseSNPReport(old)
+	if err == nil {
+		t.Error("version 1 report parsed")
+	}
+}
+
+func TestSNPReportVerify(t *testing.T) {
+	raw, vcek := readSNPFixture(t)
+	report, err := ParseSNPReport(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = report.Verify(vcek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Any change of the signed part, e.g. of the measurement
+	tampered := append([]byte(nil), raw...)
+	tampered[0x90] ^= 1
+	report, err = ParseSNPReport(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Verify(vcek) == nil {
+		t.Error("tampered report verified")
+	}
+}
+
+//MSG_REPORT_RSP with the report of the fixture
+func snpReportResponse(status uint32, report []byte) []byte {
+	response := make([]byte, snpReportResponseSize)
+	binary.LittleEndian.PutUint32(response[0:], status)
+	binary.LittleEndian.PutUint32(response[4:], uint32(len(report)))
+	copy(response[snpReportResponseHeader:], report)
+	return response
+}
+
+func TestParseReportResponse(t *testing.T) {
+	raw, _ := readSNPFixture(t)
+
+	report, err := parseReportResponse(snpReportResponse(0, raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(report, raw) {
+		t.Error("report of the response differs from the fixture")
+	}
+
+	//Invalid parameters of the request
+	_, err = parseReportResponse(snpReportResponse(0x16, raw))
+	if err == nil || !strings.Contains(err.Error(), "status 0x16") {
+		t.Errorf("failed request accepted: %v", err)
+	}
+	_, err = parseReportResponse(snpReportResponse(0, raw[:0x100]))
+	if err == nil {
+		t.Error("short report accepted")
+	}
+	response := snpReportResponse(0, raw)
+	binary.LittleEndian.PutUint32(response[4:], snpReportResponseSize)
+	_, err = parseReportResponse(response)
+	if err == nil {
+		t.Error("report beyond the response accepted")
+	}
+}
+
+func TestRetryThrottled(t *testing.T) {
+	defer func(delay time.Duration) { snpRetryDelay = delay }(snpRetryDelay)
+	snpRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name     string
+		errnos   []unix.Errno
+		want     unix.Errno
+		requests int
+	}{
+		{"success", []unix.Errno{0}, 0, 1},
+		{"throttled", []unix.Errno{unix.EAGAIN, unix.EBUSY, 0}, 0, 3},
+		{"failure", []unix.Errno{unix.EINVAL, 0}, unix.EINVAL, 1},
+		{"always throttled", []unix.Errno{unix.EBUSY}, unix.EBUSY, snpRequestRetries + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			errno := retryThrottled(func() unix.Errno {
+				errno := test.errnos[len(test.errnos)-1]
+				if requests < len(test.errnos) {
+					errno = test.errnos[requests]
+				}
+				requests++
+				return errno
+			})
+			if errno != test.want || requests != test.requests {
+				t.Errorf("got %v after %d requests, want %v after %d", errno, requests, test.want, test.requests)
+			}
+		})
+	}
+}
+
+//SNP firmware returning a recorded report
+type fakeSNPDevice struct {
+	report []byte
+	err    error
+	//Report data and VMPL of the last request
+	reportData [snpReportDataSize]byte
+	vmpl       uint32
+}
+
+func (d *fakeSNPDevice) GetReport(reportData [snpReportDataSize]byte, vmpl uint32) ([]byte, error) {
+	d.reportData, d.vmpl = reportData, vmpl
+	return d.report, d.err
+}
+
+func TestSNPGetEvidence(t *testing.T) {
+	raw, _ := readSNPFixture(t)
+	device := &fakeSNPDevice{report: raw}
+	provider := &snpProvider{devicePath: "/dev/sev-guest", device: device}
+
+	evidence, err := provider.GetEvidence([]byte("raksh snp report data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evidence.Kind != TEESNP || !bytes.Equal(evidence.Report, raw) || evidence.Claims["firmware_version"] != "1.55.21" {
+		t.Errorf("evidence = %+v", evidence)
+	}
+	if string(bytes.TrimRight(device.reportData[:], "\x00")) != "raksh snp report data" || device.vmpl != 0 {
+		t.Errorf("requested report data %q at VMPL %d", device.reportData[:], device.vmpl)
+	}
+
+	//The firmware must bind the report data of the request
+	_, err = provider.GetEvidence([]byte("other report data"))
+	if err == nil {
+		t.Error("report for other report data accepted")
+	}
+	_, err = provider.GetEvidence(make([]byte, snpReportDataSize+1))
+	if err == nil {
+		t.Error("report data longer than the report accepted")
+	}
+
+	device.err = errors.New("firmware error")
+	_, err = provider.GetEvidence(nil)
+	if err != device.err {
+		t.Errorf("device error = %v", err)
+	}
+}
+
+func TestSNPDetect(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "sev-guest")
+	device := &fakeSNPDevice{err: errors.New("no report on the start path")}
+	provider := &snpProvider{devicePath: devicePath, device: device}
+	if provider.Detect().Detected {
+		t.Error("detected without a SEV guest device")
+	}
+
+	err := ioutil.WriteFile(devicePath, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detection := provider.Detect()
+	if !detection.Detected || len(detection.Info) != 1 || detection.Info["device"] != devicePath {
+		t.Errorf("detection = %+v", detection)
+	}
+	if info := provider.Probe(); info["reportError"] != device.err.Error() {
+		t.Errorf("probe with device error = %v", info)
+	}
+}
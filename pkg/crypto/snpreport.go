@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+//SEV-SNP attestation report
+//SEV Secure Nested Paging Firmware ABI Specification, ATTESTATION_REPORT
+const (
+	snpReportSize = 0x4a0
+	//The signature covers the report up to the signature
+	snpSignedSize      = 0x2a0
+	snpSignatureOffset = 0x2a0
+	//ECDSA P-384 with SHA-384
+	snpSignatureAlgoECDSAP384 = 1
+	//r and s are little endian, zero extended to 72 bytes
+	snpSignatureComponentSize = 72
+)
+
+//TCBVersion is the security version of each firmware component
+type TCBVersion struct {
+	BootLoader uint8
+	TEE        uint8
+	SNP        uint8
+	Microcode  uint8
+}
+
+//Decode the TCB_VERSION structure
+func parseTCBVersion(raw uint64) TCBVersion {
+	return TCBVersion{
+		BootLoader: uint8(raw),
+		TEE:        uint8(raw >> 8),
+		SNP:        uint8(raw >> 48),
+		Microcode:  uint8(raw >> 56),
+	}
+}
+
+func (t TCBVersion) String() string {
+	return fmt.Sprintf("bl=%d tee=%d snp=%d ucode=%d", t.BootLoader, t.TEE, t.SNP, t.Microcode)
+}
+
+//SNPReport is a parsed SEV-SNP attestation report
+type SNPReport struct {
+	Version         uint32
+	GuestSVN        uint32
+	Policy          uint64
+	FamilyID        [16]byte
+	ImageID         [16]byte
+	VMPL            uint32
+	SignatureAlgo   uint32
+	CurrentTCB      TCBVersion
+	PlatformInfo    uint64
+	AuthorKeyEn     bool
+	MaskChipKey     bool
+	SigningKey      uint8
+	ReportData      [64]byte
+	Measurement     [48]byte
+	HostData        [32]byte
+	IDKeyDigest     [48]byte
+	AuthorKeyDigest [48]byte
+	ReportID        [32]byte
+	ReportIDMA      [32]byte
+	ReportedTCB     TCBVersion
+	ChipID          [64]byte
+	CommittedTCB    TCBVersion
+	CurrentBuild    uint8
+	CurrentMinor    uint8
+	CurrentMajor    uint8
+	CommittedBuild  uint8
+	CommittedMinor  uint8
+	CommittedMajor  uint8
+	LaunchTCB       TCBVersion
+	//r and s of the ECDSA signature, little endian
+	SignatureR [snpSignatureComponentSize]byte
+	SignatureS [snpSignatureComponentSize]byte
+
+	//The raw report, for signature verification
+	raw []byte
+}
+
+//Parse the binary SEV-SNP attestation report
+func ParseSNPReport(data []byte) (*SNPReport, error) {
+	if len(data) < snpReportSize {
+		return nil, fmt.Errorf("SNP report too short: %d bytes", len(data))
+	}
+	data = data[:snpReportSize]
+
+	le := binary.LittleEndian
+	r := &SNPReport{
+		Version:        le.Uint32(data[0x00:]),
+		GuestSVN:       le.Uint32(data[0x04:]),
+		Policy:         le.Uint64(data[0x08:]),
+		VMPL:           le.Uint32(data[0x30:]),
+		SignatureAlgo:  le.Uint32(data[0x34:]),
+		CurrentTCB:     parseTCBVersion(le.Uint64(data[0x38:])),
+		PlatformInfo:   le.Uint64(data[0x40:]),
+		ReportedTCB:    parseTCBVersion(le.Uint64(data[0x180:])),
+		CommittedTCB:   parseTCBVersion(le.Uint64(data[0x1e0:])),
+		CurrentBuild:   data[0x1e8],
+		CurrentMinor:   data[0x1e9],
+		CurrentMajor:   data[0x1ea],
+		CommittedBuild: data[0x1ec],
+		CommittedMinor: data[0x1ed],
+		CommittedMajor: data[0x1ee],
+		LaunchTCB:      parseTCBVersion(le.Uint64(data[0x1f0:])),
+		raw:            append([]byte(nil), data...),
+	}
+	if r.Version < 2 {
+		return nil, fmt.Errorf("unsupported SNP report version %d", r.Version)
+	}
+
+	keyInfo := le.Uint32(data[0x48:])
+	r.AuthorKeyEn = keyInfo&1 != 0
+	r.MaskChipKey = keyInfo&2 != 0
+	r.SigningKey = uint8(keyInfo>>2) & 7
+
+	copy(r.FamilyID[:], data[0x10:])
+	copy(r.ImageID[:], data[0x20:])
+	copy(r.ReportData[:], data[0x50:])
+	copy(r.Measurement[:], data[0x90:])
+	copy(r.HostData[:], data[0xc0:])
+	copy(r.IDKeyDigest[:], data[0xe0:])
+	copy(r.AuthorKeyDigest[:], data[0x110:])
+	copy(r.ReportID[:], data[0x140:])
+	copy(r.ReportIDMA[:], data[0x160:])
+	copy(r.ChipID[:], data[0x1a0:])
+	copy(r.SignatureR[:], data[snpSignatureOffset:])
+	copy(r.SignatureS[:], data[snpSignatureOffset+snpSignatureComponentSize:])
+
+	return r, nil
+}
+
+//Verify the report signature with the public key of the VCEK (or VLEK)
+//certificate of the platform
+func (r *SNPReport) Verify(vcek *ecdsa.PublicKey) error {
+	if r.SignatureAlgo != snpSignatureAlgoECDSAP384 {
+		return fmt.Errorf("unsupported SNP signature algorithm %d", r.SignatureAlgo)
+	}
+	digest := sha512.Sum384(r.raw[:snpSignedSize])
+	sigR := new(big.Int).SetBytes(reverseBytes(r.SignatureR[:]))
+	sigS := new(big.Int).SetBytes(reverseBytes(r.SignatureS[:]))
+	if !ecdsa.Verify(vcek, digest[:], sigR, sigS) {
+		return errors.New("SNP report signature verification failed")
+	}
+	return nil
+}
+
+//Claims of the report as evidence
+func (r *SNPReport) Claims() map[string]string {
+	return map[string]string{
+		"version":          strconv.FormatUint(uint64(r.Version), 10),
+		"guest_svn":        strconv.FormatUint(uint64(r.GuestSVN), 10),
+		"policy":           fmt.Sprintf("%#x", r.Policy),
+		"vmpl":             strconv.FormatUint(uint64(r.VMPL), 10),
+		"measurement":      hex.EncodeToString(r.Measurement[:]),
+		"host_data":        hex.EncodeToString(r.HostData[:]),
+		"report_data":      hex.EncodeToString(r.ReportData[:]),
+		"id_key_digest":    hex.EncodeToString(r.IDKeyDigest[:]),
+		"chip_id":          hex.EncodeToString(r.ChipID[:]),
+		"current_tcb":      r.CurrentTCB.String(),
+		"reported_tcb":     r.ReportedTCB.String(),
+		"committed_tcb":    r.CommittedTCB.String(),
+		"launch_tcb":       r.LaunchTCB.String(),
+		"firmware_version": fmt.Sprintf("%d.%d.%d", r.CurrentMajor, r.CurrentMinor, r.CurrentBuild),
+	}
+}
+
+//Little endian to big endian and back
+func reverseBytes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return reversed
+}
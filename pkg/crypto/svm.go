@@ -1,12 +1,11 @@
 package crypto
 
 import (
-	"bytes"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -15,90 +14,86 @@ const (
 	svmFile = "/sys/devices/system/cpu/svm"
 )
 
-//Returns true if SVM/PEF
-func isSVM() bool {
-	svm, err := ioutil.ReadFile(svmFile)
-	if err != nil {
-		log.Error("Error reading svm file: ", svmFile, err)
-		return false
-	}
+//POWER PEF secure VM. The secrets are embedded in the ESM blob and
+//retrieved with the help of the ultravisor.
+type svmProvider struct {
+	//esmb-get-file
+	tool        string
+	toolTimeout time.Duration
+}
 
-	if strings.Trim(string(svm), "\n") == "1" {
-		log.Info("It is a VM with SVM/PEF support")
-		return true
+//New SVM provider retrieving the secrets with tool
+func NewSVMProvider(tool string, toolTimeout time.Duration) TEEProvider {
+	if toolTimeout <= 0 {
+		toolTimeout = ESMBToolTimeout
 	}
-	log.Info("It is not an SVM")
-	return false
+	return &svmProvider{tool: tool, toolTimeout: toolTimeout}
 }
 
-//Populate secrets by calling esmb-get-file which will retrieve the
-//embedded secret using ultravisor
-func populateRakshSecretsForSVM() error {
-
-	log.Debug("Populating secrets for SVM/PEF")
-	err := os.MkdirAll(rakshSecretVMTEEMountPoint, os.ModeDir)
-	if err != nil {
-		log.Error("Unable to create directory for storing SVM/PEF secrets ", err)
-		return err
-	}
-	configMapKeyFile := filepath.Join(rakshSecretVMTEEMountPoint, configMapKeyFileName)
-	imageKeyFile := filepath.Join(rakshSecretVMTEEMountPoint, imageKeyFileName)
-	nonceFile := filepath.Join(rakshSecretVMTEEMountPoint, nonceFileName)
+func (p *svmProvider) Kind() TEEKind {
+	return TEESVM
+}
 
-	err = populateKeyFileforSVM(configMapKeyFile)
+func (p *svmProvider) Detect() *Detection {
+	svm, err := ioutil.ReadFile(svmFile)
 	if err != nil {
-		return err
+		return notDetected(TEESVM, "no SVM/PEF support: %s", err)
 	}
-	err = populateKeyFileforSVM(imageKeyFile)
-	if err != nil {
-		return err
-	}
-	err = populateKeyFileforSVM(nonceFile)
-	if err != nil {
-		return err
+	if strings.TrimSpace(string(svm)) != "1" {
+		return notDetected(TEESVM, "%s is %s, not a secure VM", svmFile, strings.TrimSpace(string(svm)))
 	}
+	log.Info("It is a VM with SVM/PEF support")
 
-	return nil
+	return detected(TEESVM, map[string]string{"getFileTool": p.tool})
 }
 
-//Retrieve the secrets from SVM and write to the file
-func populateKeyFileforSVM(fileName string) error {
+func (p *svmProvider) Capabilities() Capabilities {
+	return Capabilities{LaunchSecrets: true}
+}
 
-	log.Debug("Populate the Key Files for SVM/PEF")
-	_, err := os.Stat(fileName)
-	if err == nil {
-		log.Info("Secrets File exists for: ", fileName)
-		return nil
-	}
-	//Retrieve imageKey
-	filePtr, err := os.Create(fileName)
+//Populate the secrets with esmb-get-file, which retrieves the secrets
+//embedded in the ESM blob from the ultravisor
+func (p *svmProvider) FetchSecrets(dir string, names ...string) error {
+
+	log.Debug("Populating secrets for SVM/PEF")
+	err := os.MkdirAll(dir, os.ModeDir)
 	if err != nil {
-		log.Errorf("Unable to create file - ", fileName)
+		log.Error("Unable to create directory for storing SVM/PEF secrets ", err)
 		return err
 	}
-	defer filePtr.Close()
-	err = retrieveSecretsFilefromUltravisor(fileName, filePtr)
-	if err != nil {
-		log.Errorf("Error executing esmb-get-file for   ", fileName, err)
-		return err
+
+	for _, name := range names {
+		keyFile := filepath.Join(dir, name)
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("Secrets File exists for: ", keyFile)
+			continue
+		}
+		secret, err := runESMBTool(p.tool, name, p.toolTimeout)
+		if err != nil {
+			log.Infof("No %s in the ESM blob", name)
+			continue
+		}
+		err = ioutil.WriteFile(keyFile, secret, 0600)
+		Wipe(secret)
+		if err != nil {
+			log.Errorf("Unable to write %s: %s", keyFile, err)
+			os.Remove(keyFile)
+			return err
+		}
 	}
+
 	return nil
 }
 
-//Retrieve secrets file from SVM - ultravisor
-func retrieveSecretsFilefromUltravisor(fileName string, outFile *os.File) error {
-
-	log.Info("Retrieve the secrets from Ultravisor")
-	var stderr bytes.Buffer
-
-	cmd := exec.Command("esmb-get-file", "-f", fileName)
-	//Note: NewLine gets added to Stdout. Buffer has an extra \n char
-	cmd.Stdout = outFile
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("Error executing esmb-get-file for configMapKey ", err, stderr.String())
-		return err
+//PEF has no attestation report, the evidence is the SVM state as
+//reported by the kernel
+func (p *svmProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	if !p.Detect().Detected {
+		return nil, ErrNoAttestation
 	}
-	return nil
+	return &Evidence{
+		Kind:       TEESVM,
+		ReportData: reportData,
+		Claims:     map[string]string{"svm": "1"},
+	}, nil
 }
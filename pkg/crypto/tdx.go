@@ -0,0 +1,222 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	//TDX guest driver
+	tdxGuestDevice = "/dev/tdx_guest"
+	//configfs-tsm report interface of newer kernels
+	//Documentation/ABI/testing/configfs-tsm
+	tsmReportDir = "/sys/kernel/config/tsm/report"
+	tsmProvider  = "tdx_guest"
+
+	//TDX_CMD_GET_REPORT0 = _IOWR('T', 1, struct tdx_report_req)
+	//include/uapi/linux/tdx-guest.h
+	tdxGetReport0 = 0xc4405401
+
+	tdxReportDataSize = 64
+)
+
+//Obtains a TDREPORT or a quote bound to report data
+type tdxDevice interface {
+	//Returns the raw report and whether it is a quote
+	GetReport(reportData [tdxReportDataSize]byte) ([]byte, bool, error)
+}
+
+//struct tdx_report_req
+type tdxReportRequest struct {
+	reportData [tdxReportDataSize]byte
+	tdReport   [tdReportSize]byte
+}
+
+//The TDX guest driver character device, which returns the TDREPORT
+type tdxGuestDev struct {
+	path string
+}
+
+//Request a TDREPORT with the TDX_CMD_GET_REPORT0 ioctl
+func (d *tdxGuestDev) GetReport(reportData [tdxReportDataSize]byte) ([]byte, bool, error) {
+	file, err := os.OpenFile(d.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	request := &tdxReportRequest{reportData: reportData}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), tdxGetReport0, uintptr(unsafe.Pointer(request)))
+	if errno != 0 {
+		return nil, false, fmt.Errorf("TDX_CMD_GET_REPORT0: %s", errno)
+	}
+	return append([]byte(nil), request.tdReport[:]...), false, nil
+}
+
+//configfs-tsm, which returns a quote from the quoting service of the host
+type tsmReport struct {
+	dir string
+}
+
+//Generate a quote in a new configfs-tsm report entry
+func (t *tsmReport) GetReport(reportData [tdxReportDataSize]byte) ([]byte, bool, error) {
+	entry, err := ioutil.TempDir(t.dir, "raksh-")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(entry)
+
+	provider, err := ioutil.ReadFile(filepath.Join(entry, "provider"))
+	if err != nil {
+		return nil, false, err
+	}
+	if strings.TrimSpace(string(provider)) != tsmProvider {
+		return nil, false, fmt.Errorf("configfs-tsm provider is %s, not %s", bytes.TrimSpace(provider), tsmProvider)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(entry, "inblob"), reportData[:], 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	generation, err := ioutil.ReadFile(filepath.Join(entry, "generation"))
+	if err != nil {
+		return nil, false, err
+	}
+	quote, err := ioutil.ReadFile(filepath.Join(entry, "outblob"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	//The entry is private to the hook, any other write is a race
+	current, err := ioutil.ReadFile(filepath.Join(entry, "generation"))
+	if err != nil {
+		return nil, false, err
+	}
+	if !bytes.Equal(current, generation) {
+		return nil, false, errors.New("configfs-tsm report entry was modified concurrently")
+	}
+	return quote, true, nil
+}
+
+//Intel TDX guest. Quotes are preferred, they can be verified remotely,
+//with the TDREPORT of the guest driver as fallback on older kernels.
+type tdxProvider struct {
+	devicePath string
+	tsmDir     string
+	//Overrides the device selection
+	device tdxDevice
+}
+
+//New TDX provider using the TDX guest device at devicePath and the
+//configfs-tsm reports at tsmDir
+func newTDXProvider(devicePath string, tsmDir string) *tdxProvider {
+	return &tdxProvider{devicePath: devicePath, tsmDir: tsmDir}
+}
+
+func (p *tdxProvider) Kind() TEEKind {
+	return TEETDX
+}
+
+func (p *tdxProvider) Detect() *Detection {
+	_, err := os.Stat(p.devicePath)
+	if err != nil {
+		return notDetected(TEETDX, "no TDX guest device: %s", err)
+	}
+	log.Info("It is a TDX trust domain")
+
+	info := map[string]string{"device": p.devicePath, "evidence": "tdreport"}
+	if dir, err := os.Stat(p.tsmDir); err == nil && dir.IsDir() {
+		info["evidence"] = "configfs-tsm"
+	}
+	return detected(TEETDX, info)
+}
+
+//The TDX module version is in the TDREPORT, which unlike a quote doesn't
+//involve the host
+func (p *tdxProvider) Probe() map[string]string {
+	var device tdxDevice = &tdxGuestDev{path: p.devicePath}
+	if p.device != nil {
+		device = p.device
+	}
+	raw, quote, err := device.GetReport([tdxReportDataSize]byte{})
+	var report *TDXReport
+	if err == nil && quote {
+		report, err = ParseTDXQuote(raw)
+	} else if err == nil {
+		report, err = ParseTDReport(raw)
+	}
+	if err != nil {
+		return map[string]string{"reportError": err.Error()}
+	}
+	info := map[string]string{}
+	claims := report.Claims()
+	for _, claim := range []string{"tee_tcb_svn", "mr_seam", "td_attributes"} {
+		info[claim] = claims[claim]
+	}
+	return info
+}
+
+func (p *tdxProvider) Capabilities() Capabilities {
+	return Capabilities{Attestation: true}
+}
+
+//TDX has no launch secrets for Raksh, they are released to the evidence
+//by a key broker
+func (p *tdxProvider) FetchSecrets(dir string, names ...string) error {
+	log.Info("TDX holds no Raksh secrets, they are released by a key broker")
+	return nil
+}
+
+//The configfs-tsm quote when available, the TDREPORT otherwise
+func (p *tdxProvider) reportDevice() tdxDevice {
+	if p.device != nil {
+		return p.device
+	}
+	if info, err := os.Stat(p.tsmDir); err == nil && info.IsDir() {
+		return &tsmReport{dir: p.tsmDir}
+	}
+	log.Info("No configfs-tsm, the TDX evidence is a TDREPORT which can't be verified remotely")
+	return &tdxGuestDev{path: p.devicePath}
+}
+
+//Quote or TDREPORT bound to reportData
+func (p *tdxProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	if len(reportData) > tdxReportDataSize {
+		return nil, fmt.Errorf("TDX report data is at most %d bytes", tdxReportDataSize)
+	}
+	var data [tdxReportDataSize]byte
+	copy(data[:], reportData)
+
+	raw, quote, err := p.reportDevice().GetReport(data)
+	if err != nil {
+		return nil, err
+	}
+	var report *TDXReport
+	if quote {
+		report, err = ParseTDXQuote(raw)
+	} else {
+		report, err = ParseTDReport(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if report.ReportData != data {
+		return nil, errors.New("TDX report is not bound to the report data")
+	}
+
+	return &Evidence{
+		Kind:       TEETDX,
+		ReportData: reportData,
+		Report:     raw,
+		Claims:     report.Claims(),
+	}, nil
+}
@@ -0,0 +1,219 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+//testdata/tdreport.bin is a TDREPORT_STRUCT and testdata/tdx_quote_v4.bin
+//a version 4 quote, with a distinct value in every measurement
+func readTDXFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+//Check the measurements of the fixture, which start at mrSeam, mrSignerSeam,
+//mrTD, mrConfigID, mrOwner, mrOwnerConfig and rtmr0 to rtmr3
+func checkTDXMeasurements(t *testing.T, report *TDXReport, starts [10]byte) {
+	for i, field := range []struct {
+		name  string
+		value []byte
+	}{
+		{"MRSEAM", report.MRSeam[:]},
+		{"MRSIGNERSEAM", report.MRSignerSeam[:]},
+		{"MRTD", report.MRTD[:]},
+		{"MRCONFIGID", report.MRConfigID[:]},
+		{"MROWNER", report.MROwner[:]},
+		{"MROWNERCONFIG", report.MROwnerConfig[:]},
+		{"RTMR0", report.RTMR[0][:]},
+		{"RTMR1", report.RTMR[1][:]},
+		{"RTMR2", report.RTMR[2][:]},
+		{"RTMR3", report.RTMR[3][:]},
+	} {
+		if !bytes.Equal(field.value, sequence(starts[i], tdxMeasurementSize)) {
+			t.Errorf("%s = %x", field.name, field.value)
+		}
+	}
+	if report.TDAttributes != 0x10000000 || report.XFAM != 0xe71b {
+		t.Errorf("attributes %#x, XFAM %#x", report.TDAttributes, report.XFAM)
+	}
+}
+
+func TestParseTDReport(t *testing.T) {
+	report, err := ParseTDReport(readTDXFixture(t, "tdreport.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Quote {
+		t.Error("TDREPORT parsed as a quote")
+	}
+	if string(bytes.TrimRight(report.ReportData[:], "\x00")) != "raksh tdreport data" {
+		t.Errorf("report data = %q", report.ReportData[:])
+	}
+	if !bytes.Equal(report.TEETCBSVN[:], sequence(0x03, 16)) {
+		t.Errorf("TEE TCB SVN = %x", report.TEETCBSVN)
+	}
+	checkTDXMeasurements(t, report, [10]byte{0x10, 0x40, 0x70, 0xa0, 0xd0, 0x30, 0x60, 0x90, 0xc0, 0xf0})
+
+	_, err = ParseTDReport(readTDXFixture(t, "tdreport.bin")[:tdReportSize-1])
+	if err == nil {
+		t.Error("short TDREPORT parsed")
+	}
+}
+
+func TestParseTDXQuote(t *testing.T) {
+	quote := readTDXFixture(t, "tdx_quote_v4.bin")
+	report, err := ParseTDXQuote(quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Quote {
+		t.Error("quote parsed as a TDREPORT")
+	}
+	if string(bytes.TrimRight(report.ReportData[:], "\x00")) != "raksh tdx quote data" {
+		t.Errorf("report data = %q", report.ReportData[:])
+	}
+	if !bytes.Equal(report.TEETCBSVN[:], sequence(0x05, 16)) {
+		t.Errorf("TEE TCB SVN = %x", report.TEETCBSVN)
+	}
+	checkTDXMeasurements(t, report, [10]byte{0x11, 0x41, 0x71, 0xa1, 0xd1, 0x31, 0x61, 0x91, 0xc1, 0xf1})
+
+	claims := report.Claims()
+	for claim, want := range map[string]string{
+		"quote":         "true",
+		"mr_td":         hex.EncodeToString(sequence(0x71, tdxMeasurementSize)),
+		"rtmr3":         hex.EncodeToString(sequence(0xf1, tdxMeasurementSize)),
+		"td_attributes": "0x10000000",
+	} {
+		if claims[claim] != want {
+			t.Errorf("claim %s = %q, want %q", claim, claims[claim], want)
+		}
+	}
+}
+
+func TestParseTDXQuoteInvalid(t *testing.T) {
+	quote := readTDXFixture(t, "tdx_quote_v4.bin")
+	tests := []struct {
+		name   string
+		modify func(quote []byte) []byte
+	}{
+		{"short", func(quote []byte) []byte { return quote[:tdxQuoteHeaderSize+tdxQuoteBodySize-1] }},
+		{"version 3", func(quote []byte) []byte { binary.LittleEndian.PutUint16(quote, 3); return quote }},
+		{"SGX", func(quote []byte) []byte { binary.LittleEndian.PutUint32(quote[4:], 0); return quote }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseTDXQuote(test.modify(append([]byte(nil), quote...)))
+			if err == nil {
+				t.Error("invalid quote parsed")
+			}
+		})
+	}
+}
+
+//TDX device returning a recorded TDREPORT or quote
+type fakeTDXDevice struct {
+	report     []byte
+	quote      bool
+	err        error
+	reportData [tdxReportDataSize]byte
+}
+
+func (d *fakeTDXDevice) GetReport(reportData [tdxReportDataSize]byte) ([]byte, bool, error) {
+	d.reportData = reportData
+	return d.report, d.quote, d.err
+}
+
+func TestTDXGetEvidence(t *testing.T) {
+	tests := []struct {
+		name       string
+		fixture    string
+		quote      bool
+		reportData string
+	}{
+		{"tdreport", "tdreport.bin", false, "raksh tdreport data"},
+		{"quote", "tdx_quote_v4.bin", true, "raksh tdx quote data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := readTDXFixture(t, test.fixture)
+			device := &fakeTDXDevice{report: raw, quote: test.quote}
+			provider := &tdxProvider{device: device}
+
+			evidence, err := provider.GetEvidence([]byte(test.reportData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if evidence.Kind != TEETDX || !bytes.Equal(evidence.Report, raw) ||
+				evidence.Claims["quote"] != strconv.FormatBool(test.quote) {
+				t.Errorf("evidence = %+v", evidence)
+			}
+			if string(bytes.TrimRight(device.reportData[:], "\x00")) != test.reportData {
+				t.Errorf("requested report data %q", device.reportData[:])
+			}
+
+			_, err = provider.GetEvidence([]byte("other report data"))
+			if err == nil {
+				t.Error("report for other report data accepted")
+			}
+		})
+	}
+
+	device := &fakeTDXDevice{err: errors.New("quoting service unavailable")}
+	_, err := (&tdxProvider{device: device}).GetEvidence(nil)
+	if err != device.err {
+		t.Errorf("device error = %v", err)
+	}
+}
+
+func TestTDXReportDevice(t *testing.T) {
+	dir := t.TempDir()
+	provider := newTDXProvider(filepath.Join(dir, "tdx_guest"), filepath.Join(dir, "tsm"))
+	if _, ok := provider.reportDevice().(*tdxGuestDev); !ok {
+		t.Errorf("device without configfs-tsm = %T", provider.reportDevice())
+	}
+
+	provider = newTDXProvider(filepath.Join(dir, "tdx_guest"), dir)
+	if _, ok := provider.reportDevice().(*tsmReport); !ok {
+		t.Errorf("device with configfs-tsm = %T", provider.reportDevice())
+	}
+}
+
+func TestTDXDetect(t *testing.T) {
+	dir := t.TempDir()
+	devicePath := filepath.Join(dir, "tdx_guest")
+	provider := newTDXProvider(devicePath, filepath.Join(dir, "tsm"))
+	if provider.Detect().Detected {
+		t.Error("detected without a TDX guest device")
+	}
+
+	err := ioutil.WriteFile(devicePath, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &fakeTDXDevice{err: errors.New("no report on the start path")}
+	provider.device = device
+	detection := provider.Detect()
+	if !detection.Detected || detection.Info["evidence"] != "tdreport" || detection.Info["reportError"] != "" {
+		t.Errorf("detection = %+v", detection)
+	}
+	if info := provider.Probe(); info["reportError"] != device.err.Error() {
+		t.Errorf("probe with device error = %v", info)
+	}
+
+	device.err = nil
+	device.report = readTDXFixture(t, "tdreport.bin")
+	info := provider.Probe()
+	if info["tee_tcb_svn"] == "" || info["mr_seam"] == "" || info["reportError"] != "" {
+		t.Errorf("probe = %v", info)
+	}
+}
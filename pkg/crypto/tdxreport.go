@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+//Intel TDX reports and quotes
+//Intel TDX Module ABI Specification, TDREPORT_STRUCT
+//Intel TDX DCAP Quoting Library API, Quote Format v4
+const (
+	tdReportSize = 1024
+	//Offsets into TDREPORT_STRUCT
+	tdReportDataOffset = 128
+	tdTCBInfoOffset    = 256
+	tdInfoOffset       = 512
+
+	tdxQuoteHeaderSize = 48
+	tdxQuoteBodySize   = 584
+	tdxQuoteVersion    = 4
+	tdxQuoteTEEType    = 0x81
+
+	tdxMeasurementSize = 48
+	tdxRTMRCount       = 4
+)
+
+//TDXReport holds the measurements of a TD from a TDREPORT or a quote
+type TDXReport struct {
+	//True when parsed from a quote signed by the quoting enclave, false
+	//for a TDREPORT which is only MACed for the local platform
+	Quote bool
+
+	TEETCBSVN     [16]byte
+	MRSeam        [tdxMeasurementSize]byte
+	MRSignerSeam  [tdxMeasurementSize]byte
+	TDAttributes  uint64
+	XFAM          uint64
+	MRTD          [tdxMeasurementSize]byte
+	MRConfigID    [tdxMeasurementSize]byte
+	MROwner       [tdxMeasurementSize]byte
+	MROwnerConfig [tdxMeasurementSize]byte
+	RTMR          [tdxRTMRCount][tdxMeasurementSize]byte
+	ReportData    [64]byte
+}
+
+//Parse the TDREPORT_STRUCT returned by the TDX guest driver
+func ParseTDReport(data []byte) (*TDXReport, error) {
+	if len(data) < tdReportSize {
+		return nil, fmt.Errorf("TDREPORT too short: %d bytes", len(data))
+	}
+
+	le := binary.LittleEndian
+	r := &TDXReport{}
+	copy(r.ReportData[:], data[tdReportDataOffset:])
+
+	tcbInfo := data[tdTCBInfoOffset:]
+	copy(r.TEETCBSVN[:], tcbInfo[8:])
+	copy(r.MRSeam[:], tcbInfo[24:])
+	copy(r.MRSignerSeam[:], tcbInfo[72:])
+
+	tdInfo := data[tdInfoOffset:]
+	r.TDAttributes = le.Uint64(tdInfo[0:])
+	r.XFAM = le.Uint64(tdInfo[8:])
+	copy(r.MRTD[:], tdInfo[16:])
+	copy(r.MRConfigID[:], tdInfo[64:])
+	copy(r.MROwner[:], tdInfo[112:])
+	copy(r.MROwnerConfig[:], tdInfo[160:])
+	for i := range r.RTMR {
+		copy(r.RTMR[i][:], tdInfo[208+i*tdxMeasurementSize:])
+	}
+	return r, nil
+}
+
+//Parse the header and TD quote body of a version 4 TDX quote. The
+//signature and certification data are left to the verifier.
+func ParseTDXQuote(data []byte) (*TDXReport, error) {
+	if len(data) < tdxQuoteHeaderSize+tdxQuoteBodySize {
+		return nil, fmt.Errorf("TDX quote too short: %d bytes", len(data))
+	}
+
+	le := binary.LittleEndian
+	version := le.Uint16(data[0:])
+	if version != tdxQuoteVersion {
+		return nil, fmt.Errorf("unsupported TDX quote version %d", version)
+	}
+	teeType := le.Uint32(data[4:])
+	if teeType != tdxQuoteTEEType {
+		return nil, fmt.Errorf("not a TDX quote, TEE type %#x", teeType)
+	}
+
+	body := data[tdxQuoteHeaderSize:]
+	r := &TDXReport{Quote: true}
+	copy(r.TEETCBSVN[:], body[0:])
+	copy(r.MRSeam[:], body[16:])
+	copy(r.MRSignerSeam[:], body[64:])
+	r.TDAttributes = le.Uint64(body[120:])
+	r.XFAM = le.Uint64(body[128:])
+	copy(r.MRTD[:], body[136:])
+	copy(r.MRConfigID[:], body[184:])
+	copy(r.MROwner[:], body[232:])
+	copy(r.MROwnerConfig[:], body[280:])
+	for i := range r.RTMR {
+		copy(r.RTMR[i][:], body[328+i*tdxMeasurementSize:])
+	}
+	copy(r.ReportData[:], body[520:])
+	return r, nil
+}
+
+//Claims of the report as evidence
+func (r *TDXReport) Claims() map[string]string {
+	claims := map[string]string{
+		"quote":           strconv.FormatBool(r.Quote),
+		"tee_tcb_svn":     hex.EncodeToString(r.TEETCBSVN[:]),
+		"mr_seam":         hex.EncodeToString(r.MRSeam[:]),
+		"td_attributes":   fmt.Sprintf("%#x", r.TDAttributes),
+		"xfam":            fmt.Sprintf("%#x", r.XFAM),
+		"mr_td":           hex.EncodeToString(r.MRTD[:]),
+		"mr_config_id":    hex.EncodeToString(r.MRConfigID[:]),
+		"mr_owner":        hex.EncodeToString(r.MROwner[:]),
+		"mr_owner_config": hex.EncodeToString(r.MROwnerConfig[:]),
+		"report_data":     hex.EncodeToString(r.ReportData[:]),
+	}
+	for i := range r.RTMR {
+		claims["rtmr"+strconv.Itoa(i)] = hex.EncodeToString(r.RTMR[i][:])
+	}
+	return claims
+}
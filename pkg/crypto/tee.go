@@ -0,0 +1,212 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//TEEKind identifies a TEE technology
+type TEEKind string
+
+const (
+	//Not running in a TEE
+	TEENone TEEKind = "none"
+	//POWER Protected Execution Facility secure VM
+	TEESVM TEEKind = "svm"
+	//AMD Secure Encrypted Virtualization (SEV, SEV-ES)
+	TEESEV TEEKind = "sev"
+	//AMD SEV Secure Nested Paging
+	TEESNP TEEKind = "snp"
+	//Intel Trust Domain Extensions
+	TEETDX TEEKind = "tdx"
+	//IBM Secure Execution for Linux on s390x
+	TEESE TEEKind = "se"
+	//Software emulation for development, protects nothing
+	TEESimulated TEEKind = "simulated"
+	//TPM 2.0 sealing, e.g. of a vTPM
+	TEETPM TEEKind = "tpm"
+)
+
+var (
+	ErrNoAttestation = errors.New("TEE provides no attestation")
+)
+
+//Capabilities of a TEE provider
+type Capabilities struct {
+	//Hardware rooted evidence bound to caller supplied report data
+	Attestation bool `json:"attestation"`
+	//Storage which only this TEE can read back
+	Sealing bool `json:"sealing"`
+	//Secrets injected by the owner when the TEE is launched
+	LaunchSecrets bool `json:"launchSecrets"`
+}
+
+//Evidence of running in a TEE
+type Evidence struct {
+	Kind TEEKind `json:"kind"`
+	//Data bound into the report, e.g. a nonce or a hash of a public key
+	ReportData []byte `json:"reportData,omitempty"`
+	//Report or quote in the TEE specific format
+	Report []byte `json:"report,omitempty"`
+	//Certificates or other endorsements of the report
+	Endorsements [][]byte `json:"endorsements,omitempty"`
+	//Claims extracted from the report, or reported by the TEE
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+//Detection is the outcome of probing for a TEE
+type Detection struct {
+	Kind     TEEKind `json:"kind"`
+	Detected bool    `json:"detected"`
+	//Why the TEE was not detected
+	Reason string `json:"reason,omitempty"`
+	//Firmware, version and device information, where available
+	Info map[string]string `json:"info,omitempty"`
+}
+
+//Detection of the TEE, with info when not nil
+func detected(kind TEEKind, info map[string]string) *Detection {
+	return &Detection{Kind: kind, Detected: true, Info: info}
+}
+
+//Failed detection of the TEE
+func notDetected(kind TEEKind, format string, args ...interface{}) *Detection {
+	reason := fmt.Sprintf(format, args...)
+	log.Debugf("No %s TEE: %s", kind, reason)
+	return &Detection{Kind: kind, Reason: reason}
+}
+
+//DetectionReport describes the TEE the hook runs in
+type DetectionReport struct {
+	//Detected TEE, none when not running in a TEE
+	Kind         TEEKind           `json:"kind"`
+	Capabilities Capabilities      `json:"capabilities"`
+	Info         map[string]string `json:"info,omitempty"`
+	//Detection by each provider, in detection order
+	Providers []*Detection `json:"providers"`
+}
+
+//TEEProvider retrieves the Raksh secrets from a TEE
+type TEEProvider interface {
+	//Probe for this TEE
+	Detect() *Detection
+	Kind() TEEKind
+	Capabilities() Capabilities
+	//Retrieve the named secrets the TEE holds into files in dir.
+	//Secrets the TEE doesn't hold are skipped.
+	FetchSecrets(dir string, names ...string) error
+	//Evidence bound to reportData
+	GetEvidence(reportData []byte) (*Evidence, error)
+}
+
+//TEEProber is implemented by providers whose firmware and version
+//information needs a report or a device session. Detect only checks that
+//the TEE is present, it runs on every container start.
+type TEEProber interface {
+	//Firmware and version information of the detected TEE
+	Probe() map[string]string
+}
+
+var (
+	teeProvidersLock sync.Mutex
+	teeProviders     []TEEProvider
+)
+
+//The built-in providers, in detection order. The VM TEEs come before
+//SEV, which an SNP guest may also expose, and before the TPM, which
+//is often a vTPM inside one of them.
+func init() {
+	RegisterTEEProvider(newTDXProvider(tdxGuestDevice, tsmReportDir))
+	RegisterTEEProvider(newSNPProvider(sevGuestDevice))
+	RegisterTEEProvider(newSEProvider(sysfsRoot, seSecretsDir))
+	RegisterTEEProvider(NewSVMProvider(ESMBTool, 0))
+	RegisterTEEProvider(newSEVProvider(sevSecretsDir))
+	pcrs, _ := ParsePCRSelection(TPMDefaultPCRs)
+	RegisterTEEProvider(NewTPMProvider(TPMDevice, TPMSealedDir, pcrs, TPMParentHandle))
+	RegisterTEEProvider(NewSimulatedProvider(SimulatedStoreDir))
+}
+
+//Make a TEE provider available for detection and lookup
+func RegisterTEEProvider(provider TEEProvider) {
+	teeProvidersLock.Lock()
+	defer teeProvidersLock.Unlock()
+
+	for i, registered := range teeProviders {
+		if registered.Kind() == provider.Kind() {
+			teeProviders[i] = provider
+			return
+		}
+	}
+	teeProviders = append(teeProviders, provider)
+}
+
+//Returns the registered TEE providers, in registration order
+func TEEProviders() []TEEProvider {
+	teeProvidersLock.Lock()
+	defer teeProvidersLock.Unlock()
+
+	return append([]TEEProvider(nil), teeProviders...)
+}
+
+//Returns the TEE provider of the given kind
+func LookupTEEProvider(kind TEEKind) (TEEProvider, error) {
+	for _, provider := range TEEProviders() {
+		if provider.Kind() == kind {
+			return provider, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown TEE %q", kind)
+}
+
+//Probe all registered providers. The first detected TEE is selected, the
+//simulated TEE is only ever used when configured.
+func DetectTEE() (*DetectionReport, TEEProvider) {
+	return detectTEE(false)
+}
+
+//Detect the TEE like DetectTEE, with the firmware and version information
+//of the detected providers, e.g. for the detect command
+func ProbeTEE() *DetectionReport {
+	report, _ := detectTEE(true)
+	return report
+}
+
+func detectTEE(probe bool) (*DetectionReport, TEEProvider) {
+	report := &DetectionReport{Kind: TEENone}
+	var selected TEEProvider
+	for _, provider := range TEEProviders() {
+		detection := provider.Detect()
+		if prober, ok := provider.(TEEProber); ok && probe && detection.Detected {
+			if detection.Info == nil {
+				detection.Info = map[string]string{}
+			}
+			for name, value := range prober.Probe() {
+				detection.Info[name] = value
+			}
+		}
+		report.Providers = append(report.Providers, detection)
+		if selected == nil && detection.Detected && provider.Kind() != TEESimulated {
+			selected = provider
+			report.Kind = provider.Kind()
+			report.Capabilities = provider.Capabilities()
+			report.Info = detection.Info
+		}
+	}
+	return report, selected
+}
+
+//Returns the provider of the TEE the hook runs in, or nil when not
+//running in a TEE
+func DetectTEEProvider() TEEProvider {
+	log.Info("Check if running in VM TEE")
+	_, provider := DetectTEE()
+	if provider == nil {
+		log.Info("Not running in a VM TEE")
+		return nil
+	}
+	log.Infof("Running in VM TEE %s", provider.Kind())
+	return provider
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+//Provider detected or not, without any device
+type fakeProvider struct {
+	kind     TEEKind
+	detected bool
+}
+
+func (p *fakeProvider) Kind() TEEKind {
+	return p.kind
+}
+
+func (p *fakeProvider) Detect() *Detection {
+	if !p.detected {
+		return notDetected(p.kind, "fake")
+	}
+	return detected(p.kind, nil)
+}
+
+func (p *fakeProvider) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func (p *fakeProvider) FetchSecrets(dir string, names ...string) error {
+	return nil
+}
+
+func (p *fakeProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	return nil, ErrNoAttestation
+}
+
+func TestBuiltinDetectionOrder(t *testing.T) {
+	var kinds []TEEKind
+	for _, provider := range TEEProviders() {
+		kinds = append(kinds, provider.Kind())
+	}
+	want := []TEEKind{TEETDX, TEESNP, TEESE, TEESVM, TEESEV, TEETPM, TEESimulated}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("detection order %v, want %v", kinds, want)
+	}
+}
+
+func TestDetectTEE(t *testing.T) {
+	registered := TEEProviders()
+	defer func() {
+		teeProvidersLock.Lock()
+		teeProviders = registered
+		teeProvidersLock.Unlock()
+	}()
+
+	tests := []struct {
+		name     string
+		detected []TEEKind
+		kind     TEEKind
+	}{
+		{"SNP with a vTPM and SEV", []TEEKind{TEESNP, TEESEV, TEETPM}, TEESNP},
+		{"TDX with a vTPM", []TEEKind{TEETDX, TEETPM}, TEETDX},
+		{"SE with a TPM", []TEEKind{TEESE, TEETPM}, TEESE},
+		{"SEV with a vTPM", []TEEKind{TEESEV, TEETPM}, TEESEV},
+		{"TPM only", []TEEKind{TEETPM}, TEETPM},
+		{"simulated only", []TEEKind{TEESimulated}, TEENone},
+		{"none", nil, TEENone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			teeProvidersLock.Lock()
+			teeProviders = nil
+			teeProvidersLock.Unlock()
+			for _, provider := range registered {
+				fake := &fakeProvider{kind: provider.Kind()}
+				for _, kind := range test.detected {
+					fake.detected = fake.detected || kind == provider.Kind()
+				}
+				RegisterTEEProvider(fake)
+			}
+
+			report, provider := DetectTEE()
+			if report.Kind != test.kind {
+				t.Errorf("detected %s, want %s", report.Kind, test.kind)
+			}
+			if (provider == nil) != (test.kind == TEENone) || (provider != nil && provider.Kind() != test.kind) {
+				t.Errorf("selected provider %v", provider)
+			}
+			if len(report.Providers) != len(registered) {
+				t.Errorf("%d providers reported", len(report.Providers))
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package crypto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//TPM resource manager
+	TPMDevice = "/dev/tpmrm0"
+	//Sealed secrets in the guest image, named as the Raksh secrets
+	TPMSealedDir = "/usr/share/raksh/tpm"
+	//Persistent storage primary key, created when missing
+	TPMParentHandle = 0x81000001
+	//PCRs of the firmware, boot loader and secure boot state
+	TPMDefaultPCRs = "sha256:0,2,4,7"
+)
+
+//vTPM or TPM 2.0 of the VM. The secrets are TPM objects sealed to a PCR
+//policy, they only unseal when the measured boot state matches the policy.
+type tpmProvider struct {
+	device    string
+	sealedDir string
+	pcrs      *PCRSelection
+	parent    uint32
+}
+
+//New TPM provider unsealing the secrets in sealedDir with the TPM at
+//device, see openTPM. The objects must be children of the persistent
+//parent or of the default ECC primary key.
+func NewTPMProvider(device string, sealedDir string, pcrs *PCRSelection, parent uint32) TEEProvider {
+	return &tpmProvider{device: device, sealedDir: sealedDir, pcrs: pcrs, parent: parent}
+}
+
+func (p *tpmProvider) Kind() TEEKind {
+	return TEETPM
+}
+
+//A TPM and sealed secrets for it
+func (p *tpmProvider) Detect() *Detection {
+	if _, err := os.Stat(p.sealedDir); err != nil {
+		return notDetected(TEETPM, "no TPM sealed secrets: %s", err)
+	}
+	if filepath.IsAbs(p.device) {
+		if _, err := os.Stat(p.device); err != nil {
+			return notDetected(TEETPM, "no TPM: %s", err)
+		}
+	}
+	log.Info("It is a VM with a TPM and TPM sealed secrets")
+	return detected(TEETPM, map[string]string{"device": p.device, "pcrs": p.pcrs.String()})
+}
+
+//Manufacturer and firmware version of the TPM
+func (p *tpmProvider) Probe() map[string]string {
+	t, err := openTPM(p.device)
+	if err != nil {
+		return map[string]string{"tpmError": err.Error()}
+	}
+	defer t.Close()
+	manufacturer, firmware, err := t.version()
+	if err != nil {
+		return map[string]string{"tpmError": err.Error()}
+	}
+	return map[string]string{"manufacturer": manufacturer, "firmwareVersion": firmware}
+}
+
+func (p *tpmProvider) Capabilities() Capabilities {
+	return Capabilities{Sealing: true}
+}
+
+//Unseal the named secrets into dir
+func (p *tpmProvider) FetchSecrets(dir string, names ...string) error {
+
+	log.Debug("Populating secrets for TPM")
+	err := os.MkdirAll(dir, os.ModeDir)
+	if err != nil {
+		log.Error("Unable to create directory for storing TPM secrets ", err)
+		return err
+	}
+
+	t, err := openTPM(p.device)
+	if err != nil {
+		log.Errorf("Unable to open the TPM %s: %s", p.device, err)
+		return err
+	}
+	defer t.Close()
+
+	parent := p.parent
+	if err := t.readPublic(parent); err != nil {
+		log.Infof("No persistent parent %#x, creating the primary key: %s", parent, err)
+		parent, err = t.createPrimary()
+		if err != nil {
+			log.Error("Unable to create the TPM primary key: ", err)
+			return err
+		}
+		defer t.flush(parent)
+	}
+
+	for _, name := range names {
+		keyFile := filepath.Join(dir, name)
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("Secrets File exists for: ", keyFile)
+			continue
+		}
+
+		sealed, err := ioutil.ReadFile(filepath.Join(p.sealedDir, filepath.Base(name)))
+		if os.IsNotExist(err) {
+			log.Infof("No TPM sealed %s", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		secret, err := p.unseal(t, parent, sealed)
+		if err != nil {
+			log.Errorf("Unable to unseal %s, the boot state may not match its policy: %s", name, err)
+			return err
+		}
+		err = ioutil.WriteFile(keyFile, secret.Bytes(), 0600)
+		secret.Destroy()
+		if err != nil {
+			log.Errorf("Unable to write %s: %s", keyFile, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Load the sealed object and unseal it with a PCR policy session
+func (p *tpmProvider) unseal(t *tpm, parent uint32, sealed []byte) (*SecureBuffer, error) {
+	item, err := t.load(parent, sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer t.flush(item)
+
+	session, err := t.pcrPolicySession(p.pcrs)
+	if err != nil {
+		return nil, err
+	}
+	return t.unseal(item, session)
+}
+
+//Quotes need an attestation key certified for the TPM
+func (p *tpmProvider) GetEvidence(reportData []byte) (*Evidence, error) {
+	return nil, ErrNoAttestation
+}
@@ -0,0 +1,422 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Minimal TPM 2.0 client for unsealing and extending PCRs
+//TCG TPM 2.0 Library Specification, Part 2 Structures and Part 3 Commands
+const (
+	tpmSTNoSessions = 0x8001
+	tpmSTSessions   = 0x8002
+
+	tpmCCCreatePrimary    = 0x00000131
+	tpmCCLoad             = 0x00000157
+	tpmCCUnseal           = 0x0000015e
+	tpmCCFlushContext     = 0x00000165
+	tpmCCReadPublic       = 0x00000173
+	tpmCCStartAuthSession = 0x00000176
+	tpmCCPolicyPCR        = 0x0000017f
+	tpmCCGetCapability    = 0x0000017a
+	tpmCCPCREvent         = 0x0000013c
+
+	tpmRHOwner = 0x40000001
+	tpmRHNull  = 0x40000007
+	tpmRSPW    = 0x40000009
+
+	tpmAlgAES      = 0x0006
+	tpmAlgSHA1     = 0x0004
+	tpmAlgSHA256   = 0x000b
+	tpmAlgSHA384   = 0x000c
+	tpmAlgSHA512   = 0x000d
+	tpmAlgNull     = 0x0010
+	tpmAlgECC      = 0x0023
+	tpmAlgCFB      = 0x0043
+	tpmECCNISTP256 = 0x0003
+
+	tpmSEPolicy = 0x01
+
+	tpmCapTPMProperties   = 0x00000006
+	tpmPTManufacturer     = 0x00000105
+	tpmPTFirmwareVersion1 = 0x0000010b
+	tpmPTFirmwareVersion2 = 0x0000010c
+
+	tpmHeaderSize = 10
+	//Largest response of the supported commands
+	tpmMaxResponseSize = 4096
+	tpmPCRSelectSize   = 3
+	tpmPCRCount        = tpmPCRSelectSize * 8
+)
+
+//TPMError is a response code other than success
+type TPMError struct {
+	Command uint32
+	Code    uint32
+}
+
+func (e *TPMError) Error() string {
+	return fmt.Sprintf("TPM command %#x failed with response code %#x", e.Command, e.Code)
+}
+
+//Hash algorithms of PCR banks
+var tpmHashAlgs = map[string]uint16{
+	"sha1":   tpmAlgSHA1,
+	"sha256": tpmAlgSHA256,
+	"sha384": tpmAlgSHA384,
+	"sha512": tpmAlgSHA512,
+}
+
+//PCR selection of one bank
+type PCRSelection struct {
+	Hash uint16
+	PCRs []int
+}
+
+//Parse a PCR selection such as sha256:0,2,7
+func ParsePCRSelection(selection string) (*PCRSelection, error) {
+	parts := strings.SplitN(selection, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid PCR selection %q", selection)
+	}
+	hash, ok := tpmHashAlgs[strings.ToLower(parts[0])]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PCR bank %q", parts[0])
+	}
+
+	pcrs := &PCRSelection{Hash: hash}
+	for _, field := range strings.Split(parts[1], ",") {
+		pcr, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || pcr < 0 || pcr >= tpmPCRCount {
+			return nil, fmt.Errorf("invalid PCR %q", field)
+		}
+		pcrs.PCRs = append(pcrs.PCRs, pcr)
+	}
+	return pcrs, nil
+}
+
+//Selection in the format of ParsePCRSelection
+func (s *PCRSelection) String() string {
+	bank := fmt.Sprintf("%#x", s.Hash)
+	for name, hash := range tpmHashAlgs {
+		if hash == s.Hash {
+			bank = name
+		}
+	}
+	pcrs := make([]string, len(s.PCRs))
+	for i, pcr := range s.PCRs {
+		pcrs[i] = strconv.Itoa(pcr)
+	}
+	return bank + ":" + strings.Join(pcrs, ",")
+}
+
+//TPML_PCR_SELECTION with this bank
+func (s *PCRSelection) marshal(buf *bytes.Buffer) {
+	var bitmap [tpmPCRSelectSize]byte
+	for _, pcr := range s.PCRs {
+		bitmap[pcr/8] |= 1 << uint(pcr%8)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(1))
+	binary.Write(buf, binary.BigEndian, s.Hash)
+	buf.WriteByte(tpmPCRSelectSize)
+	buf.Write(bitmap[:])
+}
+
+//TPM connection, the resource manager device or a socket of a TPM
+//simulator such as swtpm
+type tpm struct {
+	lock sync.Mutex
+	rw   io.ReadWriteCloser
+}
+
+//Open the TPM at path. unix:<path> and tcp:<host:port> connect to the
+//data socket of a simulator, anything else is a character device.
+func openTPM(path string) (*tpm, error) {
+	var rw io.ReadWriteCloser
+	var err error
+	switch {
+	case strings.HasPrefix(path, "unix:"):
+		rw, err = net.Dial("unix", strings.TrimPrefix(path, "unix:"))
+	case strings.HasPrefix(path, "tcp:"):
+		rw, err = net.Dial("tcp", strings.TrimPrefix(path, "tcp:"))
+	default:
+		rw, err = os.OpenFile(path, os.O_RDWR, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tpm{rw: rw}, nil
+}
+
+func (t *tpm) Close() error {
+	return t.rw.Close()
+}
+
+//Command authorizations
+type tpmSession struct {
+	handle uint32
+}
+
+//Empty password authorization
+var tpmPasswordSession = &tpmSession{handle: tpmRSPW}
+
+//Send a command and return the response handles and parameters
+func (t *tpm) run(command uint32, handles []uint32, session *tpmSession, params []byte) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	body := &bytes.Buffer{}
+	for _, handle := range handles {
+		binary.Write(body, binary.BigEndian, handle)
+	}
+	tag := uint16(tpmSTNoSessions)
+	if session != nil {
+		tag = tpmSTSessions
+		//TPMS_AUTH_COMMAND with empty nonce and hmac
+		binary.Write(body, binary.BigEndian, uint32(9))
+		binary.Write(body, binary.BigEndian, session.handle)
+		binary.Write(body, binary.BigEndian, uint16(0))
+		body.WriteByte(0)
+		binary.Write(body, binary.BigEndian, uint16(0))
+	}
+	body.Write(params)
+
+	request := &bytes.Buffer{}
+	binary.Write(request, binary.BigEndian, tag)
+	binary.Write(request, binary.BigEndian, uint32(tpmHeaderSize+body.Len()))
+	binary.Write(request, binary.BigEndian, command)
+	request.Write(body.Bytes())
+	_, err := t.rw.Write(request.Bytes())
+	Wipe(request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	//The device returns the response in one read, sockets may split it
+	response := make([]byte, tpmMaxResponseSize)
+	n := 0
+	for n < tpmHeaderSize || n < int(binary.BigEndian.Uint32(response[2:])) {
+		m, err := t.rw.Read(response[n:])
+		n += m
+		if err != nil {
+			return nil, err
+		}
+		if n >= tpmHeaderSize && int(binary.BigEndian.Uint32(response[2:])) > len(response) {
+			return nil, errors.New("TPM response too large")
+		}
+	}
+	code := binary.BigEndian.Uint32(response[6:])
+	if code != 0 {
+		return nil, &TPMError{Command: command, Code: code}
+	}
+
+	out := response[tpmHeaderSize:binary.BigEndian.Uint32(response[2:])]
+	if binary.BigEndian.Uint16(response[0:]) == tpmSTSessions {
+		//Handles, then the parameter size and the parameters. The
+		//response authorizations are not needed.
+		handleSize := 0
+		if command == tpmCCCreatePrimary || command == tpmCCLoad {
+			handleSize = 4
+		}
+		if len(out) < handleSize+4 {
+			return nil, errors.New("truncated TPM response")
+		}
+		paramSize := int(binary.BigEndian.Uint32(out[handleSize:]))
+		if len(out) < handleSize+4+paramSize {
+			return nil, errors.New("truncated TPM response")
+		}
+		handlesAndParams := make([]byte, 0, handleSize+paramSize)
+		handlesAndParams = append(handlesAndParams, out[:handleSize]...)
+		out = append(handlesAndParams, out[handleSize+4:handleSize+4+paramSize]...)
+		Wipe(response)
+	}
+	return out, nil
+}
+
+//Append a TPM2B
+func writeTPM2B(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+//Split a TPM2B off data
+func readTPM2B(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated TPM2B")
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+size {
+		return nil, nil, errors.New("truncated TPM2B")
+	}
+	return data[2 : 2+size], data[2+size:], nil
+}
+
+//Check a persistent object exists
+func (t *tpm) readPublic(handle uint32) error {
+	_, err := t.run(tpmCCReadPublic, []uint32{handle}, nil, nil)
+	return err
+}
+
+//Create the ECC P-256 storage primary key of the owner hierarchy, with
+//the template of tpm2_createprimary -C o -G ecc
+func (t *tpm) createPrimary() (uint32, error) {
+	params := &bytes.Buffer{}
+	//TPM2B_SENSITIVE_CREATE without auth and data
+	writeTPM2B(params, []byte{0, 0, 0, 0})
+
+	template := &bytes.Buffer{}
+	binary.Write(template, binary.BigEndian, uint16(tpmAlgECC))
+	binary.Write(template, binary.BigEndian, uint16(tpmAlgSHA256))
+	//fixedTPM, fixedParent, sensitiveDataOrigin, userWithAuth, restricted, decrypt
+	binary.Write(template, binary.BigEndian, uint32(0x00030072))
+	writeTPM2B(template, nil)
+	binary.Write(template, binary.BigEndian, []uint16{tpmAlgAES, 128, tpmAlgCFB, tpmAlgNull, tpmECCNISTP256, tpmAlgNull})
+	writeTPM2B(template, nil)
+	writeTPM2B(template, nil)
+	writeTPM2B(params, template.Bytes())
+
+	//No outside info and creation PCRs
+	writeTPM2B(params, nil)
+	binary.Write(params, binary.BigEndian, uint32(0))
+
+	out, err := t.run(tpmCCCreatePrimary, []uint32{tpmRHOwner}, tpmPasswordSession, params.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(out), nil
+}
+
+//Load a sealed object, its TPM2B_PUBLIC followed by its TPM2B_PRIVATE
+//as written by tpm2_create -u and -r
+func (t *tpm) load(parent uint32, sealed []byte) (uint32, error) {
+	public, rest, err := readTPM2B(sealed)
+	if err != nil {
+		return 0, err
+	}
+	private, rest, err := readTPM2B(rest)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) != 0 {
+		return 0, errors.New("trailing data after the sealed object")
+	}
+
+	params := &bytes.Buffer{}
+	writeTPM2B(params, private)
+	writeTPM2B(params, public)
+	out, err := t.run(tpmCCLoad, []uint32{parent}, tpmPasswordSession, params.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(out), nil
+}
+
+//Extend the PCR of all banks with the digest of their bank over event
+func (t *tpm) pcrEvent(pcr int, event []byte) error {
+	if pcr < 0 || pcr >= tpmPCRCount {
+		return fmt.Errorf("invalid PCR %d", pcr)
+	}
+	params := &bytes.Buffer{}
+	writeTPM2B(params, event)
+	_, err := t.run(tpmCCPCREvent, []uint32{uint32(pcr)}, tpmPasswordSession, params.Bytes())
+	return err
+}
+
+//Start a policy session satisfied by the current values of the PCRs
+func (t *tpm) pcrPolicySession(pcrs *PCRSelection) (*tpmSession, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &bytes.Buffer{}
+	writeTPM2B(params, nonce)
+	writeTPM2B(params, nil)
+	params.WriteByte(tpmSEPolicy)
+	binary.Write(params, binary.BigEndian, []uint16{tpmAlgNull, tpmAlgSHA256})
+	out, err := t.run(tpmCCStartAuthSession, []uint32{tpmRHNull, tpmRHNull}, nil, params.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	session := &tpmSession{handle: binary.BigEndian.Uint32(out)}
+
+	params.Reset()
+	writeTPM2B(params, nil)
+	pcrs.marshal(params)
+	_, err = t.run(tpmCCPolicyPCR, []uint32{session.handle}, nil, params.Bytes())
+	if err != nil {
+		t.flush(session.handle)
+		return nil, err
+	}
+	return session, nil
+}
+
+//Unseal a loaded object. The TPM flushes the policy session when the
+//unseal succeeds.
+func (t *tpm) unseal(item uint32, session *tpmSession) (*SecureBuffer, error) {
+	out, err := t.run(tpmCCUnseal, []uint32{item}, session, nil)
+	defer Wipe(out)
+	if err != nil {
+		t.flush(session.handle)
+		return nil, err
+	}
+	data, _, err := readTPM2B(out)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := NewSecureBuffer(len(data))
+	if err != nil {
+		return nil, err
+	}
+	copy(secret.Bytes(), data)
+	return secret, nil
+}
+
+//Release a transient object or session
+func (t *tpm) flush(handle uint32) {
+	params := make([]byte, 4)
+	binary.BigEndian.PutUint32(params, handle)
+	t.run(tpmCCFlushContext, nil, nil, params)
+}
+
+//Manufacturer and firmware version from the fixed TPM properties
+func (t *tpm) version() (string, string, error) {
+	params := make([]byte, 12)
+	binary.BigEndian.PutUint32(params[0:], tpmCapTPMProperties)
+	binary.BigEndian.PutUint32(params[4:], tpmPTManufacturer)
+	binary.BigEndian.PutUint32(params[8:], tpmPTFirmwareVersion2-tpmPTManufacturer+1)
+	out, err := t.run(tpmCCGetCapability, nil, nil, params)
+	if err != nil {
+		return "", "", err
+	}
+
+	//moreData u8 | capability u32 | TPML_TAGGED_TPM_PROPERTY
+	if len(out) < 9 {
+		return "", "", errors.New("truncated TPM capability")
+	}
+	count := int(binary.BigEndian.Uint32(out[5:]))
+	out = out[9:]
+	if len(out) < count*8 {
+		return "", "", errors.New("truncated TPM capability")
+	}
+	properties := make(map[uint32]uint32, count)
+	for i := 0; i < count; i++ {
+		properties[binary.BigEndian.Uint32(out[i*8:])] = binary.BigEndian.Uint32(out[i*8+4:])
+	}
+
+	manufacturer := make([]byte, 4)
+	binary.BigEndian.PutUint32(manufacturer, properties[tpmPTManufacturer])
+	v1, v2 := properties[tpmPTFirmwareVersion1], properties[tpmPTFirmwareVersion2]
+	firmware := fmt.Sprintf("%d.%d.%d.%d", v1>>16, v1&0xffff, v2>>16, v2&0xffff)
+	return strings.TrimRight(string(manufacturer), "\x00 "), firmware, nil
+}
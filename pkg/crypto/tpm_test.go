@@ -0,0 +1,624 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	tpmCCCreate = 0x00000153
+
+	tpmAlgKeyedHash = 0x0008
+	//fixedTPM, fixedParent, and no userWithAuth so that only the policy
+	//authorizes the unseal
+	tpmSealedAttributes = 0x00000012
+
+	tpmRCHandle     = 0x0000018b
+	tpmRCPolicyFail = 0x0000099d
+	tpmRCValue      = 0x00000084
+	tpmRCTag        = 0x0000001e
+)
+
+//PCR of the seal tests, resettable and zero after TPM2_Startup
+const tpmTestPCR = 16
+
+//Parses a TPM command, remembering the first error
+type tpmReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tpmReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = errors.New("truncated command")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tpmReader) u8() uint8   { return r.next(1)[0] }
+func (r *tpmReader) u16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *tpmReader) u32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *tpmReader) tpm2b() []byte {
+	return append([]byte(nil), r.next(int(r.u16()))...)
+}
+
+//Check the value read, failing the command otherwise
+func (r *tpmReader) expect(name string, got uint32, want uint32) {
+	if r.err == nil && got != want {
+		r.err = fmt.Errorf("%s is %#x, not %#x", name, got, want)
+	}
+}
+
+//Sealed data object of TPM2B_PUBLIC
+type fakeTPMObject struct {
+	authPolicy []byte
+	secret     []byte
+}
+
+//TPM 2.0 speaking the commands of the hook over a socket, with a SHA-256
+//PCR bank, a transient primary key and PCR policy sessions. The sealed
+//objects are not encrypted. Commands are parsed as specified in Part 3
+//so that malformed encodings fail.
+type fakeTPM struct {
+	t        *testing.T
+	lock     sync.Mutex
+	pcrs     [tpmPCRCount][sha256.Size]byte
+	primary  uint32
+	objects  map[uint32]*fakeTPMObject
+	sessions map[uint32][]byte
+	handles  uint32
+	//Requests received
+	commands [][]byte
+}
+
+//Start a fake TPM on a unix socket and return its openTPM path
+func startFakeTPM(t *testing.T) (*fakeTPM, string) {
+	f := &fakeTPM{t: t, objects: map[uint32]*fakeTPMObject{}, sessions: map[uint32][]byte{}}
+	socket := filepath.Join(t.TempDir(), "tpm.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, "unix:" + socket
+}
+
+func (f *fakeTPM) serve(conn net.Conn) {
+	defer conn.Close()
+	request := make([]byte, tpmMaxResponseSize)
+	for {
+		n, err := conn.Read(request)
+		if err != nil {
+			return
+		}
+		_, err = conn.Write(f.execute(append([]byte(nil), request[:n]...)))
+		if err != nil {
+			return
+		}
+	}
+}
+
+//Response to a command
+func (f *fakeTPM) execute(request []byte) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.commands = append(f.commands, request)
+
+	r := &tpmReader{data: request}
+	tag := r.u16()
+	r.expect("command size", r.u32(), uint32(len(request)))
+	command := r.u32()
+	if r.err != nil || tag != tpmSTNoSessions && tag != tpmSTSessions {
+		return tpmResponse(tpmRCTag, nil, nil, false)
+	}
+
+	handles, params, code := f.command(command, r)
+	if code == 0 && r.err == nil && len(r.data) != 0 {
+		r.err = errors.New("trailing parameters")
+	}
+	if code == 0 && r.err != nil {
+		f.t.Errorf("TPM command %#x: %s", command, r.err)
+		code = tpmRCValue
+	}
+	return tpmResponse(code, handles, params, tag == tpmSTSessions)
+}
+
+//TPM response with one response authorization for commands with sessions
+func tpmResponse(code uint32, handles []uint32, params []byte, sessions bool) []byte {
+	body := &bytes.Buffer{}
+	tag := uint16(tpmSTNoSessions)
+	if code == 0 {
+		for _, handle := range handles {
+			binary.Write(body, binary.BigEndian, handle)
+		}
+		if sessions {
+			tag = tpmSTSessions
+			binary.Write(body, binary.BigEndian, uint32(len(params)))
+		}
+		body.Write(params)
+		if sessions {
+			//TPMS_AUTH_RESPONSE with empty nonce and hmac
+			body.Write([]byte{0, 0, 0, 0, 0})
+		}
+	}
+	response := &bytes.Buffer{}
+	binary.Write(response, binary.BigEndian, tag)
+	binary.Write(response, binary.BigEndian, uint32(tpmHeaderSize+body.Len()))
+	binary.Write(response, binary.BigEndian, code)
+	response.Write(body.Bytes())
+	return response.Bytes()
+}
+
+//Parse the authorization area with a single session
+func (f *fakeTPM) session(r *tpmReader) uint32 {
+	size := r.u32()
+	start := len(r.data)
+	handle := r.u32()
+	r.tpm2b()
+	r.u8()
+	r.tpm2b()
+	r.expect("authorization size", uint32(start-len(r.data)), size)
+	return handle
+}
+
+//Parse TPM2B_PUBLIC of a sealed data object
+func parseSealedPublic(public []byte) (*fakeTPMObject, error) {
+	r := &tpmReader{data: public}
+	r.expect("object type", uint32(r.u16()), tpmAlgKeyedHash)
+	r.expect("name algorithm", uint32(r.u16()), tpmAlgSHA256)
+	r.expect("object attributes", r.u32(), tpmSealedAttributes)
+	object := &fakeTPMObject{authPolicy: r.tpm2b()}
+	r.expect("keyed hash scheme", uint32(r.u16()), tpmAlgNull)
+	r.tpm2b()
+	if r.err == nil && len(r.data) != 0 {
+		r.err = errors.New("trailing data in the public area")
+	}
+	return object, r.err
+}
+
+//Execute a command, returning the response handles and parameters
+func (f *fakeTPM) command(command uint32, r *tpmReader) ([]uint32, []byte, uint32) {
+	params := &bytes.Buffer{}
+
+	switch command {
+	case tpmCCReadPublic:
+		//No persistent objects
+		r.u32()
+		return nil, nil, tpmRCHandle
+
+	case tpmCCCreatePrimary:
+		r.expect("hierarchy", r.u32(), tpmRHOwner)
+		r.expect("session", f.session(r), tpmRSPW)
+		sensitive := r.tpm2b()
+		template := r.tpm2b()
+		r.tpm2b()
+		r.expect("creation PCRs", r.u32(), 0)
+		//tpm2_createprimary -C o -G ecc
+		want, _ := hex.DecodeString("0023000b00030072000000060080004300100003001000000000")
+		if r.err == nil && (!bytes.Equal(sensitive, []byte{0, 0, 0, 0}) || !bytes.Equal(template, want)) {
+			r.err = fmt.Errorf("primary template %x", template)
+		}
+		f.handles++
+		f.primary = 0x80000000 + f.handles
+		writeTPM2B(params, template)
+		return []uint32{f.primary}, params.Bytes(), 0
+
+	case tpmCCCreate:
+		if r.u32() != f.primary || f.primary == 0 {
+			return nil, nil, tpmRCHandle
+		}
+		r.expect("session", f.session(r), tpmRSPW)
+		sensitive := &tpmReader{data: r.tpm2b()}
+		sensitive.tpm2b()
+		secret := sensitive.tpm2b()
+		public := r.tpm2b()
+		r.tpm2b()
+		r.expect("creation PCRs", r.u32(), 0)
+		if _, err := parseSealedPublic(public); r.err == nil && err != nil {
+			r.err = err
+		}
+		writeTPM2B(params, secret)
+		writeTPM2B(params, public)
+		//Creation data and hash, TPMT_TK_CREATION
+		params.Write([]byte{0, 0, 0, 0, 0x80, 0x21, 0x40, 0, 0, 1, 0, 0})
+		return nil, params.Bytes(), 0
+
+	case tpmCCLoad:
+		if r.u32() != f.primary || f.primary == 0 {
+			return nil, nil, tpmRCHandle
+		}
+		r.expect("session", f.session(r), tpmRSPW)
+		secret := r.tpm2b()
+		object, err := parseSealedPublic(r.tpm2b())
+		if err != nil {
+			return nil, nil, tpmRCValue
+		}
+		object.secret = secret
+		f.handles++
+		handle := 0x80000000 + f.handles
+		f.objects[handle] = object
+		//Name
+		writeTPM2B(params, []byte{0, 0x0b})
+		return []uint32{handle}, params.Bytes(), 0
+
+	case tpmCCStartAuthSession:
+		r.expect("tpmKey", r.u32(), tpmRHNull)
+		r.expect("bind", r.u32(), tpmRHNull)
+		r.expect("nonce size", uint32(len(r.tpm2b())), 16)
+		r.expect("salt size", uint32(len(r.tpm2b())), 0)
+		r.expect("session type", uint32(r.u8()), tpmSEPolicy)
+		r.expect("symmetric", uint32(r.u16()), tpmAlgNull)
+		r.expect("authHash", uint32(r.u16()), tpmAlgSHA256)
+		f.handles++
+		handle := 0x03000000 + f.handles
+		f.sessions[handle] = make([]byte, sha256.Size)
+		writeTPM2B(params, make([]byte, 16))
+		return []uint32{handle}, params.Bytes(), 0
+
+	case tpmCCPolicyPCR:
+		handle := r.u32()
+		r.expect("PCR digest size", uint32(len(r.tpm2b())), 0)
+		selection := r.next(10)
+		digest, ok := f.sessions[handle]
+		if !ok {
+			return nil, nil, tpmRCHandle
+		}
+		pcrs, err := parsePCRSelection(selection)
+		if err != nil {
+			r.err = err
+			return nil, nil, 0
+		}
+		f.sessions[handle] = policyPCRDigest(digest, selection, f.pcrValues(pcrs))
+		return nil, nil, 0
+
+	case tpmCCUnseal:
+		object, ok := f.objects[r.u32()]
+		session := f.session(r)
+		digest, isSession := f.sessions[session]
+		if !ok || !isSession {
+			return nil, nil, tpmRCHandle
+		}
+		if !bytes.Equal(digest, object.authPolicy) {
+			return nil, nil, tpmRCPolicyFail
+		}
+		//continueSession is clear
+		delete(f.sessions, session)
+		writeTPM2B(params, object.secret)
+		return nil, params.Bytes(), 0
+
+	case tpmCCFlushContext:
+		handle := r.u32()
+		switch {
+		case handle == f.primary && handle != 0:
+			f.primary = 0
+		case f.objects[handle] != nil:
+			delete(f.objects, handle)
+		case f.sessions[handle] != nil:
+			delete(f.sessions, handle)
+		default:
+			return nil, nil, tpmRCHandle
+		}
+		return nil, nil, 0
+
+	case tpmCCPCREvent:
+		pcr := r.u32()
+		r.expect("session", f.session(r), tpmRSPW)
+		event := sha256.Sum256(r.tpm2b())
+		if pcr >= tpmPCRCount {
+			return nil, nil, tpmRCValue
+		}
+		f.pcrs[pcr] = sha256.Sum256(append(f.pcrs[pcr][:], event[:]...))
+		//TPML_DIGEST_VALUES of the SHA-256 bank
+		binary.Write(params, binary.BigEndian, []uint16{0, 1, tpmAlgSHA256})
+		params.Write(event[:])
+		return nil, params.Bytes(), 0
+
+	case tpmCCGetCapability:
+		r.expect("capability", r.u32(), tpmCapTPMProperties)
+		r.expect("property", r.u32(), tpmPTManufacturer)
+		r.u32()
+		params.WriteByte(0)
+		binary.Write(params, binary.BigEndian, []uint32{tpmCapTPMProperties, 3,
+			tpmPTManufacturer, 0x49424d00, tpmPTFirmwareVersion1, 0x00020001, tpmPTFirmwareVersion2, 0x00030004})
+		return nil, params.Bytes(), 0
+	}
+	return nil, nil, tpmRCValue
+}
+
+//PCRs of a TPML_PCR_SELECTION of the SHA-256 bank
+func parsePCRSelection(selection []byte) ([]int, error) {
+	r := &tpmReader{data: selection}
+	r.expect("PCR banks", r.u32(), 1)
+	r.expect("PCR bank", uint32(r.u16()), tpmAlgSHA256)
+	r.expect("PCR select size", uint32(r.u8()), tpmPCRSelectSize)
+	bitmap := r.next(tpmPCRSelectSize)
+	var pcrs []int
+	for pcr := 0; pcr < tpmPCRCount; pcr++ {
+		if bitmap[pcr/8]&(1<<uint(pcr%8)) != 0 {
+			pcrs = append(pcrs, pcr)
+		}
+	}
+	return pcrs, r.err
+}
+
+func (f *fakeTPM) pcrValues(pcrs []int) [][]byte {
+	values := make([][]byte, len(pcrs))
+	for i, pcr := range pcrs {
+		values[i] = append([]byte(nil), f.pcrs[pcr][:]...)
+	}
+	return values
+}
+
+//Policy digest after TPM2_PolicyPCR of the PCR values, in PCR order
+func policyPCRDigest(digest []byte, selection []byte, values [][]byte) []byte {
+	pcrDigest := sha256.New()
+	for _, value := range values {
+		pcrDigest.Write(value)
+	}
+	policy := sha256.New()
+	policy.Write(digest)
+	binary.Write(policy, binary.BigEndian, uint32(tpmCCPolicyPCR))
+	policy.Write(selection)
+	policy.Write(pcrDigest.Sum(nil))
+	return policy.Sum(nil)
+}
+
+//Seal secret under the primary key to the policy, as tpm2_create -L does,
+//and return the sealed object as read by the TPM provider
+func sealTPMSecret(t *testing.T, device string, policy []byte, secret []byte) []byte {
+	tpm, err := openTPM(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+	primary, err := tpm.createPrimary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.flush(primary)
+
+	sensitive := &bytes.Buffer{}
+	writeTPM2B(sensitive, nil)
+	writeTPM2B(sensitive, secret)
+	template := &bytes.Buffer{}
+	binary.Write(template, binary.BigEndian, []uint16{tpmAlgKeyedHash, tpmAlgSHA256})
+	binary.Write(template, binary.BigEndian, uint32(tpmSealedAttributes))
+	writeTPM2B(template, policy)
+	binary.Write(template, binary.BigEndian, uint16(tpmAlgNull))
+	writeTPM2B(template, nil)
+
+	params := &bytes.Buffer{}
+	writeTPM2B(params, sensitive.Bytes())
+	writeTPM2B(params, template.Bytes())
+	writeTPM2B(params, nil)
+	binary.Write(params, binary.BigEndian, uint32(0))
+	out, err := tpm.run(tpmCCCreate, []uint32{primary}, tpmPasswordSession, params.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, out, err := readTPM2B(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _, err := readTPM2B(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := &bytes.Buffer{}
+	writeTPM2B(sealed, public)
+	writeTPM2B(sealed, private)
+	return sealed.Bytes()
+}
+
+//Seal configMapKey to the initial value of the test PCR, unseal it with
+//the provider, then extend the PCR and check the unseal fails
+func testTPMSealUnseal(t *testing.T, device string) {
+	pcrs := &PCRSelection{Hash: tpmAlgSHA256, PCRs: []int{tpmTestPCR}}
+	selection := &bytes.Buffer{}
+	pcrs.marshal(selection)
+	policy := policyPCRDigest(make([]byte, sha256.Size), selection.Bytes(), [][]byte{make([]byte, sha256.Size)})
+
+	secret := []byte("Y29uZmlnTWFwS2V5Cg==")
+	sealedDir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(sealedDir, "configMapKey"), sealTPMSecret(t, device, policy, secret), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	provider := NewTPMProvider(device, sealedDir, pcrs, TPMParentHandle)
+	err = provider.FetchSecrets(dir, "configMapKey", "imageKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "configMapKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, secret) {
+		t.Errorf("unsealed %q, want %q", data, secret)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "imageKey")); !os.IsNotExist(err) {
+		t.Error("imageKey unsealed without a sealed object")
+	}
+
+	//Another boot state
+	tpm, err := openTPM(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tpm.pcrEvent(tpmTestPCR, []byte("another kernel"))
+	tpm.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = t.TempDir()
+	err = provider.FetchSecrets(dir, "configMapKey")
+	var tpmErr *TPMError
+	if !errors.As(err, &tpmErr) || tpmErr.Command != tpmCCUnseal {
+		t.Errorf("unseal with another PCR value: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "configMapKey")); !os.IsNotExist(err) {
+		t.Error("configMapKey written although the unseal failed")
+	}
+}
+
+func TestTPMSealUnseal(t *testing.T) {
+	fake, device := startFakeTPM(t)
+	testTPMSealUnseal(t, device)
+
+	//The transient objects and sessions are flushed
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if fake.primary != 0 || len(fake.objects) != 0 || len(fake.sessions) != 0 {
+		t.Errorf("TPM handles left: primary %#x, %d objects, %d sessions", fake.primary, len(fake.objects), len(fake.sessions))
+	}
+}
+
+//The same test with swtpm, when installed
+func TestTPMSealUnsealSwtpm(t *testing.T) {
+	swtpm, err := exec.LookPath("swtpm")
+	if err != nil {
+		t.Skip("swtpm is not installed")
+	}
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "data.sock")
+	cmd := exec.Command(swtpm, "socket", "--tpm2", "--tpmstate", "dir="+dir,
+		"--server", "type=unixio,path="+socket, "--ctrl", "type=unixio,path="+filepath.Join(dir, "ctrl.sock"),
+		"--flags", "not-need-init,startup-clear")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal("swtpm didn't create its socket")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	testTPMSealUnseal(t, "unix:"+socket)
+}
+
+func TestTPMCommandEncoding(t *testing.T) {
+	fake, device := startFakeTPM(t)
+	tpm, err := openTPM(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	primary, err := tpm.createPrimary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcrs, err := ParsePCRSelection(TPMDefaultPCRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := tpm.pcrPolicySession(pcrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpm.flush(session.handle)
+	tpm.flush(primary)
+
+	//Encodings of Part 3, the nonce of TPM2_StartAuthSession is random
+	want := []string{
+		"80020000004300000131400000010000000940000009000000000000040000000000" +
+			"1a0023000b00030072000000060080004300100003001000000000000000000000",
+		"",
+		"80010000001a0000017f" + "03000002" + "0000" + "00000001000b03950000",
+		"80010000000e00000165" + "03000002",
+		"80010000000e00000165" + "80000001",
+	}
+	if len(fake.commands) != len(want) {
+		t.Fatalf("%d commands, want %d", len(fake.commands), len(want))
+	}
+	for i, command := range fake.commands {
+		if want[i] != "" && hex.EncodeToString(command) != want[i] {
+			t.Errorf("command %d = %x, want %s", i, command, want[i])
+		}
+	}
+}
+
+func TestTPMVersion(t *testing.T) {
+	_, device := startFakeTPM(t)
+	tpm, err := openTPM(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+	manufacturer, firmware, err := tpm.version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manufacturer != "IBM" || firmware != "2.1.3.4" {
+		t.Errorf("TPM %s firmware %s", manufacturer, firmware)
+	}
+}
+
+func TestParsePCRSelection(t *testing.T) {
+	tests := []struct {
+		selection string
+		valid     bool
+		marshaled string
+	}{
+		{"sha256:0,2,4,7", true, "00000001000b03950000"},
+		{"SHA1:23", true, "00000001000403000080"},
+		{"sha384:8, 16", true, "00000001000c03000101"},
+		{"sha256", false, ""},
+		{"sm3:0", false, ""},
+		{"sha256:24", false, ""},
+		{"sha256:-1", false, ""},
+	}
+	for _, test := range tests {
+		pcrs, err := ParsePCRSelection(test.selection)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error %v", test.selection, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		pcrs.marshal(buf)
+		if hex.EncodeToString(buf.Bytes()) != test.marshaled {
+			t.Errorf("%s marshaled as %x", test.selection, buf.Bytes())
+		}
+	}
+}
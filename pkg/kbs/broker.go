@@ -0,0 +1,359 @@
+package kbs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//Time to attest after the auth request, and lifetime of the
+	//attestation
+	sessionTimeout = 5 * time.Minute
+)
+
+//Verifier checks evidence and returns the report data and the claims of
+//the verified report
+type Verifier func(evidence *crypto.Evidence) ([]byte, map[string]string, error)
+
+//Broker is a minimal reference key broker. It releases the files of a
+//resource directory, encrypted to the TEE key, after verifying the
+//evidence of the TEE and the claims required by the policy. TEEs without
+//a policy get nothing.
+type Broker struct {
+	resourceDir string
+	tokenKey    ed25519.PrivateKey
+
+	lock      sync.Mutex
+	verifiers map[crypto.TEEKind]Verifier
+	//Claims and the values required for each TEE
+	policy   map[crypto.TEEKind]map[string]string
+	sessions map[string]*session
+}
+
+//Attestation state of a client
+type session struct {
+	tee       crypto.TEEKind
+	nonce     string
+	expires   time.Time
+	teePubKey *crypto.JWK
+	attested  bool
+}
+
+//New broker releasing the files in resourceDir, <repository>/<type>/<tag>
+func NewBroker(resourceDir string) (*Broker, error) {
+	_, tokenKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Broker{
+		resourceDir: resourceDir,
+		verifiers:   make(map[crypto.TEEKind]Verifier),
+		policy:      make(map[crypto.TEEKind]map[string]string),
+		tokenKey:    tokenKey,
+		sessions:    make(map[string]*session),
+	}, nil
+}
+
+//Accept evidence of the TEE kind verified by verifier
+func (b *Broker) SetVerifier(kind crypto.TEEKind, verifier Verifier) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.verifiers[kind] = verifier
+}
+
+//Require the claims of the verified evidence of the TEE kind to have
+//these values. Without claims, nothing is released to the TEE kind.
+func (b *Broker) SetPolicy(kind crypto.TEEKind, claims map[string]string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.policy[kind] = claims
+}
+
+//Verifier of simulated evidence signed by the dev key
+func SimulatedVerifier(key ed25519.PublicKey) Verifier {
+	return func(evidence *crypto.Evidence) ([]byte, map[string]string, error) {
+		claims, err := crypto.VerifySimulatedEvidence(evidence, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return evidence.ReportData, claims, nil
+	}
+}
+
+//Verifier of SEV-SNP reports signed by the VCEK of the platform
+func SNPVerifier(vcek *ecdsa.PublicKey) Verifier {
+	return func(evidence *crypto.Evidence) ([]byte, map[string]string, error) {
+		report, err := crypto.ParseSNPReport(evidence.Report)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = report.Verify(vcek)
+		if err != nil {
+			return nil, nil, err
+		}
+		return report.ReportData[:], report.Claims(), nil
+	}
+}
+
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == AuthPath && r.Method == http.MethodPost:
+		b.auth(w, r)
+	case r.URL.Path == AttestPath && r.Method == http.MethodPost:
+		b.attest(w, r)
+	case strings.HasPrefix(r.URL.Path, ResourcePath) && r.Method == http.MethodGet:
+		b.resource(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "NotFound", "unknown endpoint")
+	}
+}
+
+//Start a session and challenge the client
+func (b *Broker) auth(w http.ResponseWriter, r *http.Request) {
+	request := &Request{}
+	err := readJSON(r, request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	if request.Version != ProtocolVersion {
+		writeError(w, http.StatusBadRequest, "ProtocolVersion", "unsupported protocol version "+request.Version)
+		return
+	}
+	kind := teeKind(request.TEE)
+	b.lock.Lock()
+	_, ok := b.verifiers[kind]
+	b.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "UnsupportedTEE", "no verifier for TEE "+request.TEE)
+		return
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal", err.Error())
+		return
+	}
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal", err.Error())
+		return
+	}
+
+	b.lock.Lock()
+	now := time.Now()
+	for id, s := range b.sessions {
+		if now.After(s.expires) {
+			delete(b.sessions, id)
+		}
+	}
+	b.sessions[id] = &session{tee: kind, nonce: base64.StdEncoding.EncodeToString(nonce), expires: now.Add(sessionTimeout)}
+	b.lock.Unlock()
+
+	log.Infof("Challenging %s client %s", kind, r.RemoteAddr)
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: id, Path: "/kbs", HttpOnly: true})
+	writeJSON(w, &Challenge{Nonce: base64.StdEncoding.EncodeToString(nonce), ExtraParams: json.RawMessage("{}")})
+}
+
+//Verify the evidence of the session
+func (b *Broker) attest(w http.ResponseWriter, r *http.Request) {
+	id, s := b.session(r)
+	if s == nil {
+		writeError(w, http.StatusUnauthorized, "InvalidSession", "no session, send an auth request first")
+		return
+	}
+	attestation := &Attestation{}
+	err := readJSON(r, attestation)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	if attestation.TEEPubKey == nil || len(attestation.TEEEvidence) == 0 {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "missing TEE public key or evidence")
+		return
+	}
+	//The resources are encrypted with key agreement only
+	if attestation.TEEPubKey.KeyType != "EC" && attestation.TEEPubKey.KeyType != "OKP" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "unsupported TEE key type "+attestation.TEEPubKey.KeyType)
+		return
+	}
+
+	err = b.verify(id, s, attestation)
+	if err != nil {
+		log.Errorf("Attestation of %s client %s failed: %s", s.tee, r.RemoteAddr, err)
+		writeError(w, http.StatusUnauthorized, "AttestationFailed", err.Error())
+		return
+	}
+
+	token, err := b.token(s)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal", err.Error())
+		return
+	}
+	log.Infof("Attested %s client %s", s.tee, r.RemoteAddr)
+	writeJSON(w, &AttestationResult{Token: token})
+}
+
+//Verify the evidence, its binding to the nonce and TEE key, and the
+//policy, then mark the session id attested. s is updated as well.
+func (b *Broker) verify(id string, s *session, attestation *Attestation) error {
+	//Earlier clients send the evidence as a JSON string
+	teeEvidence := attestation.TEEEvidence
+	var quoted string
+	if json.Unmarshal(teeEvidence, &quoted) == nil {
+		teeEvidence = json.RawMessage(quoted)
+	}
+	evidence, err := parseEvidence(s.tee, teeEvidence)
+	if err != nil {
+		return fmt.Errorf("invalid %s evidence: %s", s.tee, err)
+	}
+	b.lock.Lock()
+	verifier := b.verifiers[s.tee]
+	policy := b.policy[s.tee]
+	b.lock.Unlock()
+	if len(policy) == 0 {
+		return fmt.Errorf("no policy for %s, nothing is released", s.tee)
+	}
+	reportData, claims, err := verifier(evidence)
+	if err != nil {
+		return err
+	}
+
+	expected, err := ReportData(s.nonce, attestation.TEEPubKey)
+	if err != nil {
+		return err
+	}
+	if len(reportData) < len(expected) || !bytes.Equal(reportData[:len(expected)], expected) {
+		return errors.New("evidence is not bound to the challenge and TEE key")
+	}
+
+	for claim, value := range policy {
+		if claims[claim] != value {
+			return fmt.Errorf("claim %s is %q, the policy requires %q", claim, claims[claim], value)
+		}
+	}
+
+	s.teePubKey = attestation.TEEPubKey
+	s.attested = true
+	s.expires = time.Now().Add(sessionTimeout)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.sessions[id]; !ok {
+		return errors.New("the session expired")
+	}
+	attested := *s
+	b.sessions[id] = &attested
+	return nil
+}
+
+//Release a resource, encrypted to the TEE key of the session
+func (b *Broker) resource(w http.ResponseWriter, r *http.Request) {
+	_, s := b.session(r)
+	if s == nil || !s.attested {
+		writeError(w, http.StatusUnauthorized, "Unauthorized", "the TEE is not attested")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, ResourcePath)
+	if err := ValidResourcePath(path); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(b.resourceDir, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "NotFound", "no resource "+path)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal", err.Error())
+		return
+	}
+
+	response, err := crypto.SealEnvelope(data, crypto.EnvelopeHeader{}, s.teePubKey)
+	crypto.Wipe(data)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal", err.Error())
+		return
+	}
+	log.Infof("Released %s to %s client %s", path, s.tee, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+//ID and copy of the unexpired session of the request
+func (b *Broker) session(r *http.Request) (string, *session) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.sessions[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		return "", nil
+	}
+	copied := *s
+	return cookie.Value, &copied
+}
+
+//Attestation token, a JWT signed by the broker
+func (b *Broker) token(s *session) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"tee":        s.tee,
+		"tee-pubkey": s.teePubKey,
+		"exp":        s.expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(b.tokenKey, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func readJSON(r *http.Request, value interface{}) error {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, value)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, errorType string, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorInfo{Type: errorType, Detail: detail})
+}
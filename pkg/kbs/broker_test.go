@@ -0,0 +1,307 @@
+package kbs
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Reference broker with a verifier of the simulated TEE, serving
+//default/raksh/configMapKey and default/user/db-password
+func startBroker(t *testing.T) (*Broker, *httptest.Server, crypto.TEEProvider) {
+	dir := t.TempDir()
+	tee := crypto.NewSimulatedProvider(t.TempDir())
+	evidence, err := tee.GetEvidence(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParsePKIXPublicKey(evidence.Endorsements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, data := range map[string]string{
+		"default/raksh/configMapKey": "Y29uZmlnTWFwS2V5",
+		"default/user/db-password":   "secret",
+	} {
+		file := filepath.Join(dir, filepath.FromSlash(path))
+		err = os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(file, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker, err := NewBroker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.SetVerifier(crypto.TEESimulated, SimulatedVerifier(key.(ed25519.PublicKey)))
+	broker.SetPolicy(crypto.TEESimulated, map[string]string{"simulated": "true"})
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+	return broker, server, tee
+}
+
+func TestBrokerRelease(t *testing.T) {
+	_, server, tee := startBroker(t)
+	client, err := NewClient(server.URL, tee, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "secrets")
+	err = client.FetchResources(dir, "default/raksh", "configMapKey", "imageKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "configMapKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Y29uZmlnTWFwS2V5" {
+		t.Errorf("configMapKey = %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "imageKey")); !os.IsNotExist(err) {
+		t.Error("imageKey fetched although the broker doesn't hold it")
+	}
+
+	password, err := client.GetResource("default/user/db-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer password.Destroy()
+	if string(password.Bytes()) != "secret" {
+		t.Errorf("db-password = %q", password.Bytes())
+	}
+
+	_, err = client.GetResource("default/../raksh")
+	if err == nil {
+		t.Error("invalid resource path accepted")
+	}
+
+	//The resource is a JWE with the key wrapped to the TEE key
+	response, err := client.http.Get(server.URL + ResourcePath + "default/user/db-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var jwe map[string]string
+	err = json.NewDecoder(response.Body).Decode(&jwe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"protected", "encrypted_key", "iv", "ciphertext", "tag"} {
+		if jwe[field] == "" {
+			t.Errorf("no %s in the resource", field)
+		}
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jwe["protected"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &crypto.EnvelopeHeader{}
+	err = json.Unmarshal(protected, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Algorithm != crypto.AlgECDHESA256KW || header.Encryption != crypto.EncA256GCM || header.EphemeralKey == nil {
+		t.Errorf("resource encrypted with %s %s", header.Algorithm, header.Encryption)
+	}
+}
+
+func TestBrokerUnattested(t *testing.T) {
+	_, server, _ := startBroker(t)
+
+	response, err := http.Get(server.URL + ResourcePath + "default/raksh/configMapKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("resource without session: %s", response.Status)
+	}
+
+	//A session whose evidence failed to verify releases nothing
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	post := func(path string, request interface{}) *http.Response {
+		data, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := client.Post(server.URL+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+	response = post(AuthPath, &Request{Version: ProtocolVersion, TEE: "sample"})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("auth: %s", response.Status)
+	}
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teePubKey, err := crypto.NewJWK(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence := json.RawMessage(`{"svn":"1","report_data":"","report":"a.b.c"}`)
+	response = post(AttestPath, &Attestation{TEEPubKey: teePubKey, TEEEvidence: evidence})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("attest with forged evidence: %s", response.Status)
+	}
+	response, err = client.Get(server.URL + ResourcePath + "default/raksh/configMapKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("resource after failed attestation: %s", response.Status)
+	}
+}
+
+func TestBrokerPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy map[string]string
+		err    string
+	}{
+		{"no policy", nil, "no policy for simulated"},
+		{"mismatch", map[string]string{"debug": "false"}, "claim debug is"},
+		{"unknown claim", map[string]string{"measurement": "abc"}, "claim measurement is"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker, server, tee := startBroker(t)
+			broker.SetPolicy(crypto.TEESimulated, test.policy)
+			client, err := NewClient(server.URL, tee, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.GetResource("default/raksh/configMapKey")
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestBrokerUnknownKey(t *testing.T) {
+	_, server, _ := startBroker(t)
+	tee := crypto.NewSimulatedProvider(t.TempDir())
+	client, err := NewClient(server.URL, tee, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Evidence of another dev key
+	_, err = client.GetResource("default/raksh/configMapKey")
+	if err == nil {
+		t.Error("evidence of an unknown key accepted")
+	}
+}
+
+//Run with -race for the session state shared by the handlers: clients
+//attesting in parallel, and a session attesting again while it gets
+//resources
+func TestBrokerConcurrentClients(t *testing.T) {
+	_, server, tee := startBroker(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := NewClient(server.URL, tee, "")
+			if err != nil {
+				errs <- err
+				return
+			}
+			resource, err := client.GetResource("default/raksh/configMapKey")
+			if err != nil {
+				errs <- err
+				return
+			}
+			resource.Destroy()
+		}()
+	}
+
+	client, err := NewClient(server.URL, tee, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := &Challenge{}
+	err = client.post(AuthPath, &Request{Version: ProtocolVersion, TEE: "sample"}, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teePubKey, err := crypto.NewJWK(client.key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportData, err := ReportData(challenge.Nonce, teePubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence, err := tee.GetEvidence(reportData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teeEvidence, err := marshalEvidence(evidence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestation := &Attestation{TEEPubKey: teePubKey, TEEEvidence: teeEvidence}
+	err = client.post(AttestPath, attestation, &AttestationResult{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.attested = true
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- client.post(AttestPath, attestation, &AttestationResult{})
+		}()
+		go func() {
+			defer wg.Done()
+			resource, err := client.GetResource("default/raksh/configMapKey")
+			if err == nil {
+				resource.Destroy()
+			}
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package kbs
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	clientTimeout = 30 * time.Second
+)
+
+//Client retrieves resources from a KBS after attesting the TEE. The
+//resources are encrypted to a key which only lives in the client.
+type Client struct {
+	url      string
+	tee      crypto.TEEProvider
+	http     *http.Client
+	key      *ecdh.PrivateKey
+	attested bool
+}
+
+//New client of the broker at url attesting with the evidence of tee.
+//caFile, if set, holds the PEM CA certificates of the broker.
+func NewClient(url string, tee crypto.TEEProvider, caFile string) (*Client, error) {
+	if tee == nil || !tee.Capabilities().Attestation {
+		return nil, fmt.Errorf("the key broker needs a TEE with attestation")
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		url:  strings.TrimSuffix(url, "/"),
+		tee:  tee,
+		http: &http.Client{Jar: jar, Transport: transport, Timeout: clientTimeout},
+		key:  key,
+	}, nil
+}
+
+//Attest the TEE to the broker, once per client
+func (c *Client) Attest() error {
+	if c.attested {
+		return nil
+	}
+	log.Infof("Attesting %s to the key broker %s", c.tee.Kind(), c.url)
+
+	challenge := &Challenge{}
+	request := &Request{Version: ProtocolVersion, TEE: teeName(c.tee.Kind()), ExtraParams: json.RawMessage("{}")}
+	err := c.post(AuthPath, request, challenge)
+	if err != nil {
+		return fmt.Errorf("key broker auth: %s", err)
+	}
+
+	teePubKey, err := crypto.NewJWK(c.key.PublicKey())
+	if err != nil {
+		return err
+	}
+	teePubKey.Algorithm = crypto.AlgECDHESA256KW
+	reportData, err := ReportData(challenge.Nonce, teePubKey)
+	if err != nil {
+		return err
+	}
+	evidence, err := c.tee.GetEvidence(reportData)
+	if err != nil {
+		return fmt.Errorf("unable to get the %s evidence: %s", c.tee.Kind(), err)
+	}
+	teeEvidence, err := marshalEvidence(evidence)
+	if err != nil {
+		return err
+	}
+
+	result := &AttestationResult{}
+	err = c.post(AttestPath, &Attestation{TEEPubKey: teePubKey, TEEEvidence: teeEvidence}, result)
+	if err != nil {
+		return fmt.Errorf("key broker attestation: %s", err)
+	}
+	c.attested = true
+	log.Info("Attested to the key broker")
+	return nil
+}
+
+//Retrieve and decrypt the resource at path, <repository>/<type>/<tag>
+func (c *Client) GetResource(path string) (*crypto.SecureBuffer, error) {
+	err := ValidResourcePath(path)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Attest()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.http.Get(c.url + ResourcePath + path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := readBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("key broker resource %s: %w", path, err)
+	}
+
+	envelope, err := crypto.ParseEnvelope(body)
+	if err != nil {
+		return nil, fmt.Errorf("key broker resource %s: %s", path, err)
+	}
+	return envelope.Decrypt(&crypto.EnvelopeKeys{Private: c.key})
+}
+
+//Retrieve the resources <prefix>/<name> into files in dir. Resources the
+//broker doesn't hold are skipped.
+func (c *Client) FetchResources(dir string, prefix string, names ...string) error {
+	err := os.MkdirAll(dir, os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		keyFile := filepath.Join(dir, name)
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("Secrets File exists for: ", keyFile)
+			continue
+		}
+
+		resource, err := c.GetResource(prefix + "/" + name)
+		if errors.Is(err, errNotFound) {
+			log.Infof("No %s at the key broker", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(keyFile, resource.Bytes(), 0600)
+		resource.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//POST request as JSON and decode the JSON response into response
+func (c *Client) post(path string, request interface{}, response interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := c.http.Post(c.url+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	body, err := readBody(httpResponse)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, response)
+}
+
+var errNotFound = errors.New("resource not found")
+
+//Read the body of a successful response, or turn the error response
+//into an error
+func readBody(response *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		info := &ErrorInfo{}
+		if json.Unmarshal(body, info) == nil && info.Detail != "" {
+			return nil, fmt.Errorf("%s: %s", response.Status, info.Detail)
+		}
+		return nil, fmt.Errorf("%s", response.Status)
+	}
+	return body, nil
+}
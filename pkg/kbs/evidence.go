@@ -0,0 +1,316 @@
+package kbs
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//tee-evidence is in the format the Trustee attestation service verifies
+//for each TEE
+//https://github.com/confidential-containers/trustee/tree/main/deps/verifier
+
+//TEEs named differently in the KBS protocol
+var protocolTEENames = map[crypto.TEEKind]string{
+	crypto.TEESimulated: "sample",
+}
+
+//Name of the TEE kind in the KBS protocol
+func teeName(kind crypto.TEEKind) string {
+	if name, ok := protocolTEENames[kind]; ok {
+		return name
+	}
+	return string(kind)
+}
+
+//TEE kind of the name in the KBS protocol
+func teeKind(name string) crypto.TEEKind {
+	for kind, protocolName := range protocolTEENames {
+		if protocolName == name {
+			return kind
+		}
+	}
+	return crypto.TEEKind(name)
+}
+
+//Evidence of the sample TEE, which Trustee accepts without verification.
+//report carries the signed simulated evidence, which Trustee ignores.
+type sampleEvidence struct {
+	SVN        string `json:"svn"`
+	ReportData string `json:"report_data"`
+	Report     string `json:"report,omitempty"`
+}
+
+//Evidence of a TDX TD, the quote and the CC event log in base64
+type tdxEvidence struct {
+	CCEventLog *string `json:"cc_eventlog"`
+	Quote      string  `json:"quote"`
+}
+
+//Evidence of an SEV-SNP guest. Without certificates, the verifier gets
+//the VCEK of the report from AMD.
+type snpEvidence struct {
+	AttestationReport map[string]json.RawMessage `json:"attestation_report"`
+	CertChain         []json.RawMessage          `json:"cert_chain"`
+}
+
+//tee-evidence of the Raksh evidence
+func marshalEvidence(evidence *crypto.Evidence) (json.RawMessage, error) {
+	switch evidence.Kind {
+	case crypto.TEESimulated:
+		return json.Marshal(&sampleEvidence{
+			SVN:        "1",
+			ReportData: base64.StdEncoding.EncodeToString(evidence.ReportData),
+			Report:     string(evidence.Report),
+		})
+	case crypto.TEETDX:
+		//TDREPORTs are only verifiable in the TD itself
+		if _, err := crypto.ParseTDXQuote(evidence.Report); err != nil {
+			return nil, fmt.Errorf("the key broker needs a TDX quote, enable configfs-tsm: %s", err)
+		}
+		return json.Marshal(&tdxEvidence{Quote: base64.StdEncoding.EncodeToString(evidence.Report)})
+	case crypto.TEESNP:
+		report, err := marshalSNPReport(evidence.Report)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(&snpEvidence{AttestationReport: report})
+	}
+	return nil, fmt.Errorf("no key broker evidence format for %s", evidence.Kind)
+}
+
+//Raksh evidence of the tee-evidence of a kind TEE
+func parseEvidence(kind crypto.TEEKind, data json.RawMessage) (*crypto.Evidence, error) {
+	switch kind {
+	case crypto.TEESimulated:
+		sample := &sampleEvidence{}
+		err := json.Unmarshal(data, sample)
+		if err != nil {
+			return nil, err
+		}
+		reportData, err := base64.StdEncoding.DecodeString(sample.ReportData)
+		if err != nil {
+			return nil, fmt.Errorf("sample report_data: %s", err)
+		}
+		return &crypto.Evidence{Kind: kind, ReportData: reportData, Report: []byte(sample.Report)}, nil
+	case crypto.TEETDX:
+		tdx := &tdxEvidence{}
+		err := json.Unmarshal(data, tdx)
+		if err != nil {
+			return nil, err
+		}
+		quote, err := base64.StdEncoding.DecodeString(tdx.Quote)
+		if err != nil {
+			return nil, fmt.Errorf("TDX quote: %s", err)
+		}
+		return &crypto.Evidence{Kind: kind, Report: quote}, nil
+	case crypto.TEESNP:
+		snp := &snpEvidence{}
+		err := json.Unmarshal(data, snp)
+		if err != nil {
+			return nil, err
+		}
+		report, err := unmarshalSNPReport(snp.AttestationReport)
+		if err != nil {
+			return nil, err
+		}
+		return &crypto.Evidence{Kind: kind, Report: report}, nil
+	}
+	return nil, fmt.Errorf("no key broker evidence format for %s", kind)
+}
+
+//Encoding of a field of the SEV-SNP report
+type snpFieldKind int
+
+const (
+	//Little endian integer
+	snpNumber snpFieldKind = iota
+	//Array of byte values
+	snpBytes
+	//TCB version object
+	snpTCB
+	//Signature object
+	snpSignature
+)
+
+//Field of the SEV-SNP attestation report in the serde layout of the sev
+//crate, which the Trustee SNP verifier deserializes. Reserved fields are
+//part of it.
+type snpReportField struct {
+	name   string
+	offset int
+	size   int
+	kind   snpFieldKind
+}
+
+const snpReportSize = 0x4a0
+
+var snpReportFields = []snpReportField{
+	{"version", 0x00, 4, snpNumber},
+	{"guest_svn", 0x04, 4, snpNumber},
+	{"policy", 0x08, 8, snpNumber},
+	{"family_id", 0x10, 16, snpBytes},
+	{"image_id", 0x20, 16, snpBytes},
+	{"vmpl", 0x30, 4, snpNumber},
+	{"sig_algo", 0x34, 4, snpNumber},
+	{"current_tcb", 0x38, 8, snpTCB},
+	{"plat_info", 0x40, 8, snpNumber},
+	{"_author_key_en", 0x48, 4, snpNumber},
+	{"_reserved_0", 0x4c, 4, snpNumber},
+	{"report_data", 0x50, 64, snpBytes},
+	{"measurement", 0x90, 48, snpBytes},
+	{"host_data", 0xc0, 32, snpBytes},
+	{"id_key_digest", 0xe0, 48, snpBytes},
+	{"author_key_digest", 0x110, 48, snpBytes},
+	{"report_id", 0x140, 32, snpBytes},
+	{"report_id_ma", 0x160, 32, snpBytes},
+	{"reported_tcb", 0x180, 8, snpTCB},
+	{"_reserved_1", 0x188, 24, snpBytes},
+	{"chip_id", 0x1a0, 64, snpBytes},
+	{"committed_tcb", 0x1e0, 8, snpTCB},
+	{"current_build", 0x1e8, 1, snpNumber},
+	{"current_minor", 0x1e9, 1, snpNumber},
+	{"current_major", 0x1ea, 1, snpNumber},
+	{"_reserved_2", 0x1eb, 1, snpNumber},
+	{"committed_build", 0x1ec, 1, snpNumber},
+	{"committed_minor", 0x1ed, 1, snpNumber},
+	{"committed_major", 0x1ee, 1, snpNumber},
+	{"_reserved_3", 0x1ef, 1, snpNumber},
+	{"launch_tcb", 0x1f0, 8, snpTCB},
+	{"_reserved_4", 0x1f8, 168, snpBytes},
+	{"signature", 0x2a0, 512, snpSignature},
+}
+
+//Fields of the TCB version and of the signature
+var (
+	snpTCBFields = []snpReportField{
+		{"bootloader", 0, 1, snpNumber},
+		{"tee", 1, 1, snpNumber},
+		{"_reserved", 2, 4, snpBytes},
+		{"snp", 6, 1, snpNumber},
+		{"microcode", 7, 1, snpNumber},
+	}
+	snpSignatureFields = []snpReportField{
+		{"r", 0, 72, snpBytes},
+		{"s", 72, 72, snpBytes},
+		{"_reserved", 144, 368, snpBytes},
+	}
+)
+
+//attestation_report of the raw SEV-SNP report
+func marshalSNPReport(raw []byte) (map[string]json.RawMessage, error) {
+	if len(raw) < snpReportSize {
+		return nil, fmt.Errorf("SNP report too short: %d bytes", len(raw))
+	}
+	return marshalSNPFields(raw, snpReportFields)
+}
+
+func marshalSNPFields(raw []byte, fields []snpReportField) (map[string]json.RawMessage, error) {
+	object := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		data := raw[field.offset : field.offset+field.size]
+		var value interface{}
+		switch field.kind {
+		case snpNumber:
+			var number [8]byte
+			copy(number[:], data)
+			value = binary.LittleEndian.Uint64(number[:])
+		case snpBytes:
+			//An array of numbers, []byte would be base64
+			numbers := make([]int, len(data))
+			for i, b := range data {
+				numbers[i] = int(b)
+			}
+			value = numbers
+		case snpTCB:
+			tcb, err := marshalSNPFields(data, snpTCBFields)
+			if err != nil {
+				return nil, err
+			}
+			value = tcb
+		case snpSignature:
+			signature, err := marshalSNPFields(data, snpSignatureFields)
+			if err != nil {
+				return nil, err
+			}
+			value = signature
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		object[field.name] = encoded
+	}
+	return object, nil
+}
+
+//Raw SEV-SNP report of the attestation_report
+func unmarshalSNPReport(object map[string]json.RawMessage) ([]byte, error) {
+	raw := make([]byte, snpReportSize)
+	err := unmarshalSNPFields(object, snpReportFields, raw)
+	if err != nil {
+		return nil, fmt.Errorf("SNP attestation_report: %s", err)
+	}
+	return raw, nil
+}
+
+func unmarshalSNPFields(object map[string]json.RawMessage, fields []snpReportField, raw []byte) error {
+	if object == nil {
+		return errors.New("missing")
+	}
+	for _, field := range fields {
+		encoded, ok := object[field.name]
+		if !ok {
+			return fmt.Errorf("missing %s", field.name)
+		}
+		data := raw[field.offset : field.offset+field.size]
+		switch field.kind {
+		case snpNumber:
+			var number uint64
+			err := json.Unmarshal(encoded, &number)
+			if err != nil {
+				return fmt.Errorf("%s: %s", field.name, err)
+			}
+			if field.size < 8 && number>>(8*field.size) != 0 {
+				return fmt.Errorf("%s out of range", field.name)
+			}
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], number)
+			copy(data, buf[:field.size])
+		case snpBytes:
+			var numbers []uint16
+			err := json.Unmarshal(encoded, &numbers)
+			if err != nil {
+				return fmt.Errorf("%s: %s", field.name, err)
+			}
+			if len(numbers) != field.size {
+				return fmt.Errorf("%s has %d bytes, want %d", field.name, len(numbers), field.size)
+			}
+			for i, number := range numbers {
+				if number > 0xff {
+					return fmt.Errorf("%s out of range", field.name)
+				}
+				data[i] = byte(number)
+			}
+		case snpTCB, snpSignature:
+			var nested map[string]json.RawMessage
+			err := json.Unmarshal(encoded, &nested)
+			if err != nil {
+				return fmt.Errorf("%s: %s", field.name, err)
+			}
+			nestedFields := snpTCBFields
+			if field.kind == snpSignature {
+				nestedFields = snpSignatureFields
+			}
+			err = unmarshalSNPFields(nested, nestedFields, data)
+			if err != nil {
+				return fmt.Errorf("%s: %s", field.name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package kbs
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+func readCryptoFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("..", "crypto", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSNPEvidence(t *testing.T) {
+	raw := readCryptoFixture(t, "snp_report.bin")
+	teeEvidence, err := marshalEvidence(&crypto.Evidence{Kind: crypto.TEESNP, Report: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The sev crate layout: numbers, arrays of byte values and objects
+	if !strings.Contains(string(teeEvidence), `"report_data":[`) || !strings.Contains(string(teeEvidence), `"cert_chain":null`) {
+		t.Errorf("tee-evidence %s", teeEvidence)
+	}
+	report, err := crypto.ParseSNPReport(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields struct {
+		AttestationReport struct {
+			Version    uint32 `json:"version"`
+			CurrentTCB struct {
+				Microcode uint8 `json:"microcode"`
+			} `json:"current_tcb"`
+			Signature struct {
+				R []uint16 `json:"r"`
+			} `json:"signature"`
+		} `json:"attestation_report"`
+	}
+	err = json.Unmarshal(teeEvidence, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields.AttestationReport.Version != report.Version || fields.AttestationReport.CurrentTCB.Microcode != report.CurrentTCB.Microcode {
+		t.Errorf("version %d, microcode %d", fields.AttestationReport.Version, fields.AttestationReport.CurrentTCB.Microcode)
+	}
+	if len(fields.AttestationReport.Signature.R) != 72 {
+		t.Errorf("signature r of %d bytes", len(fields.AttestationReport.Signature.R))
+	}
+
+	evidence, err := parseEvidence(crypto.TEESNP, teeEvidence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(evidence.Report, raw[:snpReportSize]) {
+		t.Error("report changed by the round trip")
+	}
+
+	tests := []struct {
+		name     string
+		evidence string
+		err      string
+	}{
+		{"no report", `{"cert_chain":null}`, "attestation_report: missing"},
+		{"missing field", strings.Replace(string(teeEvidence), `"chip_id"`, `"chip"`, 1), "missing chip_id"},
+		{"byte out of range", strings.Replace(string(teeEvidence), `"family_id":[`, `"family_id":[256,`, 1), "family_id"},
+		{"number out of range", strings.Replace(string(teeEvidence), `"current_build":`, `"current_build":256`, 1), "current_build"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseEvidence(crypto.TEESNP, json.RawMessage(test.evidence))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestTDXEvidence(t *testing.T) {
+	quote := readCryptoFixture(t, "tdx_quote_v4.bin")
+	teeEvidence, err := marshalEvidence(&crypto.Evidence{Kind: crypto.TEETDX, Report: quote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(teeEvidence), `{"cc_eventlog":null,"quote":"`) {
+		t.Errorf("tee-evidence %s", teeEvidence)
+	}
+	evidence, err := parseEvidence(crypto.TEETDX, teeEvidence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(evidence.Report, quote) {
+		t.Error("quote changed by the round trip")
+	}
+
+	_, err = marshalEvidence(&crypto.Evidence{Kind: crypto.TEETDX, Report: readCryptoFixture(t, "tdreport.bin")})
+	if err == nil || !strings.Contains(err.Error(), "needs a TDX quote") {
+		t.Errorf("TDREPORT error = %v", err)
+	}
+}
+
+func TestSampleEvidence(t *testing.T) {
+	teeEvidence, err := marshalEvidence(&crypto.Evidence{Kind: crypto.TEESimulated, ReportData: []byte{1, 2, 3}, Report: []byte("a.b.c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(teeEvidence) != `{"svn":"1","report_data":"AQID","report":"a.b.c"}` {
+		t.Errorf("tee-evidence %s", teeEvidence)
+	}
+	if teeName(crypto.TEESimulated) != "sample" || teeKind("sample") != crypto.TEESimulated || teeKind("snp") != crypto.TEESNP {
+		t.Error("wrong sample TEE name")
+	}
+
+	_, err = marshalEvidence(&crypto.Evidence{Kind: crypto.TEESVM})
+	if err == nil {
+		t.Error("evidence of a TEE without a KBS format")
+	}
+}
+
+//The runtime data is hashed as Trustee serializes it, with sorted keys
+func TestReportData(t *testing.T) {
+	key := &crypto.JWK{KeyType: "EC", Curve: "P-256", X: "eA", Y: "eQ", Algorithm: crypto.AlgECDHESA256KW}
+	reportData, err := ReportData("bm9uY2U=", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha512.Sum384([]byte(`{"nonce":"bm9uY2U=","tee-pubkey":{"alg":"ECDH-ES+A256KW","crv":"P-256","kty":"EC","x":"eA","y":"eQ"}}`))
+	if !bytes.Equal(reportData, want[:]) {
+		t.Errorf("report data %x, want %x", reportData, want)
+	}
+}
@@ -0,0 +1,100 @@
+package kbs
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//KBS attestation protocol of Confidential Containers (Trustee): auth,
+//attest and resource requests, with the evidence in the format of the
+//Trustee verifier of each TEE and the resources as ECDH-ES+A256KW JWE.
+//https://github.com/confidential-containers/trustee/blob/main/kbs/docs/kbs_attestation_protocol.md
+
+const (
+	ProtocolVersion = "0.1.1"
+
+	AuthPath     = "/kbs/v0/auth"
+	AttestPath   = "/kbs/v0/attest"
+	ResourcePath = "/kbs/v0/resource/"
+
+	//Session established by the auth request
+	SessionCookie = "kbs-session-id"
+
+	//Largest request or response body
+	maxBodySize = 1 << 20
+)
+
+//Request starts the attestation of a TEE
+type Request struct {
+	Version string `json:"version"`
+	//TEE name in the protocol, e.g. snp, tdx or sample
+	TEE         string          `json:"tee"`
+	ExtraParams json.RawMessage `json:"extra-params"`
+}
+
+//Challenge is the nonce the evidence must be bound to
+type Challenge struct {
+	//Base64 of random bytes
+	Nonce       string          `json:"nonce"`
+	ExtraParams json.RawMessage `json:"extra-params"`
+}
+
+//Attestation carries the evidence and the public key of the TEE the
+//resources are encrypted to
+type Attestation struct {
+	TEEPubKey *crypto.JWK `json:"tee-pubkey"`
+	//Evidence in the format of the TEE
+	TEEEvidence json.RawMessage `json:"tee-evidence"`
+}
+
+//AttestationResult carries the attestation token
+type AttestationResult struct {
+	Token string `json:"token"`
+}
+
+//ErrorInfo is the body of error responses
+type ErrorInfo struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+//Report data binding the evidence to the challenge nonce and the TEE key,
+//the SHA-384 of the runtime data {"nonce", "tee-pubkey"} in JSON with
+//sorted keys, as Trustee serializes it
+func ReportData(nonce string, teePubKey *crypto.JWK) ([]byte, error) {
+	key, err := json.Marshal(teePubKey)
+	if err != nil {
+		return nil, err
+	}
+	var sortedKey map[string]interface{}
+	err = json.Unmarshal(key, &sortedKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(map[string]interface{}{"nonce": nonce, "tee-pubkey": sortedKey})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum384(data)
+	return digest[:], nil
+}
+
+var resourcePathPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+//Check a resource path is <repository>/<type>/<tag>
+func ValidResourcePath(path string) error {
+	if !resourcePathPattern.MatchString(path) {
+		return fmt.Errorf("invalid resource path %q", path)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("invalid resource path %q", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package ocicrypt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+//ocicrypt key provider protocol
+//https://github.com/containers/ocicrypt/blob/main/docs/keyprovider.md
+//The image puller passes the annotation of the key provider, here a JWE
+//of the private options, and gets back the private options. Requests are
+//JSON, on stdin for a command provider, or in the single bytes field of
+//the gRPC messages of keyprovider.KeyProviderService.
+
+const (
+	OpKeyWrap   = "keywrap"
+	OpKeyUnwrap = "keyunwrap"
+
+	//gRPC method of the unwrap operation
+	GRPCUnwrapKeyPath = "/keyprovider.KeyProviderService/UnWrapKey"
+	GRPCWrapKeyPath   = "/keyprovider.KeyProviderService/WrapKey"
+
+	//Larger requests are rejected
+	keyProviderMaxRequest = 1 << 20
+)
+
+//KeyProviderInput is the request of the image puller
+type KeyProviderInput struct {
+	Operation       string          `json:"op"`
+	KeyWrapParams   json.RawMessage `json:"keywrapparams,omitempty"`
+	KeyUnwrapParams struct {
+		//Decrypt config of the puller, unused
+		DecryptConfig json.RawMessage `json:"dc,omitempty"`
+		//Annotation returned by the key provider when wrapping
+		Annotation []byte `json:"annotation"`
+	} `json:"keyunwrapparams"`
+}
+
+//KeyProviderOutput is the response to the image puller
+type KeyProviderOutput struct {
+	KeyUnwrapResults struct {
+		OptsData []byte `json:"optsdata"`
+	} `json:"keyunwrapresults"`
+}
+
+//KeyProvider unwraps layer keys for image pullers
+type KeyProvider struct {
+	keys *crypto.EnvelopeKeys
+}
+
+//New key provider unwrapping with keys
+func NewKeyProvider(keys *crypto.EnvelopeKeys) *KeyProvider {
+	return &KeyProvider{keys: keys}
+}
+
+//Process a JSON request and return the JSON response. Only unwrapping is
+//supported, layers are encrypted outside of the guest.
+func (p *KeyProvider) Process(request []byte) ([]byte, error) {
+	var input KeyProviderInput
+	err := json.Unmarshal(request, &input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key provider request: %s", err)
+	}
+	if input.Operation != OpKeyUnwrap {
+		return nil, fmt.Errorf("unsupported key provider operation %q", input.Operation)
+	}
+	if len(input.KeyUnwrapParams.Annotation) == 0 {
+		return nil, errors.New("the key provider request has no annotation")
+	}
+
+	opts, err := UnwrapJWE(input.KeyUnwrapParams.Annotation, p.keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap the layer key: %s", err)
+	}
+	defer opts.Destroy()
+	var privOpts PrivateOptions
+	err = json.Unmarshal(opts.Bytes(), &privOpts)
+	crypto.Wipe(privOpts.SymmetricKey)
+	if err != nil {
+		return nil, fmt.Errorf("layer private options: %s", err)
+	}
+
+	var output KeyProviderOutput
+	output.KeyUnwrapResults.OptsData = opts.Bytes()
+	return json.Marshal(&output)
+}
+
+//Serve a command request from r to w
+func (p *KeyProvider) ServeCommand(w io.Writer, r io.Reader) error {
+	request, err := ioutil.ReadAll(io.LimitReader(r, keyProviderMaxRequest))
+	if err != nil {
+		return err
+	}
+	response, err := p.Process(request)
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(response)
+	_, err = w.Write(response)
+	return err
+}
+
+//gRPC status codes
+const (
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+)
+
+//Serve gRPC requests, over HTTP/2. The messages have the JSON in their
+//field 1.
+func (p *KeyProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.Header().Set("Content-Type", "application/grpc")
+
+	status, message := grpcInternal, ""
+	defer func() {
+		w.Header().Set("Grpc-Status", strconv.Itoa(status))
+		w.Header().Set("Grpc-Message", message)
+	}()
+
+	switch r.URL.Path {
+	case GRPCUnwrapKeyPath:
+	case GRPCWrapKeyPath:
+		status, message = grpcUnimplemented, "keywrap is not supported in the guest"
+		return
+	default:
+		status, message = grpcUnimplemented, "unknown method "+r.URL.Path
+		return
+	}
+
+	request, err := readGRPCMessage(r.Body)
+	if err != nil {
+		status, message = grpcInvalidArgument, err.Error()
+		return
+	}
+	response, err := p.Process(request)
+	if err != nil {
+		log.Errorf("Key provider: %s", err)
+		status, message = grpcInvalidArgument, err.Error()
+		return
+	}
+	defer crypto.Wipe(response)
+	err = writeGRPCMessage(w, response)
+	if err != nil {
+		message = err.Error()
+		return
+	}
+	status = 0
+}
+
+//Read a gRPC message and return its bytes field 1
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > keyProviderMaxRequest {
+		return nil, errors.New("the gRPC message is too large")
+	}
+	message := make([]byte, length)
+	_, err = io.ReadFull(r, message)
+	if err != nil {
+		return nil, err
+	}
+
+	//Skip other fields
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return nil, errors.New("invalid gRPC message")
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(message)
+			if n <= 0 {
+				return nil, errors.New("invalid gRPC message")
+			}
+			message = message[n:]
+		case 2:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || size > uint64(len(message)-n) {
+				return nil, errors.New("invalid gRPC message")
+			}
+			field := message[n : n+int(size)]
+			message = message[n+int(size):]
+			if key>>3 == 1 {
+				return field, nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported gRPC wire type %d", key&7)
+		}
+	}
+	return nil, errors.New("the gRPC message has no request")
+}
+
+//Write data as bytes field 1 of a gRPC message
+func writeGRPCMessage(w io.Writer, data []byte) error {
+	message := make([]byte, 5, 5+1+binary.MaxVarintLen64+len(data))
+	message = append(message, 1<<3|2)
+	message = binary.AppendUvarint(message, uint64(len(data)))
+	message = append(message, data...)
+	defer crypto.Wipe(message)
+
+	binary.BigEndian.PutUint32(message[1:5], uint32(len(message)-5))
+	_, err := w.Write(message)
+	return err
+}
@@ -0,0 +1,176 @@
+package ocicrypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//testdata/keyunwrap.json and testdata/keywrap.json are requests in the
+//format ocicrypt sends to a key provider. The annotation of keyunwrap is
+//an ECDH-ES JWE of keyProviderOpts for testdata/keyprovider_key.pem,
+//a key for testing only.
+const keyProviderOpts = `{"symkey":"X9LRDp3Wwm8qz4D+dUTnAanlR+EjUJ0J1NAFgLJiJMs=","digest":"sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865","cipheroptions":{"nonce":"oPXhp5w2XOcFCb1lQ0/0Lw=="}}`
+
+func readKeyProviderFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testKeyProvider(t *testing.T) *KeyProvider {
+	key, err := crypto.ParsePrivateKey(readKeyProviderFixture(t, "keyprovider_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKeyProvider(&crypto.EnvelopeKeys{Private: key})
+}
+
+func TestKeyProviderProcess(t *testing.T) {
+	other, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrap := readKeyProviderFixture(t, "keyunwrap.json")
+	tests := []struct {
+		name     string
+		request  []byte
+		provider *KeyProvider
+		//Error substring, the private options when empty
+		err string
+	}{
+		{"keyunwrap", unwrap, testKeyProvider(t), ""},
+		{"keywrap", readKeyProviderFixture(t, "keywrap.json"), testKeyProvider(t), `unsupported key provider operation "keywrap"`},
+		{"other key", unwrap, NewKeyProvider(&crypto.EnvelopeKeys{Private: other}), "unable to unwrap the layer key"},
+		{"no annotation", []byte(`{"op":"keyunwrap","keyunwrapparams":{"dc":{}}}`), testKeyProvider(t), "no annotation"},
+		{"not a JWE", []byte(`{"op":"keyunwrap","keyunwrapparams":{"annotation":"bGF5ZXIga2V5"}}`), testKeyProvider(t), "unable to unwrap the layer key"},
+		{"invalid JSON", unwrap[:len(unwrap)/2], testKeyProvider(t), "invalid key provider request"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := test.provider.Process(test.request)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var output KeyProviderOutput
+			err = json.Unmarshal(response, &output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output.KeyUnwrapResults.OptsData) != keyProviderOpts {
+				t.Errorf("optsdata = %s", output.KeyUnwrapResults.OptsData)
+			}
+		})
+	}
+}
+
+func TestKeyProviderCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	err := testKeyProvider(t).ServeCommand(&stdout, bytes.NewReader(readKeyProviderFixture(t, "keyunwrap.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout.String(), `{"keyunwrapresults":{"optsdata":"`) {
+		t.Errorf("response = %s", stdout.String())
+	}
+}
+
+//Key provider gRPC service over HTTP/2 without TLS, like ocicrypt's
+func startKeyProviderServer(t *testing.T) (*http.Client, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: testKeyProvider(t), Protocols: &protocols}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	return client, "http://" + listener.Addr().String()
+}
+
+func TestKeyProviderGRPC(t *testing.T) {
+	client, url := startKeyProviderServer(t)
+
+	var unwrap, keywrap bytes.Buffer
+	err := writeGRPCMessage(&unwrap, readKeyProviderFixture(t, "keyunwrap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeGRPCMessage(&keywrap, readKeyProviderFixture(t, "keywrap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		message []byte
+		status  string
+	}{
+		{"unwrap", GRPCUnwrapKeyPath, unwrap.Bytes(), "0"},
+		{"wrap", GRPCWrapKeyPath, keywrap.Bytes(), "12"},
+		{"unknown method", "/keyprovider.KeyProviderService/Other", unwrap.Bytes(), "12"},
+		{"keywrap to unwrap", GRPCUnwrapKeyPath, keywrap.Bytes(), "3"},
+		{"compressed", GRPCUnwrapKeyPath, append([]byte{1}, unwrap.Bytes()[1:]...), "3"},
+		{"truncated", GRPCUnwrapKeyPath, unwrap.Bytes()[:unwrap.Len()-1], "3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Post(url+test.path, "application/grpc", bytes.NewReader(test.message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != "application/grpc" {
+				t.Errorf("%s response with Content-Type %q", resp.Proto, resp.Header.Get("Content-Type"))
+			}
+			//The status is only known once the body is read
+			if status := resp.Trailer.Get("Grpc-Status"); status != test.status {
+				t.Fatalf("Grpc-Status = %q (%s), want %s", status, resp.Trailer.Get("Grpc-Message"), test.status)
+			}
+			if test.status != "0" {
+				if len(body) != 0 || resp.Trailer.Get("Grpc-Message") == "" {
+					t.Errorf("error response %q with message %q", body, resp.Trailer.Get("Grpc-Message"))
+				}
+				return
+			}
+
+			response, err := readGRPCMessage(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var output KeyProviderOutput
+			err = json.Unmarshal(response, &output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output.KeyUnwrapResults.OptsData) != keyProviderOpts {
+				t.Errorf("optsdata = %s", output.KeyUnwrapResults.OptsData)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package ocicrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+//Layers encrypted by ocicrypt, as used by containerd imgcrypt and skopeo
+//https://github.com/containers/ocicrypt
+//The layer is encrypted with a random key, which is wrapped for each
+//recipient in the annotations of the layer descriptor.
+
+const (
+	//Comma separated base64 JWEs of the private options
+	AnnotationKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	//Base64 JSON of the public options
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+
+	//AES-256 in CTR mode, HMAC-SHA256 over the ciphertext with the same key
+	CipherAES256CTR = "AES_256_CTR_HMAC_SHA256"
+
+	//Media type suffix of encrypted layers
+	MediaTypeSuffix = "+encrypted"
+)
+
+//PublicOptions are the cipher parameters of the layer, in the clear
+type PublicOptions struct {
+	Cipher        string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+//PrivateOptions are the key of the layer and the digest of the plaintext,
+//wrapped for the recipients
+type PrivateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+//Unwrap the private options of the JWE keys annotation with keys. Returns
+//their JSON, which holds the layer key.
+func UnwrapKey(annotation string, keys *crypto.EnvelopeKeys) (*crypto.SecureBuffer, error) {
+	err := errors.New("the layer has no JWE keys")
+	for _, wrapped := range strings.Split(annotation, ",") {
+		var jwe []byte
+		jwe, err = b64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			err = fmt.Errorf("layer key: %s", err)
+			continue
+		}
+		var opts *crypto.SecureBuffer
+		opts, err = UnwrapJWE(jwe, keys)
+		if err == nil {
+			return opts, nil
+		}
+		log.Debugf("Unable to unwrap a layer key: %s", err)
+	}
+	return nil, err
+}
+
+//Unwrap the private options of a single JWE, compact or JSON
+func UnwrapJWE(jwe []byte, keys *crypto.EnvelopeKeys) (*crypto.SecureBuffer, error) {
+	envelope, err := crypto.ParseEnvelope(jwe)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.Decrypt(keys)
+}
+
+//Decrypt the layer read from r into w with the private options unwrapped
+//from annotations. The ciphertext and the plaintext are authenticated
+//only when the whole layer is read: on error, w must be discarded.
+func DecryptLayer(w io.Writer, r io.Reader, annotations map[string]string, keys *crypto.EnvelopeKeys) error {
+	pubOptsJSON, err := b64.StdEncoding.DecodeString(annotations[AnnotationPubOpts])
+	if err != nil {
+		return fmt.Errorf("layer public options: %s", err)
+	}
+	var pubOpts PublicOptions
+	err = json.Unmarshal(pubOptsJSON, &pubOpts)
+	if err != nil {
+		return fmt.Errorf("layer public options: %s", err)
+	}
+
+	privOptsJSON, err := UnwrapKey(annotations[AnnotationKeysJWE], keys)
+	if err != nil {
+		return err
+	}
+	defer privOptsJSON.Destroy()
+	var privOpts PrivateOptions
+	err = json.Unmarshal(privOptsJSON.Bytes(), &privOpts)
+	if err != nil {
+		return fmt.Errorf("layer private options: %s", err)
+	}
+	defer crypto.Wipe(privOpts.SymmetricKey)
+
+	return decryptAESCTR(w, r, &pubOpts, &privOpts)
+}
+
+//Decrypt with AES-256-CTR, checking the HMAC of the ciphertext and the
+//digest of the plaintext
+func decryptAESCTR(w io.Writer, r io.Reader, pubOpts *PublicOptions, privOpts *PrivateOptions) error {
+	if pubOpts.Cipher != CipherAES256CTR {
+		return fmt.Errorf("unsupported layer cipher %q", pubOpts.Cipher)
+	}
+	if len(privOpts.SymmetricKey) != 32 {
+		return fmt.Errorf("invalid layer key length %d", len(privOpts.SymmetricKey))
+	}
+	nonce := privOpts.CipherOptions["nonce"]
+	if len(nonce) != aes.BlockSize {
+		return fmt.Errorf("invalid layer nonce length %d", len(nonce))
+	}
+	digestAlgorithm, expectedDigest, ok := strings.Cut(privOpts.Digest, ":")
+	if !ok || digestAlgorithm != "sha256" {
+		return fmt.Errorf("unsupported layer digest %q", privOpts.Digest)
+	}
+
+	block, err := aes.NewCipher(privOpts.SymmetricKey)
+	if err != nil {
+		return err
+	}
+	stream := cipher.NewCTR(block, nonce)
+	mac := hmac.New(sha256.New, privOpts.SymmetricKey)
+	digest := sha256.New()
+
+	err = decryptStream(w, r, stream, mac, digest)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil), pubOpts.HMAC) {
+		return errors.New("the layer HMAC doesn't match, the layer was modified")
+	}
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest.Sum(nil))), []byte(expectedDigest)) != 1 {
+		return errors.New("the digest of the decrypted layer doesn't match")
+	}
+	return nil
+}
+
+func decryptStream(w io.Writer, r io.Reader, stream cipher.Stream, mac hash.Hash, digest hash.Hash) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			mac.Write(buf[:n])
+			stream.XORKeyStream(buf[:n], buf[:n])
+			digest.Write(buf[:n])
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
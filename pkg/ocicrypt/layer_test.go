@@ -0,0 +1,140 @@
+package ocicrypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//testdata/layer.tar.enc is testdata/layer.tar encrypted in the ocicrypt
+//layer format, with the descriptor annotations in
+//testdata/layer_annotations.json. The layer key is wrapped in an ECDH-ES
+//JWE for testdata/keyprovider_key.pem.
+const layerDigest = "2fa529f6da728633c66a98cf8a71e9025d5d1200389180e2f5cb0528da63bf54"
+
+func readLayerAnnotations(t *testing.T) map[string]string {
+	annotations := map[string]string{}
+	err := json.Unmarshal(readKeyProviderFixture(t, "layer_annotations.json"), &annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return annotations
+}
+
+//Annotations with the public options changed by change
+func withPublicOptions(t *testing.T, annotations map[string]string, change func(*PublicOptions)) map[string]string {
+	data, err := b64.StdEncoding.DecodeString(annotations[AnnotationPubOpts])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pubOpts PublicOptions
+	err = json.Unmarshal(data, &pubOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(&pubOpts)
+	data, err = json.Marshal(&pubOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := map[string]string{}
+	for name, value := range annotations {
+		changed[name] = value
+	}
+	changed[AnnotationPubOpts] = b64.StdEncoding.EncodeToString(data)
+	return changed
+}
+
+//Reader failing after the first n bytes
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestDecryptLayer(t *testing.T) {
+	annotations := readLayerAnnotations(t)
+	encrypted := readKeyProviderFixture(t, "layer.tar.enc")
+
+	var layer bytes.Buffer
+	err := DecryptLayer(&layer, bytes.NewReader(encrypted), annotations, testKeyProvider(t).keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(layer.Bytes())
+	if hex.EncodeToString(digest[:]) != layerDigest {
+		t.Errorf("layer digest sha256:%x", digest)
+	}
+	if !bytes.Equal(layer.Bytes(), readKeyProviderFixture(t, "layer.tar")) {
+		t.Error("decrypted layer differs from testdata/layer.tar")
+	}
+}
+
+func TestDecryptLayerInvalid(t *testing.T) {
+	annotations := readLayerAnnotations(t)
+	encrypted := readKeyProviderFixture(t, "layer.tar.enc")
+	modified := append([]byte(nil), encrypted...)
+	modified[len(modified)/2] ^= 1
+	other, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		layer       io.Reader
+		annotations map[string]string
+		keys        *crypto.EnvelopeKeys
+		err         string
+	}{
+		{"modified layer", bytes.NewReader(modified), annotations, nil, "the layer HMAC doesn't match"},
+		{"truncated layer", bytes.NewReader(encrypted[:len(encrypted)-512]), annotations, nil, "the layer HMAC doesn't match"},
+		{"empty layer", bytes.NewReader(nil), annotations, nil, "the layer HMAC doesn't match"},
+		{"failed read", &failingReader{r: bytes.NewReader(encrypted), n: 1024}, annotations, nil, io.ErrUnexpectedEOF.Error()},
+		{"wrong HMAC", bytes.NewReader(encrypted), withPublicOptions(t, annotations, func(pubOpts *PublicOptions) {
+			pubOpts.HMAC[0] ^= 1
+		}), nil, "the layer HMAC doesn't match"},
+		{"no HMAC", bytes.NewReader(encrypted), withPublicOptions(t, annotations, func(pubOpts *PublicOptions) {
+			pubOpts.HMAC = nil
+		}), nil, "the layer HMAC doesn't match"},
+		{"other cipher", bytes.NewReader(encrypted), withPublicOptions(t, annotations, func(pubOpts *PublicOptions) {
+			pubOpts.Cipher = "AES_256_GCM"
+		}), nil, `unsupported layer cipher "AES_256_GCM"`},
+		{"no public options", bytes.NewReader(encrypted), map[string]string{AnnotationKeysJWE: annotations[AnnotationKeysJWE]}, nil, "layer public options"},
+		{"no keys", bytes.NewReader(encrypted), map[string]string{AnnotationPubOpts: annotations[AnnotationPubOpts]}, nil, "not an encrypted envelope"},
+		{"other key", bytes.NewReader(encrypted), annotations, &crypto.EnvelopeKeys{Private: other}, "message authentication failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := test.keys
+			if keys == nil {
+				keys = testKeyProvider(t).keys
+			}
+			err := DecryptLayer(ioutil.Discard, test.layer, test.annotations, keys)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package vsock
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+)
+
+//Client requests secrets from the host proxy
+type Client struct {
+	address string
+}
+
+//New client of the proxy at address, vsock:<cid>:<port> or unix:<path>
+func NewClient(address string) *Client {
+	return &Client{address: address}
+}
+
+//Request the named secrets into files in dir. Secrets the proxy doesn't
+//hold are skipped.
+func (c *Client) FetchSecrets(dir string, names ...string) error {
+
+	log.Infof("Requesting secrets from the host proxy %s", c.address)
+	err := os.MkdirAll(dir, os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			log.Info("Secrets File exists for: ", filepath.Join(dir, name))
+			continue
+		}
+		missing = append(missing, name)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	//Only this request can decrypt the response
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	publicKey, err := crypto.NewJWK(key.PublicKey())
+	if err != nil {
+		return err
+	}
+
+	conn, err := Dial(c.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	err = writeMessage(conn, &Request{Version: ProtocolVersion, PublicKey: publicKey, Names: missing})
+	if err != nil {
+		return err
+	}
+	response := &Response{}
+	err = readMessage(conn, response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return fmt.Errorf("host proxy: %s", response.Error)
+	}
+
+	keys := &crypto.EnvelopeKeys{Private: key}
+	for _, name := range missing {
+		wrapped, ok := response.Secrets[name]
+		if !ok {
+			log.Infof("No %s at the host proxy", name)
+			continue
+		}
+		envelope, err := crypto.ParseEnvelope(wrapped)
+		if err != nil {
+			return fmt.Errorf("host proxy secret %s: %s", name, err)
+		}
+		if envelope.Header.Algorithm != crypto.AlgECDHES {
+			return errors.New("host proxy secrets must be encrypted to the request key")
+		}
+		secret, err := envelope.Decrypt(keys)
+		if err != nil {
+			return fmt.Errorf("host proxy secret %s: %s", name, err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), secret.Bytes(), 0600)
+		secret.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
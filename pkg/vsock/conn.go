@@ -0,0 +1,174 @@
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	//vsock:<cid>:<port>, the CID may be host or any
+	schemeVsock = "vsock:"
+	//unix:<path>, stand-in for vsock in tests
+	schemeUnix = "unix:"
+
+	dialTimeout = 10 * time.Second
+)
+
+//Address of an AF_VSOCK socket
+type Addr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a *Addr) Network() string {
+	return "vsock"
+}
+
+func (a *Addr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+//Parse vsock:<cid>:<port>
+func parseVsockAddress(address string) (*Addr, error) {
+	parts := strings.Split(strings.TrimPrefix(address, schemeVsock), ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid vsock address %q", address)
+	}
+
+	var cid uint64
+	var err error
+	switch parts[0] {
+	case "host":
+		cid = unix.VMADDR_CID_HOST
+	case "any":
+		cid = unix.VMADDR_CID_ANY
+	default:
+		cid, err = strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vsock CID %q", parts[0])
+		}
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vsock port %q", parts[1])
+	}
+	return &Addr{CID: uint32(cid), Port: uint32(port)}, nil
+}
+
+//AF_VSOCK stream, the net package doesn't support the address family
+type conn struct {
+	*os.File
+	local  *Addr
+	remote *Addr
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+//Wrap a connected socket. Non-blocking, so that deadlines work.
+func newConn(fd int, remote *Addr) (net.Conn, error) {
+	local := &Addr{}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			local = &Addr{CID: vm.CID, Port: vm.Port}
+		}
+	}
+	err := unix.SetNonblock(fd, true)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &conn{File: os.NewFile(uintptr(fd), "vsock:"+remote.String()), local: local, remote: remote}, nil
+}
+
+//Connect to a vsock:<cid>:<port> or unix:<path> address
+func Dial(address string) (net.Conn, error) {
+	if strings.HasPrefix(address, schemeUnix) {
+		return net.DialTimeout("unix", strings.TrimPrefix(address, schemeUnix), dialTimeout)
+	}
+	if !strings.HasPrefix(address, schemeVsock) {
+		return nil, fmt.Errorf("unsupported address %q", address)
+	}
+
+	remote, err := parseVsockAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock socket: %s", err)
+	}
+	timeout := unix.NsecToTimeval(dialTimeout.Nanoseconds())
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &timeout)
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: remote.CID, Port: remote.Port})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("vsock connect to %s: %s", remote, err)
+	}
+	return newConn(fd, remote)
+}
+
+//Listener on an AF_VSOCK socket
+type listener struct {
+	fd   int
+	addr *Addr
+}
+
+//Listen on a vsock:<cid>:<port> or unix:<path> address
+func Listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, schemeUnix) {
+		return net.Listen("unix", strings.TrimPrefix(address, schemeUnix))
+	}
+	if !strings.HasPrefix(address, schemeVsock) {
+		return nil, fmt.Errorf("unsupported address %q", address)
+	}
+
+	addr, err := parseVsockAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock socket: %s", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrVM{CID: addr.CID, Port: addr.Port})
+	if err == nil {
+		err = unix.Listen(fd, unix.SOMAXCONN)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("vsock listen on %s: %s", addr, err)
+	}
+	return &listener{fd: fd, addr: addr}, nil
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	fd, sa, err := unix.Accept4(l.fd, unix.SOCK_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	remote := &Addr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = &Addr{CID: vm.CID, Port: vm.Port}
+	}
+	return newConn(fd, remote)
+}
+
+func (l *listener) Close() error {
+	return unix.Close(l.fd)
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
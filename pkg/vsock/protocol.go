@@ -0,0 +1,70 @@
+package vsock
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Secret provisioning over vsock
+//Each message is a JSON document preceded by its length, 4 bytes big
+//endian. The guest sends a Request and the host proxy answers with a
+//Response holding the secrets encrypted to the ephemeral key of the
+//request.
+
+const (
+	ProtocolVersion = 1
+
+	//Largest message
+	maxMessageSize = 1 << 20
+)
+
+//Request for the named secrets
+type Request struct {
+	Version int `json:"version"`
+	//Ephemeral X25519 key of the guest
+	PublicKey *crypto.JWK `json:"publicKey"`
+	Names     []string    `json:"names"`
+}
+
+//Response with a JWE per secret held by the proxy
+type Response struct {
+	Secrets map[string]json.RawMessage `json:"secrets,omitempty"`
+	Error   string                     `json:"error,omitempty"`
+}
+
+//Write a length prefixed message
+func writeMessage(w io.Writer, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes too large", len(data))
+	}
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+//Read a length prefixed message
+func readMessage(r io.Reader, message interface{}) error {
+	var size uint32
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return err
+	}
+	if size > maxMessageSize {
+		return fmt.Errorf("message of %d bytes too large", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, message)
+}
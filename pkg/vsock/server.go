@@ -0,0 +1,88 @@
+package vsock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+//Server is the host proxy, serving the files of a directory
+type Server struct {
+	dir string
+}
+
+//New proxy serving the secrets in dir
+func NewServer(dir string) *Server {
+	return &Server{dir: dir}
+}
+
+//Serve the guests connecting to listener
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	request := &Request{}
+	err := readMessage(conn, request)
+	if err != nil {
+		log.Errorf("Invalid request from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	response := s.handle(request)
+	if response.Error != "" {
+		log.Errorf("Request from %s failed: %s", conn.RemoteAddr(), response.Error)
+	}
+	err = writeMessage(conn, response)
+	if err != nil {
+		log.Errorf("Unable to respond to %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+//Encrypt the requested secrets to the key of the request
+func (s *Server) handle(request *Request) *Response {
+	if request.Version != ProtocolVersion {
+		return &Response{Error: "unsupported protocol version"}
+	}
+	if request.PublicKey == nil || request.PublicKey.Curve != "X25519" {
+		return &Response{Error: "the request needs an X25519 public key"}
+	}
+
+	response := &Response{Secrets: make(map[string]json.RawMessage)}
+	for _, name := range request.Names {
+		if !secretNamePattern.MatchString(name) {
+			return &Response{Error: "invalid secret name " + name}
+		}
+		secret, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return &Response{Error: err.Error()}
+		}
+		wrapped, err := crypto.SealEnvelope(secret, crypto.EnvelopeHeader{}, request.PublicKey)
+		crypto.Wipe(secret)
+		if err != nil {
+			return &Response{Error: err.Error()}
+		}
+		response.Secrets[name] = wrapped
+		log.Infof("Provisioned %s", name)
+	}
+	return response
+}
@@ -0,0 +1,287 @@
+package vsock
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+	"golang.org/x/sys/unix"
+)
+
+//Proxy on a Unix socket serving configMapKey and imageKey
+func startServer(t *testing.T) string {
+	dir := t.TempDir()
+	for name, secret := range map[string]string{
+		"configMapKey": "Y29uZmlnTWFwS2V5",
+		"imageKey":     "aW1hZ2VLZXk=",
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(secret), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	address := schemeUnix + filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(dir).Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return address
+}
+
+//Proxy on a Unix socket handling each connection with serve
+func startFakeServer(t *testing.T, serve func(conn net.Conn)) string {
+	address := schemeUnix + filepath.Join(t.TempDir(), "fake.sock")
+	listener, err := Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serve(conn)
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return address
+}
+
+//Send request to the proxy at address and read its response
+func roundTrip(t *testing.T, address string, request interface{}) (*Response, error) {
+	conn, err := Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = writeMessage(conn, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &Response{}
+	return response, readMessage(conn, response)
+}
+
+func testPublicKey(t *testing.T, curve ecdh.Curve) *crypto.JWK {
+	key, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := crypto.NewJWK(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+func TestFetchSecrets(t *testing.T) {
+	address := startServer(t)
+	dir := filepath.Join(t.TempDir(), "secrets")
+
+	err := NewClient(address).FetchSecrets(dir, "configMapKey", "imageKey", "trustedKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"configMapKey": "Y29uZmlnTWFwS2V5",
+		"imageKey":     "aW1hZ2VLZXk=",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "trustedKeys")); !os.IsNotExist(err) {
+		t.Error("trustedKeys written although the proxy doesn't hold it")
+	}
+
+	//Secrets already fetched are not requested again
+	err = NewClient(schemeUnix+filepath.Join(t.TempDir(), "none.sock")).FetchSecrets(dir, "configMapKey", "imageKey")
+	if err != nil {
+		t.Errorf("request for secrets already fetched: %s", err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	address := startServer(t)
+	tests := []struct {
+		name    string
+		request *Request
+		err     string
+	}{
+		{"unknown version", &Request{Version: ProtocolVersion + 1, PublicKey: testPublicKey(t, ecdh.X25519()), Names: []string{"configMapKey"}}, "unsupported protocol version"},
+		{"no key", &Request{Version: ProtocolVersion, Names: []string{"configMapKey"}}, "needs an X25519 public key"},
+		{"P-256 key", &Request{Version: ProtocolVersion, PublicKey: testPublicKey(t, ecdh.P256()), Names: []string{"configMapKey"}}, "needs an X25519 public key"},
+		{"path in name", &Request{Version: ProtocolVersion, PublicKey: testPublicKey(t, ecdh.X25519()), Names: []string{"../configMapKey"}}, "invalid secret name ../configMapKey"},
+		{"hidden name", &Request{Version: ProtocolVersion, PublicKey: testPublicKey(t, ecdh.X25519()), Names: []string{".configMapKey"}}, "invalid secret name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := roundTrip(t, address, test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(response.Error, test.err) || len(response.Secrets) != 0 {
+				t.Errorf("response %+v, want error %q", response, test.err)
+			}
+		})
+	}
+
+	//The client reports the error of the proxy
+	err := NewClient(address).FetchSecrets(t.TempDir(), "../configMapKey")
+	if err == nil || !strings.Contains(err.Error(), "host proxy: invalid secret name") {
+		t.Errorf("client error = %v", err)
+	}
+}
+
+func TestOversizedFrame(t *testing.T) {
+	address := startServer(t)
+
+	//The proxy drops the connection without reading the message
+	conn, err := Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var frame [4]byte
+	binary.BigEndian.PutUint32(frame[:], maxMessageSize+1)
+	_, err = conn.Write(frame[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readMessage(conn, &Response{})
+	if err != io.EOF {
+		t.Errorf("response to an oversized frame: %v", err)
+	}
+
+	//The client rejects an oversized response
+	address = startFakeServer(t, func(conn net.Conn) {
+		readMessage(conn, &Request{})
+		conn.Write(frame[:])
+	})
+	err = NewClient(address).FetchSecrets(t.TempDir(), "configMapKey")
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized response error = %v", err)
+	}
+
+	err = writeMessage(ioutil.Discard, &Response{Error: strings.Repeat("x", maxMessageSize)})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized message written: %v", err)
+	}
+}
+
+func TestClosedConnection(t *testing.T) {
+	tests := []struct {
+		name  string
+		serve func(conn net.Conn)
+		err   error
+	}{
+		{"closed before the response", func(conn net.Conn) {
+			readMessage(conn, &Request{})
+		}, io.EOF},
+		{"closed in the length", func(conn net.Conn) {
+			readMessage(conn, &Request{})
+			conn.Write([]byte{0, 0})
+		}, io.ErrUnexpectedEOF},
+		{"closed in the message", func(conn net.Conn) {
+			readMessage(conn, &Request{})
+			conn.Write([]byte{0, 0, 0, 100, '{'})
+		}, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := NewClient(startFakeServer(t, test.serve)).FetchSecrets(dir, "configMapKey")
+			if err != test.err {
+				t.Errorf("error = %v, want %v", err, test.err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "configMapKey")); !os.IsNotExist(err) {
+				t.Error("configMapKey written")
+			}
+		})
+	}
+}
+
+func TestSecretOfOtherKey(t *testing.T) {
+	other := testPublicKey(t, ecdh.X25519())
+	address := startFakeServer(t, func(conn net.Conn) {
+		readMessage(conn, &Request{})
+		wrapped, err := crypto.SealEnvelope([]byte("Y29uZmlnTWFwS2V5"), crypto.EnvelopeHeader{}, other)
+		if err != nil {
+			return
+		}
+		writeMessage(conn, &Response{Secrets: map[string]json.RawMessage{"configMapKey": wrapped}})
+	})
+	err := NewClient(address).FetchSecrets(t.TempDir(), "configMapKey")
+	if err == nil || !strings.Contains(err.Error(), "host proxy secret configMapKey") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeMessage(&buf, &Request{Version: ProtocolVersion, Names: []string{"imageKey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.BigEndian.Uint32(buf.Bytes()); int(size) != buf.Len()-4 {
+		t.Errorf("length %d of a %d byte message", size, buf.Len()-4)
+	}
+	request := &Request{}
+	err = readMessage(&buf, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Version != ProtocolVersion || len(request.Names) != 1 || request.Names[0] != "imageKey" {
+		t.Errorf("request %+v", request)
+	}
+}
+
+func TestParseVsockAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		addr    *Addr
+	}{
+		{"vsock:host:1024", &Addr{CID: unix.VMADDR_CID_HOST, Port: 1024}},
+		{"vsock:any:1024", &Addr{CID: unix.VMADDR_CID_ANY, Port: 1024}},
+		{"vsock:3:5000", &Addr{CID: 3, Port: 5000}},
+		{"vsock:3", nil},
+		{"vsock:guest:1024", nil},
+		{"vsock:3:port", nil},
+		{"vsock:3:4294967296", nil},
+	}
+	for _, test := range tests {
+		addr, err := parseVsockAddress(test.address)
+		if test.addr == nil {
+			if err == nil {
+				t.Errorf("%s parsed", test.address)
+			}
+			continue
+		}
+		if err != nil || *addr != *test.addr {
+			t.Errorf("%s = %v, %v", test.address, addr, err)
+		}
+	}
+
+	_, err := Dial("tcp:localhost:1024")
+	if err == nil {
+		t.Error("dialed a TCP address")
+	}
+}
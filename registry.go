@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Credentials of the image puller of the guest, a Docker config.json auth
+//file delivered as a user secret with the registry-auth content type. They
+//are kept in the guest, per namespace, and never copied into the container.
+
+const (
+	//Content type of the envelope of registry credentials
+	registryAuthContentType = "raksh.registry-auth+json"
+
+	//<dir>/<namespace>/auth.json
+	rakshRegistryAuthDir      = rakshVMTEEMountPoint + "/registry-auth"
+	registryAuthFileName      = "auth.json"
+	registryAuthMaxRegistries = 64
+)
+
+//Docker config.json auth file
+type registryAuthFile struct {
+	Auths map[string]registryAuth `json:"auths"`
+	//Credential helpers would run programs named by the deployer
+	CredsStore  string            `json:"credsStore,omitempty"`
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+}
+
+//Credentials of a registry
+type registryAuth struct {
+	//base64 of <username>:<password>
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+//Check the structure of the auth file
+func validateRegistryAuth(data []byte) error {
+
+	var file registryAuthFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&file)
+	if err != nil {
+		return fmt.Errorf("invalid registry credentials: %s", err)
+	}
+
+	if file.CredsStore != "" || len(file.CredHelpers) > 0 {
+		return errors.New("credential helpers are not supported in registry credentials")
+	}
+	if len(file.Auths) == 0 {
+		return errors.New("the registry credentials have no auths")
+	}
+	if len(file.Auths) > registryAuthMaxRegistries {
+		return fmt.Errorf("the registry credentials have more than %d registries", registryAuthMaxRegistries)
+	}
+	for registry, auth := range file.Auths {
+		if registry == "" || strings.ContainsAny(registry, " \t\n") {
+			return fmt.Errorf("invalid registry %q in the registry credentials", registry)
+		}
+		switch {
+		case auth.Auth != "":
+			decoded, err := b64.StdEncoding.DecodeString(auth.Auth)
+			valid := err == nil && strings.Contains(string(decoded), ":")
+			crypto.Wipe(decoded)
+			if !valid {
+				return fmt.Errorf("invalid auth of registry %s, expected base64 of <username>:<password>", registry)
+			}
+		case auth.Username != "" && auth.Password != "":
+		case auth.IdentityToken != "" || auth.RegistryToken != "":
+		default:
+			return fmt.Errorf("registry %s has no credentials", registry)
+		}
+	}
+	return nil
+}
+
+//Validate and store the registry credentials of the namespace for the
+//image puller of the guest
+func storeRegistryAuth(namespace string, data *crypto.SecureBuffer) error {
+
+	if namespace == "" || namespace != filepath.Base(namespace) || strings.HasPrefix(namespace, ".") {
+		return fmt.Errorf("registry credentials need the namespace of the properties, not %q", namespace)
+	}
+	err := validateRegistryAuth(data.Bytes())
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(rakshRegistryAuthDir, namespace)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	//Replace the file of an earlier container atomically
+	file, err := os.CreateTemp(dir, "."+registryAuthFileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, registryAuthFileName)
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+	log.Infof("Stored the registry credentials of namespace %s in %s", namespace, path)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	//High-water marks of the envelope versions
+	//The persistent location is used when the guest image provides it, so
+	//the marks survive VM restarts. It is neither sealed nor authenticated:
+	//whoever controls the guest disk can roll the marks back. Otherwise the
+	//marks only live as long as the VM.
+	rakshPersistentVersionsDir = "/var/lib/raksh/versions"
+	rakshVersionsDir           = rakshVMTEEMountPoint + "/versions"
+)
+
+//Store of the highest envelope version accepted per workload item
+type versionStore struct {
+	dir string
+}
+
+//Open the version store, preferring the persistent location
+func openVersionStore() (*versionStore, error) {
+
+	dir := rakshVersionsDir
+	if _, err := os.Stat(filepath.Dir(rakshPersistentVersionsDir)); err == nil {
+		dir = rakshPersistentVersionsDir
+	} else {
+		log.Info("No persistent storage, version high-water marks last for the VM lifetime only")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.Errorf("Unable to create the version store %s: %s", dir, err)
+		return nil, err
+	}
+	log.Infof("Version store: %s", dir)
+	return &versionStore{dir: dir}, nil
+}
+
+//Reject versions below the high-water mark of the workload item and
+//raise the mark to version otherwise
+func (s *versionStore) check(workload string, item string, version uint64) error {
+
+	key := workload + "/" + item
+	digest := sha256.Sum256([]byte(key))
+	markFile := filepath.Join(s.dir, hex.EncodeToString(digest[:]))
+
+	var mark uint64
+	data, err := ioutil.ReadFile(markFile)
+	if err == nil {
+		mark, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("corrupt version high-water mark for %s: %s", key, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if version < mark {
+		return fmt.Errorf("rollback of %s to version %d, already seen version %d", key, version, mark)
+	}
+	if version == mark {
+		return nil
+	}
+
+	log.Infof("Raising version high-water mark for %s to %d", key, version)
+	tmpFile := markFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, []byte(strconv.FormatUint(version, 10)), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, markFile)
+}
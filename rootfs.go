@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//Integrity of the container rootfs, which the host provides over virtio-fs
+//or as a block device. Either a manifest digest of selected paths, or the
+//root hash of the dm-verity device the rootfs is mounted from.
+
+const (
+	procSelfMountInfo = "/proc/self/mountinfo"
+	sysBlockDir       = "/sys/block"
+)
+
+//Expected rootfs of a container of the properties
+type rootfsIntegrity struct {
+	//Paths in the rootfs covered by digest, e.g. /usr, /app
+	Paths []string `yaml:"paths"`
+	//sha256:<hex> manifest digest of the paths
+	Digest string `yaml:"digest"`
+	//Hex root hash of the dm-verity device of the rootfs
+	VerityRootHash string `yaml:"verityRootHash"`
+}
+
+//Check the rootfs of the container against the properties before the
+//secrets are delivered. Containers without rootfs integrity in the
+//properties are not checked. The result is recorded in events.
+func verifyRootfs(scConfig *scConfig, annotations map[string]string, rootfs string, events *eventLog) error {
+
+	container, err := scConfig.container(annotations)
+	if err != nil {
+		return err
+	}
+	expected := container.Rootfs
+	if expected == nil {
+		log.Infof("No rootfs integrity for container %s, the rootfs is not verified", container.Name)
+		return nil
+	}
+
+	data := map[string]string{}
+	switch {
+	case expected.VerityRootHash != "":
+		var rootHash string
+		rootHash, err = verityRootHash(rootfs)
+		if err == nil && subtle.ConstantTimeCompare([]byte(rootHash), []byte(strings.ToLower(expected.VerityRootHash))) != 1 {
+			err = fmt.Errorf("the dm-verity root hash of the rootfs is %s", rootHash)
+		}
+		data["verityRootHash"] = rootHash
+	case expected.Digest != "":
+		var digest string
+		digest, err = rootfsDigest(rootfs, expected.Paths)
+		if err == nil && subtle.ConstantTimeCompare([]byte(digest), []byte(expected.Digest)) != 1 {
+			err = fmt.Errorf("the digest of the rootfs is %s", digest)
+		}
+		data["digest"] = digest
+	default:
+		err = errors.New("the rootfs integrity has neither digest nor verityRootHash")
+	}
+
+	data["result"] = verificationResult(err)
+	if recordErr := events.record(eventRootfs, data); recordErr != nil {
+		return recordErr
+	}
+	if err != nil {
+		return fmt.Errorf("rootfs of container %s: %s", container.Name, err)
+	}
+	log.Infof("Verified the rootfs of container %s", container.Name)
+	return nil
+}
+
+//Manifest digest of paths in rootfs. The manifest has a line per file,
+//directory and symbolic link under the paths, in lexical order:
+//<type> <uid> <gid> <mode> <content> <path>
+//with type f, d, l or o, the octal permission bits, the hex SHA-256 of
+//regular files or the quoted target of symbolic links, - otherwise, and
+//the quoted absolute path in the rootfs. Symbolic links are not followed.
+func rootfsDigest(rootfs string, paths []string) (string, error) {
+
+	if len(paths) == 0 {
+		return "", errors.New("no rootfs paths to digest")
+	}
+	manifest := sha256.New()
+	for _, path := range paths {
+		top := filepath.Join(rootfs, filepath.Clean("/"+path))
+		err := filepath.WalkDir(top, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			line, err := manifestLine(rootfs, file)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(manifest, line)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return "sha256:" + hex.EncodeToString(manifest.Sum(nil)), nil
+}
+
+//Manifest line of file
+func manifestLine(rootfs string, file string) (string, error) {
+
+	info, err := os.Lstat(file)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no owner of %s", file)
+	}
+
+	fileType, content := "o", "-"
+	switch {
+	case info.Mode().IsRegular():
+		fileType = "f"
+		content, err = fileDigest(file)
+	case info.IsDir():
+		fileType = "d"
+	case info.Mode()&os.ModeSymlink != 0:
+		fileType = "l"
+		var target string
+		target, err = os.Readlink(file)
+		content = strconv.Quote(target)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	path, err := filepath.Rel(rootfs, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d %d %04o %s %s\n", fileType, stat.Uid, stat.Gid, stat.Mode&07777,
+		content, strconv.Quote("/"+filepath.ToSlash(path))), nil
+}
+
+//Hex SHA-256 of the content of file
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	digest := sha256.New()
+	_, err = io.Copy(digest, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+//Root hash of the dm-verity device the rootfs is mounted from, which the
+//kernel has verified so far
+func verityRootHash(rootfs string) (string, error) {
+
+	device, err := mountSource(procSelfMountInfo, rootfs)
+	if err != nil {
+		return "", err
+	}
+	name, err := deviceMapperName(sysBlockDir, device)
+	if err != nil {
+		return "", err
+	}
+	return dmVerityRootHash(name)
+}
+
+//Root hash of the dm-verity device name, unless it detected corruption
+func dmVerityRootHash(name string) (string, error) {
+
+	//<start> <length> verity <version> <data device> <hash device>
+	//<data block size> <hash block size> <data blocks> <hash start>
+	//<algorithm> <root hash> <salt> [<options>]
+	out, err := exec.Command("dmsetup", "table", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("dmsetup table %s: %s", name, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 13 || fields[2] != "verity" {
+		return "", fmt.Errorf("the rootfs device %s is not a dm-verity device", name)
+	}
+	rootHash := strings.ToLower(fields[11])
+
+	//The status ends with V while no corruption was detected
+	out, err = exec.Command("dmsetup", "status", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("dmsetup status %s: %s", name, err)
+	}
+	status := strings.Fields(string(out))
+	if len(status) < 4 || status[3] != "V" {
+		return "", fmt.Errorf("the dm-verity device %s detected corruption", name)
+	}
+	return rootHash, nil
+}
+
+//Source of the mount at mountPoint, the last one when mounted over
+func mountSource(mountInfo string, mountPoint string) (string, error) {
+
+	file, err := os.Open(mountInfo)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var source string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		//<id> <parent> <major:minor> <root> <mount point> <options> [<optional>...] - <type> <source> <super options>
+		mount, super, ok := strings.Cut(scanner.Text(), " - ")
+		fields := strings.Fields(mount)
+		superFields := strings.Fields(super)
+		if !ok || len(fields) < 5 || len(superFields) < 2 {
+			continue
+		}
+		if unescapeMountPath(fields[4]) == filepath.Clean(mountPoint) {
+			source = unescapeMountPath(superFields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if source == "" {
+		return "", fmt.Errorf("%s is not a mount point", mountPoint)
+	}
+	return source, nil
+}
+
+//Mount info escapes space, tab, newline and backslash in octal
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
+
+//Device mapper name of device, /dev/mapper/<name> or /dev/dm-<n> as
+//named in sysBlock
+func deviceMapperName(sysBlock string, device string) (string, error) {
+
+	if strings.HasPrefix(device, "/dev/mapper/") {
+		return strings.TrimPrefix(device, "/dev/mapper/"), nil
+	}
+	if strings.HasPrefix(device, "/dev/dm-") {
+		name, err := ioutil.ReadFile(filepath.Join(sysBlock, filepath.Base(device), "dm", "name"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(name)), nil
+	}
+	return "", fmt.Errorf("the rootfs is mounted from %s, not from a device mapper device", device)
+}
+
+//rootfs-digest -paths <path>[,<path>...] <rootfs>
+//Print the manifest digest of the paths in rootfs, for the properties
+func rootfsDigestCommand(args []string) error {
+
+	flags := flag.NewFlagSet("rootfs-digest", flag.ContinueOnError)
+	paths := flags.String("paths", "", "Comma separated paths in the rootfs")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *paths == "" {
+		return errors.New("usage: rootfs-digest -paths <path>[,<path>...] <rootfs>")
+	}
+	digest, err := rootfsDigest(flags.Arg(0), strings.Split(*paths, ","))
+	if err != nil {
+		return err
+	}
+	fmt.Println(digest)
+	return nil
+}
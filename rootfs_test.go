@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Rootfs with a directory, files and symbolic links whose names need
+//quoting, and a path outside of the digest
+func writeTestRootfs(t *testing.T) string {
+	rootfs := t.TempDir()
+	for _, dir := range []string{"app", "app/my dir", "etc/raksh"} {
+		err := os.MkdirAll(filepath.Join(rootfs, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"app/run":               "#!/bin/sh\n",
+		"app/my dir/a\"b\\c":    "data",
+		"etc/raksh/secret.conf": "not covered",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(rootfs, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Chmod(filepath.Join(rootfs, "app/run"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("../run", filepath.Join(rootfs, "app/my dir/link\tto run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"app", "app/my dir"} {
+		err = os.Chmod(filepath.Join(rootfs, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func sha256Hex(data string) string {
+	digest := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestRootfsDigest(t *testing.T) {
+	rootfs := writeTestRootfs(t)
+	uid, gid := os.Geteuid(), os.Getegid()
+	manifest := fmt.Sprintf(`d %[1]d %[2]d 0755 - "/app"
+d %[1]d %[2]d 0755 - "/app/my dir"
+f %[1]d %[2]d 0644 %[3]s "/app/my dir/a\"b\\c"
+l %[1]d %[2]d 0777 "../run" "/app/my dir/link\tto run"
+f %[1]d %[2]d 0755 %[4]s "/app/run"
+`, uid, gid, sha256Hex("data"), sha256Hex("#!/bin/sh\n"))
+
+	digest, err := rootfsDigest(rootfs, []string{"/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "sha256:" + sha256Hex(manifest); digest != want {
+		t.Fatalf("digest %s, want %s of\n%s", digest, want, manifest)
+	}
+
+	//Paths are relative to the rootfs
+	for _, paths := range [][]string{{"app"}, {"/app/"}, {"/../../app"}} {
+		other, err := rootfsDigest(rootfs, paths)
+		if err != nil || other != digest {
+			t.Errorf("%q: digest %s, %v", paths, other, err)
+		}
+	}
+
+	//Changes outside of the paths are not covered
+	err = ioutil.WriteFile(filepath.Join(rootfs, "etc/raksh/secret.conf"), []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := rootfsDigest(rootfs, []string{"/app"}); other != digest {
+		t.Error("digest changed by a path outside of the paths")
+	}
+
+	changes := []struct {
+		name   string
+		change func(rootfs string) error
+	}{
+		{"content", func(rootfs string) error {
+			return ioutil.WriteFile(filepath.Join(rootfs, "app/run"), []byte("#!/bin/bash\n"), 0755)
+		}},
+		{"mode", func(rootfs string) error {
+			return os.Chmod(filepath.Join(rootfs, "app/run"), os.ModeSetuid|0755)
+		}},
+		{"link target", func(rootfs string) error {
+			link := filepath.Join(rootfs, "app/my dir/link\tto run")
+			err := os.Remove(link)
+			if err != nil {
+				return err
+			}
+			return os.Symlink("/bin/sh", link)
+		}},
+		{"new file", func(rootfs string) error {
+			return ioutil.WriteFile(filepath.Join(rootfs, "app/my dir/new"), nil, 0644)
+		}},
+		{"renamed file", func(rootfs string) error {
+			return os.Rename(filepath.Join(rootfs, "app/run"), filepath.Join(rootfs, "app/run2"))
+		}},
+	}
+	for _, test := range changes {
+		rootfs := writeTestRootfs(t)
+		err := test.change(rootfs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := rootfsDigest(rootfs, []string{"/app"})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if other == digest {
+			t.Errorf("%s: same digest", test.name)
+		}
+	}
+
+	_, err = rootfsDigest(rootfs, []string{"/app", "/missing"})
+	if err == nil {
+		t.Error("digest of a missing path")
+	}
+	_, err = rootfsDigest(rootfs, nil)
+	if err == nil {
+		t.Error("digest without paths")
+	}
+}
+
+func TestManifestLine(t *testing.T) {
+	rootfs := writeTestRootfs(t)
+	uid, gid := os.Geteuid(), os.Getegid()
+	tests := []struct {
+		file string
+		line string
+	}{
+		{"app", fmt.Sprintf(`d %d %d 0755 - "/app"`, uid, gid)},
+		{"app/run", fmt.Sprintf(`f %d %d 0755 %s "/app/run"`, uid, gid, sha256Hex("#!/bin/sh\n"))},
+		{"app/my dir/link\tto run", fmt.Sprintf(`l %d %d 0777 "../run" "/app/my dir/link\tto run"`, uid, gid)},
+	}
+	for _, test := range tests {
+		line, err := manifestLine(rootfs, filepath.Join(rootfs, test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != test.line+"\n" {
+			t.Errorf("%q: %q, want %q", test.file, line, test.line)
+		}
+	}
+	_, err := manifestLine(rootfs, filepath.Join(rootfs, "missing"))
+	if err == nil {
+		t.Error("manifest line of a missing file")
+	}
+}
+
+func TestVerifyRootfs(t *testing.T) {
+	rootfs := writeTestRootfs(t)
+	digest, err := rootfsDigest(rootfs, []string{"/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		integrity *rootfsIntegrity
+		err       string
+	}{
+		{"matching digest", &rootfsIntegrity{Paths: []string{"/app"}, Digest: digest}, ""},
+		{"other digest", &rootfsIntegrity{Paths: []string{"/app"}, Digest: "sha256:" + sha256Hex("")}, "the digest of the rootfs is " + digest},
+		{"missing path", &rootfsIntegrity{Paths: []string{"/usr"}, Digest: digest}, "no such file or directory"},
+		{"not a mount point", &rootfsIntegrity{VerityRootHash: sha256Hex("")}, "is not a mount point"},
+		{"neither", &rootfsIntegrity{}, "neither digest nor verityRootHash"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "container.jsonl")
+			events := openTestEventLog(t, path, &fakeMeasurer{})
+			scConfig := &scConfig{Spec: spec{Containers: []containers{{Name: "app", Rootfs: test.integrity}}}}
+
+			err := verifyRootfs(scConfig, nil, rootfs, events)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+			log, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(log), `"type":"`+eventRootfs+`"`) {
+				t.Errorf("no %s event in %s", eventRootfs, log)
+			}
+		})
+	}
+
+	//Containers without rootfs integrity are not checked
+	scConfig := &scConfig{Spec: spec{Containers: []containers{{Name: "app"}}}}
+	err = verifyRootfs(scConfig, nil, filepath.Join(rootfs, "missing"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+const testMountInfo = `22 1 253:1 / / rw,relatime - ext4 /dev/vda1 rw
+35 22 0:32 / /run rw,nosuid shared:5 - tmpfs tmpfs rw,mode=755
+60 35 253:2 / /run/kata-containers/shared/containers/app\040x/rootfs ro,relatime shared:20 master:1 - ext4 /dev/mapper/app\040root ro
+61 35 0:40 / /run/kata-containers/shared/containers/app\040x/rootfs rw - overlay overlay rw
+62 35 0:41 / /run/kata-containers/shared/containers/db/rootfs rw - overlay overlay rw
+63 62 253:3 / /run/kata-containers/shared/containers/db/rootfs ro - ext4 /dev/dm-3 ro
+64 35 0:42 / /run/tab\011and\134back rw - tmpfs dev\012ice rw
+malformed line
+65 35 0:43 / /run/short rw -
+`
+
+func TestMountSource(t *testing.T) {
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	err := ioutil.WriteFile(mountInfo, []byte(testMountInfo), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mountPoint string
+		source     string
+	}{
+		{"/", "/dev/vda1"},
+		{"/run/kata-containers/shared/containers/db/rootfs", "/dev/dm-3"},
+		{"/run/kata-containers/shared/containers/db/rootfs/", "/dev/dm-3"},
+		{"/run/kata-containers/shared/containers/app x/rootfs", "overlay"},
+		{"/run/tab\tand\\back", "dev\nice"},
+		{"/run/kata-containers", ""},
+		{"/run/short", ""},
+	}
+	for _, test := range tests {
+		source, err := mountSource(mountInfo, test.mountPoint)
+		if test.source == "" {
+			if err == nil || !strings.Contains(err.Error(), "is not a mount point") {
+				t.Errorf("%s: source %q, error %v", test.mountPoint, source, err)
+			}
+			continue
+		}
+		if err != nil || source != test.source {
+			t.Errorf("%s: source %q, error %v, want %q", test.mountPoint, source, err, test.source)
+		}
+	}
+
+	_, err = mountSource(filepath.Join(t.TempDir(), "missing"), "/")
+	if err == nil {
+		t.Error("mount source without mount info")
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/run/app", "/run/app"},
+		{`/run/app\040x`, "/run/app x"},
+		{`\011\012\134\040`, "\t\n\\ "},
+		{`/run/a\04`, `/run/a\04`},
+		{`/run/a\999`, `/run/a\999`},
+		{`/run/a\`, `/run/a\`},
+	}
+	for _, test := range tests {
+		if got := unescapeMountPath(test.path); got != test.want {
+			t.Errorf("%q: %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestDeviceMapperName(t *testing.T) {
+	sysBlock := t.TempDir()
+	err := os.MkdirAll(filepath.Join(sysBlock, "dm-3", "dm"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sysBlock, "dm-3", "dm", "name"), []byte("db-root\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		device string
+		name   string
+	}{
+		{"/dev/mapper/app root", "app root"},
+		{"/dev/dm-3", "db-root"},
+		{"/dev/dm-4", ""},
+		{"/dev/vda1", ""},
+		{"overlay", ""},
+	}
+	for _, test := range tests {
+		name, err := deviceMapperName(sysBlock, test.device)
+		if test.name == "" {
+			if err == nil {
+				t.Errorf("%s: name %q", test.device, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name {
+			t.Errorf("%s: name %q, error %v, want %q", test.device, name, err, test.name)
+		}
+	}
+}
+
+//dmsetup printing table and status of the device, or failing for others
+func fakeDMSetup(t *testing.T, device string, table string, status string) {
+	dir := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+[ "$2" = %q ] || { echo "Device does not exist." >&2; exit 1; }
+case "$1" in
+table) echo %q ;;
+status) echo %q ;;
+*) exit 1 ;;
+esac
+`, device, table, status)
+	err := ioutil.WriteFile(filepath.Join(dir, "dmsetup"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDMVerityRootHash(t *testing.T) {
+	rootHash := sha256Hex("root")
+	table := "0 2097152 verity 1 /dev/vdb /dev/vdc 4096 4096 262144 1 sha256 " + strings.ToUpper(rootHash) + " 5eed ignore_zero_blocks"
+	tests := []struct {
+		name   string
+		device string
+		table  string
+		status string
+		err    string
+	}{
+		{"verified", "app-root", table, "0 2097152 verity V", ""},
+		{"corrupted", "app-root", table, "0 2097152 verity C", "detected corruption"},
+		{"no status", "app-root", table, "", "detected corruption"},
+		{"linear", "app-root", "0 2097152 linear /dev/vdb 0", "0 2097152 linear", "is not a dm-verity device"},
+		{"short table", "app-root", "0 2097152 verity 1 /dev/vdb", "0 2097152 verity V", "is not a dm-verity device"},
+		{"missing device", "other", table, "0 2097152 verity V", "dmsetup table app-root"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeDMSetup(t, test.device, test.table, test.status)
+			got, err := dmVerityRootHash("app-root")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("root hash %q, error %v, want %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil || got != rootHash {
+				t.Errorf("root hash %q, error %v", got, err)
+			}
+		})
+	}
+}
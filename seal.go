@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//seal -key <public key> -workload <namespace>/<name> -version <n> [-validity <duration>] [-cty <type>] [-in <file>]
+//Encrypt the properties or a user secret, from -in or stdin, to the public
+//half of envelopeKey and print the envelope, for the deployer
+func sealCommand(args []string) error {
+
+	flags := flag.NewFlagSet("seal", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "PEM public key of envelopeKey, X25519 or NIST curve")
+	workload := flags.String("workload", "", "Workload of the item, e.g. <namespace>/<name>")
+	version := flags.Uint64("version", 0, "Version of the item, increased on every update")
+	validity := flags.Duration("validity", 30*24*time.Hour, "Validity of the envelope from now")
+	contentType := flags.String("cty", "", "Type of a user secret, e.g. "+registryAuthContentType)
+	input := flags.String("in", "", "File to encrypt instead of stdin")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *keyFile == "" || *workload == "" || *version == 0 || flags.NArg() != 0 {
+		return errors.New("usage: seal -key <public key> -workload <namespace>/<name> -version <n> [-validity <duration>] [-cty <type>] [-in <file>]")
+	}
+
+	recipient, err := readEnvelopePublicKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	var plaintext []byte
+	if *input != "" {
+		plaintext, err = ioutil.ReadFile(*input)
+	} else {
+		plaintext, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(plaintext)
+	if *contentType == registryAuthContentType {
+		err = validateRegistryAuth(plaintext)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	envelope, err := crypto.SealEnvelope(plaintext, crypto.EnvelopeHeader{
+		Workload:    *workload,
+		Version:     *version,
+		ContentType: *contentType,
+		IssuedAt:    now.Unix(),
+		NotAfter:    now.Add(*validity).Unix(),
+	}, recipient)
+	if err != nil {
+		return err
+	}
+	//No newline, the signature is over the envelope alone
+	_, err = os.Stdout.Write(envelope)
+	return err
+}
+
+//JWK of the PEM public key in file
+func readEnvelopePublicKey(file string) (*crypto.JWK, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdh.PublicKey:
+		return crypto.NewJWK(key)
+	case *ecdsa.PublicKey:
+		public, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return crypto.NewJWK(public)
+	}
+	return nil, fmt.Errorf("unsupported public key type %T in %s, envelopes use ECDH-ES", key, file)
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	b64 "encoding/base64"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/raksh-oci-hook/pkg/crypto"
+	"github.com/raksh-oci-hook/pkg/kbs"
+	"github.com/raksh-oci-hook/pkg/vsock"
 )
 
 type requests struct {
@@ -33,46 +40,79 @@ type containers struct {
 	Env       []env     `yaml:"env"`
 	Cwd       string    `yaml:"cwd"`
 	Ports     []ports   `yaml:"ports"`
+	//Optional integrity of the rootfs
+	Rootfs *rootfsIntegrity `yaml:"rootfs"`
 }
 type spec struct {
 	Containers []containers `yaml:"containers"`
 }
+type metadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
 type scConfig struct {
-	Spec spec `yaml:"spec"`
+	Metadata    metadata    `yaml:"metadata"`
+	Spec        spec        `yaml:"spec"`
+	ImagePolicy imagePolicy `yaml:"imagePolicy"`
+	//SHA-256 of the decrypted properties
+	digest [sha256.Size]byte
+}
+
+//Container of the properties which the runtime starts. The host only
+//picks which of the containers of the properties it starts.
+func (c *scConfig) container(annotations map[string]string) (*containers, error) {
+	name := annotations[containerdContainerNameAnnotation]
+	if name == "" {
+		name = annotations[crioContainerNameAnnotation]
+	}
+	for i := range c.Spec.Containers {
+		container := &c.Spec.Containers[i]
+		if container.Name == name || len(c.Spec.Containers) == 1 && name == "" {
+			return container, nil
+		}
+	}
+	return nil, fmt.Errorf("container %q is not in the properties", name)
 }
 
 //Read encrypted ConfigMap containing Raksh properties
-func readEncryptedConfigmap(encryptedYamlContainerSpec []byte, configMapKey []byte, nonce []byte) (*scConfig, error) {
+//Returns the properties and the workload they belong to
+func readEncryptedConfigmap(encryptedYamlContainerSpec []byte, keys *crypto.EnvelopeKeys, versions *versionStore) (*scConfig, string, error) {
 
 	var scConfig scConfig
 
 	log.Infof("Reading encrypted configmap")
 
-	decryptedConfigMap, err := crypto.DecryptConfigMap(encryptedYamlContainerSpec, configMapKey, nonce)
+	decryptedConfigMap, header, err := openEnvelope(encryptedYamlContainerSpec, keys, rakshProperties, "", versions)
 	if err != nil {
 		log.Errorf("Error in decrypting configMap %s", err)
-		return nil, err
+		return nil, "", err
 	}
-	log.Debugf("Decrypted configmap %v", decryptedConfigMap)
+	defer decryptedConfigMap.Destroy()
+	log.Debugf("Decrypted configmap of %d bytes", decryptedConfigMap.Len())
 
-	err = persistDecryptedConfigMap(decryptedConfigMap)
+	err = persistDecryptedConfigMap(decryptedConfigMap.Bytes())
 	if err != nil {
 		log.Errorf("Error when persisting decrypted configmap %s", err)
-		return nil, err
+		return nil, "", err
 	}
 
-	err = yaml.Unmarshal(decryptedConfigMap, &scConfig)
+	err = yaml.Unmarshal(decryptedConfigMap.Bytes(), &scConfig)
 	if err != nil {
 		log.Errorf("Error unmarshalling yaml %s", err)
-		return nil, err
+		return nil, "", err
 	}
+	scConfig.digest = sha256.Sum256(decryptedConfigMap.Bytes())
 
-	return &scConfig, err
+	return &scConfig, header.Workload, err
 
 }
 
 //Read the Raksh secrets
-func readRakshUserSecrets(srcPath string, decKey []byte, nonce []byte) (userSecrets map[string][]byte, err error) {
+//The caller destroys the returned secure buffers
+//Each user secret is recorded in events
+//Registry credentials are stored for the image puller of the namespace
+//instead of being returned
+func readRakshUserSecrets(srcPath string, keys *crypto.EnvelopeKeys, workload string, namespace string, versions *versionStore, trustedKeys crypto.TrustedKeys, events *eventLog) (userSecrets map[string]*crypto.SecureBuffer, err error) {
 	log.Infof("Read Raksh User secrets")
 	//read all key value pairs under srcPath
 	files, err := ioutil.ReadDir(srcPath)
@@ -80,74 +120,303 @@ func readRakshUserSecrets(srcPath string, decKey []byte, nonce []byte) (userSecr
 		log.Errorf("Unable to read the secrets %s", err)
 		return nil, err
 	}
-	userSecrets = make(map[string][]byte)
+	userSecrets = make(map[string]*crypto.SecureBuffer)
 	for _, file := range files {
+		//Signatures are consumed along with the secret they sign
+		if strings.HasSuffix(file.Name(), userSecretSignatureSuffix) {
+			continue
+		}
 		log.Debugf("User secret key %s", file.Name())
-		userSecrets[file.Name()] = []byte{}
-                keyPath := filepath.Join(srcPath, file.Name())
-		value, err := readSecretFile(keyPath)
+		keyPath := filepath.Join(srcPath, file.Name())
+		value, err := readEncryptedFile(keyPath)
 		if err != nil {
 			log.Errorf("Reading the value for %s resulted in error %s", file.Name(), err)
+			//A refused secret is not replaced by one of the key broker
+			userSecrets[file.Name()] = nil
+			if err := recordUserSecret(events, file.Name(), "", err); err != nil {
+				return userSecrets, err
+			}
 			continue
 		}
-		//Decrypt the value. Use the master secret from Raksh secrets configMapKey and nonce
-		decValue, err := crypto.DecryptConfigMap(value, decKey, nonce)
+		sigPath := keyPath + userSecretSignatureSuffix
+		err = verifyDeployerSignature(trustedKeys, userSecretSignedData(file.Name(), value), sigPath)
 		if err != nil {
-			log.Errorf("Error in decrypting user secret key %s", err)
+			log.Errorf("Refusing to use user secret %s: %s", file.Name(), err)
+			userSecrets[file.Name()] = nil
+			if err := recordUserSecret(events, file.Name(), digestHex(value), err); err != nil {
+				return userSecrets, err
+			}
+			continue
+		}
+		//Decrypt the value. Use the master secret from Raksh secrets configMapKey
+		//or the TEE held envelope key
+		decValue, header, err := openEnvelope(value, keys, file.Name(), workload, versions)
+		registryAuth := err == nil && header.ContentType == registryAuthContentType
+		if registryAuth {
+			err = storeRegistryAuth(namespace, decValue)
+			decValue.Destroy()
+		} else if err == nil && header.ContentType != "" {
+			decValue.Destroy()
+			err = fmt.Errorf("user secret %s has the unknown content type %q", file.Name(), header.ContentType)
+		}
+		if recordErr := recordUserSecret(events, file.Name(), digestHex(value), err); recordErr != nil {
+			decValue.Destroy()
+			return userSecrets, recordErr
+		}
+		if err != nil {
+			log.Errorf("Refusing to use user secret %s: %s", file.Name(), err)
+			userSecrets[file.Name()] = nil
+			continue
+		}
+		if registryAuth {
 			continue
 		}
 		userSecrets[file.Name()] = decValue
-                persistDecryptedUserSecrets(file.Name(), decValue)
-		log.Debugf("User secret value %s", string(decValue))
+		persistDecryptedUserSecrets(file.Name(), decValue.Bytes())
+		log.Debugf("User secret value of %d bytes", decValue.Len())
 	}
-	log.Debugf("User Secrets map: %v", userSecrets)
 	return userSecrets, nil
 
 }
 
+//Get the user secrets configured for the key broker. They are encrypted
+//to the TEE in transit, so they need no envelope.
+func readKBSUserSecrets(broker *kbs.Client, config *hookConfig, userSecrets map[string]*crypto.SecureBuffer, events *eventLog) error {
+
+	if broker == nil {
+		return nil
+	}
+	for _, name := range config.KBS.UserSecrets {
+		if _, ok := userSecrets[name]; ok {
+			log.Errorf("User secret %s is both in the Kubernetes secret and at the key broker", name)
+			continue
+		}
+		value, err := broker.GetResource(config.KBS.Repository + "/user/" + name)
+		if err != nil {
+			log.Errorf("Unable to get user secret %s from the key broker: %s", name, err)
+			return err
+		}
+		userSecrets[name] = value
+		//Encrypted to the TEE key of the session, no ciphertext to record
+		err = events.record(eventUserSecret, map[string]string{"name": name, "source": "kbs", "result": verificationResult(nil)})
+		if err != nil {
+			return err
+		}
+		err = persistDecryptedUserSecrets(name, value.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Decrypt the envelope and enforce its validity window, workload and
+//version. item names the envelope within the workload for the version
+//check. workload is the expected workload, any for the properties which
+//define it.
+func openEnvelope(data []byte, keys *crypto.EnvelopeKeys, item string, workload string, versions *versionStore) (*crypto.SecureBuffer, *crypto.EnvelopeHeader, error) {
+
+	envelope, err := crypto.ParseEnvelope(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Decrypting authenticates the header before it's trusted
+	plaintext, err := envelope.Decrypt(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := &envelope.Header
+	err = header.CheckValidity(time.Now())
+	if err != nil {
+		plaintext.Destroy()
+		return nil, nil, fmt.Errorf("%s of workload %s rejected: %w", item, header.Workload, err)
+	}
+	//Before the version check, so that an envelope of another workload
+	//doesn't touch the versions
+	if workload != "" && header.Workload != workload {
+		plaintext.Destroy()
+		return nil, nil, fmt.Errorf("%s of workload %s for workload %s", item, header.Workload, workload)
+	}
+
+	err = versions.check(header.Workload, item, header.Version)
+	if err != nil {
+		plaintext.Destroy()
+		return nil, nil, err
+	}
+
+	log.Infof("Accepted %s of workload %s version %d", item, header.Workload, header.Version)
+	return plaintext, header, nil
+}
+
+//Load the trusted deployer keys from the guest image, and from the VM TEE
+//or the key broker when the secrets came from an attested source
+func loadTrustedKeys(attested bool) (crypto.TrustedKeys, error) {
+	if !attested {
+		return crypto.LoadTrustedKeys(rakshTrustedKeysDir)
+	}
+	return crypto.LoadTrustedKeys(rakshTrustedKeysDir,
+		filepath.Join(rakshSecretVMTEEMountPoint, trustedKeysFileName))
+}
+
+//Verify the deployer signature in sigFile over data
+func verifyDeployerSignature(trustedKeys crypto.TrustedKeys, data []byte, sigFile string) error {
+	sig, err := readSecretFile(sigFile)
+	if err != nil {
+		log.Errorf("Unable to read signature %s: %s", sigFile, err)
+		return err
+	}
+	defer sig.Destroy()
+	return trustedKeys.Verify(data, sig.Bytes())
+}
+
+//The signature of a user secret covers its name as well as its
+//encrypted value, so that values can't be swapped between names
+func userSecretSignedData(name string, value []byte) []byte {
+	data := make([]byte, 0, len(name)+1+len(value))
+	data = append(data, name...)
+	data = append(data, 0)
+	return append(data, value...)
+}
+
+//Raksh secrets from the VM TEE, key broker, host proxy or the Raksh
+//Kubernetes secret
+//Kept in secure buffers, until destroyed
+type rakshSecrets struct {
+	configMapKey *crypto.SecureBuffer
+	imageKey     *crypto.SecureBuffer
+	//Optional private key to unwrap the envelope content keys
+	envelopeKey *crypto.SecureBuffer
+	//Optional CA certificate and key issuing the workload identities
+	identityCA *crypto.SecureBuffer
+	//From the VM TEE or the key broker, which alone are trusted with
+	//trustedKeys, envelopeKey and identityCA
+	attested bool
+}
+
+//Retrieves the Raksh secrets into files in a directory
+type secretSource interface {
+	FetchSecrets(dir string, names ...string) error
+}
+
+//Raksh secrets released by the key broker
+type kbsSecrets struct {
+	client *kbs.Client
+	prefix string
+}
+
+func (s *kbsSecrets) FetchSecrets(dir string, names ...string) error {
+	return s.client.FetchResources(dir, s.prefix, names...)
+}
+
+//Whether source is the VM TEE or the key broker. The host proxy only
+//protects the transport, the host itself is not trusted.
+func attestedSource(source secretSource) bool {
+	switch source.(type) {
+	case nil, *vsock.Client:
+		return false
+	}
+	return true
+}
+
 //Read the Raksh secrets
-func readRakshSecrets(srcPath string) (configMapKey []byte, nonce []byte, imageKey []byte, err error) {
+//tee is the provider of the VM TEE, nil when not running in a TEE
+//source retrieves the secrets, the Raksh Kubernetes secret at srcPath
+//is used when nil
+func readRakshSecrets(srcPath string, config *hookConfig, tee crypto.TEEProvider, source secretSource) (*rakshSecrets, error) {
 
-	var configMapKeyFile, nonceFile, imageKeyFile string
+	var secretsDir string
 
 	log.Infof("Read Raksh secrets")
 
 	//Decrypt the secret data - local/remote attestation etc
-	if crypto.IsVMTEE() == true {
-		//VM TEE
-		err = crypto.PopulateSecretsForVMTEE()
+	attested := attestedSource(source)
+	if source != nil {
+		//VM TEE, key broker or host proxy
+		names := []string{configMapKeyFileName, imageKeyFileName}
+		if attested {
+			names = append(names, trustedKeysFileName, envelopeKeyFileName, identityCAFileName)
+		}
+		err := source.FetchSecrets(rakshSecretVMTEEMountPoint, names...)
 		if err != nil {
-			log.Errorf("Error populating secrets for TEE")
-			return nil, nil, nil, err
+			log.Errorf("Error populating secrets: %s", err)
+			return nil, err
 		}
-		configMapKeyFile = filepath.Join(rakshSecretVMTEEMountPoint, configMapKeyFileName)
-		imageKeyFile = filepath.Join(rakshSecretVMTEEMountPoint, imageKeyFileName)
-		nonceFile = filepath.Join(rakshSecretVMTEEMountPoint, nonceFileName)
-		log.Debug("Found secrets at: ", rakshSecretVMTEEMountPoint)
+		secretsDir = rakshSecretVMTEEMountPoint
 	} else {
 		//non VM TEE case
-		configMapKeyFile = filepath.Join(srcPath, configMapKeyFileName)
-		nonceFile = filepath.Join(srcPath, nonceFileName)
-		imageKeyFile = filepath.Join(srcPath, imageKeyFileName)
-		log.Debug("Found secrets at: ", srcPath)
+		secretsDir = srcPath
 	}
+	log.Debug("Found secrets at: ", secretsDir)
 
-	configMapKey, err = readSecretFile(configMapKeyFile)
+	var err error
+	secrets := &rakshSecrets{attested: attested}
+	if config.MasterKey != nil {
+		//No single source holds configMapKey
+		secrets.configMapKey, err = combineMasterKey(config.MasterKey, srcPath, tee)
+	} else {
+		secrets.configMapKey, err = readSecretFile(filepath.Join(secretsDir, configMapKeyFileName))
+	}
 	if err != nil {
-		return nil, nil, nil, err
+		secrets.destroy()
+		return nil, err
 	}
 
-	imageKey, err = readSecretFile(imageKeyFile)
+	secrets.imageKey, err = readSecretFile(filepath.Join(secretsDir, imageKeyFileName))
 	if err != nil {
-		return nil, nil, nil, err
+		secrets.destroy()
+		return nil, err
 	}
 
-	nonce, err = readSecretFile(nonceFile)
-	if err != nil {
-		return nil, nil, nil, err
+	//The envelope private key must never come from the host
+	envelopeKeyFile := filepath.Join(secretsDir, envelopeKeyFileName)
+	if source == nil && fileExists(envelopeKeyFile) == nil {
+		secrets.destroy()
+		return nil, fmt.Errorf("%s is in the Raksh Kubernetes secret, where the host can read it: provision it through the VM TEE or the key broker", envelopeKeyFileName)
+	}
+	if attested && fileExists(envelopeKeyFile) == nil {
+		secrets.envelopeKey, err = readSecretFile(envelopeKeyFile)
+		if err != nil {
+			secrets.destroy()
+			return nil, err
+		}
+	}
+
+	//The identity CA must never come from the host
+	identityCAFile := filepath.Join(secretsDir, identityCAFileName)
+	if attested && fileExists(identityCAFile) == nil {
+		secrets.identityCA, err = readSecretFile(identityCAFile)
+		if err != nil {
+			secrets.destroy()
+			return nil, err
+		}
 	}
 
-	return configMapKey, nonce, imageKey, nil
+	return secrets, nil
+}
+
+//Wipe the Raksh secrets from memory
+func (s *rakshSecrets) destroy() {
+	s.configMapKey.Destroy()
+	s.imageKey.Destroy()
+	s.envelopeKey.Destroy()
+	s.identityCA.Destroy()
+}
+
+//Keys to open the envelopes of the properties and user secrets
+func (s *rakshSecrets) envelopeKeys() (*crypto.EnvelopeKeys, error) {
+
+	keys := &crypto.EnvelopeKeys{Symmetric: s.configMapKey.Bytes()}
+	if s.envelopeKey.Len() != 0 {
+		privateKey, err := crypto.ParsePrivateKey(s.envelopeKey.Bytes())
+		if err != nil {
+			log.Errorf("Unable to parse the envelope private key: %s", err)
+			return nil, err
+		}
+		keys.Private = privateKey
+	}
+	return keys, nil
 }
 
 //Persist the decrypted configMap in memory
@@ -179,7 +448,8 @@ func persistDecryptedUserSecrets(fileName string, plaintextData []byte) error {
 }
 
 //Get the secrets from the relevant files
-func readSecretFile(fileName string) ([]byte, error) {
+//The secrets are decoded into a secure buffer, never into a Go string
+func readSecretFile(fileName string) (*crypto.SecureBuffer, error) {
 
 	err := fileExists(fileName)
 	if err != nil {
@@ -187,15 +457,59 @@ func readSecretFile(fileName string) ([]byte, error) {
 		return nil, err
 	}
 
-	//The secrets are base64 encoded
-	keyEnc, err := ioutil.ReadFile(fileName)
+	file, err := os.Open(fileName)
+	if err != nil {
+		log.Errorf("Could not open file %s: %s", fileName, err)
+		return nil, err
+	}
+	defer file.Close()
+
+	var size int
+	if info, err := file.Stat(); err == nil {
+		size = int(info.Size())
+	}
+
+	keyEnc, err := crypto.ReadSecureBuffer(file, size)
+	if err != nil {
+		log.Errorf("Could not read file %s: %s", fileName, err)
+		return nil, err
+	}
+	defer keyEnc.Destroy()
+
+	return decodeSecret(keyEnc)
+}
+
+//The secrets are base64 encoded
+func decodeSecret(keyEnc *crypto.SecureBuffer) (*crypto.SecureBuffer, error) {
+
+	keyDecoded, err := crypto.NewSecureBuffer(b64.StdEncoding.DecodedLen(keyEnc.Len()))
+	if err != nil {
+		return nil, err
+	}
+	n, err := b64.StdEncoding.Decode(keyDecoded.Bytes(), bytes.TrimSpace(keyEnc.Bytes()))
+	if err != nil {
+		keyDecoded.Destroy()
+		return nil, err
+	}
+	keyDecoded.Truncate(n)
+	return keyDecoded, nil
+}
+
+//Read an encrypted envelope from the file
+func readEncryptedFile(fileName string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		log.Errorf("Could not read file %s: %s", fileName, err)
 		return nil, err
 	}
 
-	keyDecoded, err := b64.StdEncoding.DecodeString(string(keyEnc))
-	return keyDecoded, err
+	data = bytes.TrimSpace(data)
+	if !crypto.IsEnvelope(data) {
+		log.Errorf("%s has no validity metadata, refusing to use it", fileName)
+		return nil, crypto.ErrNotEnvelope
+	}
+	return data, nil
 }
 
 //Check if the given file exists
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Envelope of plaintext for workload at version, and the keys opening it
+func sealTestEnvelope(t *testing.T, plaintext string, workload string, version uint64) ([]byte, *crypto.EnvelopeKeys) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := crypto.NewJWK(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	envelope, err := crypto.SealEnvelope([]byte(plaintext), crypto.EnvelopeHeader{
+		Workload: workload,
+		Version:  version,
+		IssuedAt: now.Unix(),
+		NotAfter: now.Add(time.Hour).Unix(),
+	}, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope, &crypto.EnvelopeKeys{Private: key}
+}
+
+func TestOpenEnvelope(t *testing.T) {
+	versions := &versionStore{dir: t.TempDir()}
+	envelope, keys := sealTestEnvelope(t, "db password", "payments/app", 2)
+
+	plaintext, header, err := openEnvelope(envelope, keys, "db", "payments/app", versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext.Bytes()) != "db password" || header.Version != 2 {
+		t.Errorf("opened %q version %d", plaintext.Bytes(), header.Version)
+	}
+	plaintext.Destroy()
+
+	older, keys := sealTestEnvelope(t, "old password", "payments/app", 1)
+	_, _, err = openEnvelope(older, keys, "db", "payments/app", versions)
+	if err == nil || !strings.Contains(err.Error(), "rollback") {
+		t.Errorf("rollback error = %v", err)
+	}
+}
+
+func TestOpenEnvelopeOtherWorkload(t *testing.T) {
+	dir := t.TempDir()
+	versions := &versionStore{dir: dir}
+	envelope, keys := sealTestEnvelope(t, "db password", "other/app", 7)
+
+	_, _, err := openEnvelope(envelope, keys, "db", "payments/app", versions)
+	if err == nil || !strings.Contains(err.Error(), "of workload other/app for workload payments/app") {
+		t.Fatalf("error = %v", err)
+	}
+	//The envelope of the other workload must not raise any mark
+	marks, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 0 {
+		t.Errorf("%d version marks written for a rejected envelope", len(marks))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+const (
+	//Limits for fetching a share from a local key broker
+	brokerShareTimeout = 10 * time.Second
+	brokerShareMaxSize = 64 * 1024
+)
+
+//Reconstruct configMapKey from the shares available. Combinations of
+//threshold shares are tried until one gives the key of the key check, so
+//that a wrong share from a faulty or malicious source is outvoted.
+func combineMasterKey(config *masterKeyConfig, srcPath string, tee crypto.TEEProvider) (*crypto.SecureBuffer, error) {
+
+	log.Infof("Reconstructing configMapKey from %d of %d shares", config.Threshold, len(config.Shares))
+	keyCheck, err := hex.DecodeString(config.KeyCheck)
+	if err != nil || len(keyCheck) != sha256.Size {
+		return nil, errors.New("invalid configMapKey key check")
+	}
+
+	var shares []*crypto.SecureBuffer
+	var sources []string
+	defer func() {
+		for _, share := range shares {
+			share.Destroy()
+		}
+	}()
+
+	for _, source := range config.Shares {
+		share, err := readShare(source, srcPath, tee)
+		if err != nil {
+			log.Errorf("Unable to get %s share %s: %s", source.Type, source.Path, err)
+			continue
+		}
+		log.Infof("Got %s share %s", source.Type, source.Path)
+		shares = append(shares, share)
+		sources = append(sources, source.Type+" "+source.Path)
+	}
+
+	if len(shares) < config.Threshold {
+		return nil, fmt.Errorf("only %d of %d configMapKey shares available", len(shares), config.Threshold)
+	}
+
+	var key *crypto.SecureBuffer
+	combination := make([][]byte, config.Threshold)
+	combinations(len(shares), config.Threshold, func(indices []int) bool {
+		for i, index := range indices {
+			combination[i] = shares[index].Bytes()
+		}
+		combined, err := crypto.CombineShares(combination)
+		if err != nil {
+			log.Debugf("Unable to combine shares %v: %s", indices, err)
+			return true
+		}
+		digest := sha256.Sum256(combined.Bytes())
+		if subtle.ConstantTimeCompare(digest[:], keyCheck) == 1 {
+			key = combined
+			return false
+		}
+		combined.Destroy()
+		log.Warnf("Shares %v don't give configMapKey", indices)
+		return true
+	})
+	if key == nil {
+		return nil, fmt.Errorf("no %d of the configMapKey shares %v give configMapKey", config.Threshold, sources)
+	}
+	return key, nil
+}
+
+//Call f with each combination of k of the indices 0 to n-1, in
+//lexicographic order, until it returns false
+func combinations(n int, k int, f func(indices []int) bool) {
+	indices := make([]int, k)
+	for i := range indices {
+		indices[i] = i
+	}
+	for {
+		if !f(indices) {
+			return
+		}
+		//Advance the rightmost index which can still move
+		i := k - 1
+		for i >= 0 && indices[i] == n-k+i {
+			i--
+		}
+		if i < 0 {
+			return
+		}
+		indices[i]++
+		for j := i + 1; j < k; j++ {
+			indices[j] = indices[j-1] + 1
+		}
+	}
+}
+
+//Read a single share from its source
+func readShare(source shareSource, srcPath string, tee crypto.TEEProvider) (*crypto.SecureBuffer, error) {
+
+	switch source.Type {
+	case shareSourceTEE:
+		if tee == nil {
+			return nil, errors.New("not running in a VM TEE")
+		}
+		err := tee.FetchSecrets(rakshSecretVMTEEMountPoint, source.Path)
+		if err != nil {
+			return nil, err
+		}
+		return readSecretFile(filepath.Join(rakshSecretVMTEEMountPoint, source.Path))
+	case shareSourceSecret:
+		return readSecretFile(filepath.Join(srcPath, source.Path))
+	case shareSourceFile:
+		return readSecretFile(source.Path)
+	case shareSourceBroker:
+		return fetchBrokerShare(source)
+	}
+	return nil, fmt.Errorf("unknown share type %q", source.Type)
+}
+
+//Fetch a share from a local key broker, over HTTPS or a unix socket
+func fetchBrokerShare(source shareSource) (*crypto.SecureBuffer, error) {
+
+	transport := &http.Transport{}
+	if source.Socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", source.Socket)
+		}
+	}
+	if source.CACert != "" {
+		pem, err := ioutil.ReadFile(source.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates in %s", source.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	client := &http.Client{Timeout: brokerShareTimeout, Transport: transport}
+	resp, err := client.Get(source.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key broker returned %s", resp.Status)
+	}
+
+	shareEnc, err := crypto.ReadSecureBuffer(io.LimitReader(resp.Body, brokerShareMaxSize), 512)
+	if err != nil {
+		return nil, err
+	}
+	defer shareEnc.Destroy()
+	return decodeSecret(shareEnc)
+}
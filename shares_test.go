@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raksh-oci-hook/pkg/crypto"
+)
+
+//Split a random configMapKey into n shares of which k combine, in base64
+//files of dir. Returns the key and the shares configuration.
+func writeTestShares(t *testing.T, dir string, k int, n int) ([]byte, *masterKeyConfig) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := crypto.SplitSecret(key, n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(key)
+	config := &masterKeyConfig{Threshold: k, KeyCheck: hex.EncodeToString(digest[:])}
+	for i, share := range shares {
+		path := filepath.Join(dir, "share"+string(rune('a'+i)))
+		err = ioutil.WriteFile(path, []byte(b64.StdEncoding.EncodeToString(share)+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Shares = append(config.Shares, shareSource{Type: shareSourceFile, Path: path})
+	}
+	return key, config
+}
+
+//Replace the share of source with a corrupted one
+func corruptShare(t *testing.T, source shareSource) {
+	data, err := ioutil.ReadFile(source.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := b64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	share[0] ^= 0x5a
+	err = ioutil.WriteFile(source.Path, []byte(b64.StdEncoding.EncodeToString(share)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCombineMasterKey(t *testing.T) {
+	tests := []struct {
+		name string
+		k, n int
+		//Shares which are corrupted or missing
+		corrupt []int
+		missing []int
+		err     string
+	}{
+		{"2 of 3", 2, 3, nil, nil, ""},
+		{"3 of 5", 3, 5, nil, nil, ""},
+		{"one of k+1 bad", 2, 3, []int{0}, nil, ""},
+		{"last of k+1 bad", 3, 4, []int{3}, nil, ""},
+		{"one missing", 3, 4, nil, []int{1}, ""},
+		{"fewer than k", 3, 4, nil, []int{0, 2}, "only 2 of 3 configMapKey shares available"},
+		{"bad share of k", 2, 2, []int{1}, nil, "no 2 of the configMapKey shares"},
+		{"two of k+1 bad", 2, 3, []int{0, 2}, nil, "no 2 of the configMapKey shares"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			key, config := writeTestShares(t, dir, test.k, test.n)
+			for _, i := range test.corrupt {
+				corruptShare(t, config.Shares[i])
+			}
+			for _, i := range test.missing {
+				config.Shares[i].Path = filepath.Join(dir, "missing")
+			}
+
+			combined, err := combineMasterKey(config, dir, nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer combined.Destroy()
+			if !bytes.Equal(combined.Bytes(), key) {
+				t.Error("wrong configMapKey")
+			}
+		})
+	}
+}
+
+func TestCombineMasterKeyCheck(t *testing.T) {
+	dir := t.TempDir()
+	_, config := writeTestShares(t, dir, 2, 3)
+
+	config.KeyCheck = "00" + config.KeyCheck[2:]
+	_, err := combineMasterKey(config, dir, nil)
+	if err == nil {
+		t.Error("shares accepted for another key check")
+	}
+	config.KeyCheck = "not hex"
+	_, err = combineMasterKey(config, dir, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid configMapKey key check") {
+		t.Errorf("invalid key check error = %v", err)
+	}
+}
+
+func TestCombineMasterKeyTEE(t *testing.T) {
+	dir := t.TempDir()
+	_, config := writeTestShares(t, dir, 2, 2)
+	config.Shares[0] = shareSource{Type: shareSourceTEE, Path: "configMapKeyShare"}
+	_, err := combineMasterKey(config, dir, nil)
+	if err == nil || !strings.Contains(err.Error(), "only 1 of 2") {
+		t.Errorf("error without a TEE = %v", err)
+	}
+}
+
+func TestBrokerShare(t *testing.T) {
+	dir := t.TempDir()
+	key, config := writeTestShares(t, dir, 2, 3)
+	share, err := ioutil.ReadFile(config.Shares[2].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "broker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/shares/raksh" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(share)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	config.Shares[2] = shareSource{Type: shareSourceBroker, Path: "http://broker/shares/raksh", Socket: socket}
+	corruptShare(t, config.Shares[0])
+	combined, err := combineMasterKey(config, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer combined.Destroy()
+	if !bytes.Equal(combined.Bytes(), key) {
+		t.Error("wrong configMapKey")
+	}
+
+	_, err = fetchBrokerShare(shareSource{Type: shareSourceBroker, Path: "http://broker/other", Socket: socket})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing share error = %v", err)
+	}
+}
+
+func TestCombinations(t *testing.T) {
+	var got [][]int
+	combinations(4, 2, func(indices []int) bool {
+		got = append(got, append([]int(nil), indices...))
+		return true
+	})
+	want := [][]int{{0, 1}, {0, 2}, {0, 3}, {1, 2}, {1, 3}, {2, 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("combinations = %v, want %v", got, want)
+	}
+
+	calls := 0
+	combinations(5, 3, func([]int) bool {
+		calls++
+		return calls < 2
+	})
+	if calls != 2 {
+		t.Errorf("%d calls after stopping at the second", calls)
+	}
+}